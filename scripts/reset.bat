@@ -7,7 +7,7 @@ if not exist "%EXE%" (
   exit /b 1
 )
 
-"%EXE%" reset
+"%EXE%" reset %*
 if errorlevel 1 exit /b 1
 echo Reset completed
 exit /b 0
@@ -0,0 +1,210 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// Per-win announcements (discordAnnounceEnabled).
+// Besides the summary edit, each win is posted as its own short message so it
+// stands out in a busy channel. Jackpots and reward threshold crossings (e.g. a
+// user newly reaching Gif) use the highlight template and color. Regular
+// announcements are limited to discordAnnouncePerMinute; highlights are always
+// posted. With discordAnnounceDeleteAfterMin > 0 the messages are deleted after
+// that many minutes (by the API server, or by the next announcement).
+// Sent messages and the rate window live in data/discord_announce.json.
+
+const (
+    announceColor          = 0x3B82F6 // blue-500
+    announceHighlightColor = 0xF59E0B // amber-500
+)
+
+type announceData struct {
+    User      User
+    Tier      string     // tier label of this win, e.g. 大当たり
+    Counter   string     // tier counter, e.g. jackpot
+    Jackpot   bool       // win on a tier with highlight (jackpot by default)
+    Crossed   bool       // the win moved the user up to Reward
+    Reward    RewardRule // current reward (zero if none)
+    Prev      RewardRule // reward before this win (zero if none)
+    Emoji     string
+    Ref       string
+}
+
+type announcedMessage struct {
+    ID       string `json:"id"`
+    Name     string `json:"name,omitempty"`
+    ThreadID string `json:"threadId,omitempty"`
+    PostedAt string `json:"postedAt"`
+    DeleteAt string `json:"deleteAt,omitempty"`
+}
+
+type announceLog struct {
+    Recent   []string           `json:"recent"` // post times of regular announcements (last minute)
+    Messages []announcedMessage `json:"messages"`
+}
+
+func announcePath(base string) string { return filepath.Join(base, "data", "discord_announce.json") }
+
+func loadAnnounceLog(base string) (announceLog, error) {
+    var l announceLog
+    b, err := os.ReadFile(announcePath(base))
+    if err != nil {
+        if os.IsNotExist(err) { return l, nil }
+        return l, err
+    }
+    err = json.Unmarshal(b, &l)
+    return l, err
+}
+
+func saveAnnounceLog(base string, l announceLog) error {
+    b, err := json.MarshalIndent(l, "", "  ")
+    if err != nil { return err }
+    return writeFileAtomic(announcePath(base), b)
+}
+
+// buildAnnounceData describes a win event; ok is false for other events or
+// when the user snapshot is missing.
+func buildAnnounceData(ev ChangeEvent, cfg Settings, tiers []PrizeTier) (announceData, bool) {
+    if ev.Type != journalWin || ev.User == nil { return announceData{}, false }
+    rules, _ := rulesFromSettings(cfg)
+    u := *ev.User
+    d := announceData{User: u, Counter: ev.Counter, Tier: ev.Counter}
+    for _, t := range tiers {
+        if t.Counter != ev.Counter { continue }
+        d.Tier = t.Label
+        d.Jackpot = t.Highlight
+        break
+    }
+    // state before the win: same user with one win less on this counter
+    prev := u
+    prev.Counts = map[string]int{}
+    for k, v := range u.Counts { prev.Counts[k] = v }
+    normalizeUserCounts(&prev)
+    if prev.Counts[ev.Counter] > 0 { prev.Counts[ev.Counter]-- }
+    normalizeUserCounts(&prev)
+    recomputeUser(&prev, rules)
+    if r, ok := findRewardRule(rules, u.Present); ok { d.Reward = r.RewardRule }
+    if r, ok := findRewardRule(rules, prev.Present); ok { d.Prev = r.RewardRule }
+    // reaching the entry reward (the first win) is not a crossing
+    entry := len(rules) > 0 && rules[len(rules)-1].Name == u.Present
+    d.Crossed = u.Present != "" && u.Present != prev.Present && !entry
+    for _, g := range buildSummaryGroups(State{Users: []User{u}}, cfg) {
+        for _, l := range g.Lines { d.Emoji, d.Ref = l.Emoji, l.Ref }
+    }
+    return d, true
+}
+
+// announceWins posts one message per win event. Failures are logged only (an
+// announcement is not worth a retry; the summary carries the state).
+func announceWins(base string, events []ChangeEvent) {
+    cfg := loadSettings(base)
+    if !cfg.DiscordAnnounceEnabled || !discordConfigured() { return }
+    if !cfg.DiscordEnabled && !isTruthy(os.Getenv("DISCORD_NOTIFY")) { return }
+    tpl, _ := compileDiscordTemplates(cfg.DiscordTemplates)
+    tiers := loadTiers(base, cfg)
+    l, err := loadAnnounceLog(base)
+    if err != nil {
+        _ = appendAppLog(base, "warn: read discord_announce.json failed: "+err.Error())
+        l = announceLog{}
+    }
+    now := time.Now().UTC()
+    recent := l.Recent[:0]
+    for _, s := range l.Recent {
+        if t, err := time.Parse(time.RFC3339Nano, s); err == nil && now.Sub(t) < time.Minute { recent = append(recent, s) }
+    }
+    l.Recent = recent
+    thread := currentThread(base)
+    changed := false
+    for _, ev := range events {
+        d, ok := buildAnnounceData(ev, cfg, tiers)
+        if !ok { continue }
+        highlight := d.Jackpot || d.Crossed
+        if !highlight && cfg.DiscordAnnouncePerMinute > 0 && len(l.Recent) >= cfg.DiscordAnnouncePerMinute {
+            _ = appendAppLog(base, fmt.Sprintf("info: discord announce skipped (rate limit %d/min): %s", cfg.DiscordAnnouncePerMinute, d.User.Name))
+            continue
+        }
+        e := DiscordEmbed{Description: tpl.announce.render(d), Color: announceColor}
+        if highlight {
+            e = DiscordEmbed{Description: tpl.announceHighlight.render(d), Color: announceHighlightColor}
+        }
+        if strings.TrimSpace(e.Description) == "" { continue }
+        id, mode, err := discordPostMessage(thread, DiscordMessage{Embeds: []DiscordEmbed{e}})
+        if err != nil {
+            _ = appendAppLog(base, "warn: discord "+mode+" announce failed: "+err.Error())
+            continue
+        }
+        _ = appendAppLog(base, "info: discord "+mode+" announce ok: "+d.User.Name)
+        if !highlight { l.Recent = append(l.Recent, now.Format(time.RFC3339Nano)) }
+        if cfg.DiscordAnnounceDeleteAfterMin > 0 && id != "" {
+            at := now.Add(time.Duration(cfg.DiscordAnnounceDeleteAfterMin) * time.Minute)
+            l.Messages = append(l.Messages, announcedMessage{ID: id, Name: d.User.Name, ThreadID: thread, PostedAt: now.Format(time.RFC3339), DeleteAt: at.Format(time.RFC3339)})
+        }
+        changed = true
+    }
+    if changed {
+        if err := saveAnnounceLog(base, l); err != nil {
+            _ = appendAppLog(base, "warn: save discord_announce.json failed: "+err.Error())
+        }
+    }
+}
+
+// announceHasExpired reports whether an announcement is due for deletion.
+func announceHasExpired(base string, now time.Time) bool {
+    l, err := loadAnnounceLog(base)
+    if err != nil { return false }
+    for _, m := range l.Messages {
+        if t, err := time.Parse(time.RFC3339, m.DeleteAt); err == nil && !t.After(now) { return true }
+    }
+    return false
+}
+
+// deleteExpiredAnnouncements deletes announcements past their DeleteAt. A
+// message that is already gone is forgotten; other failures are retried later.
+// Callers hold the notify lock.
+func deleteExpiredAnnouncements(base string) error {
+    l, err := loadAnnounceLog(base)
+    if err != nil || len(l.Messages) == 0 { return err }
+    now := time.Now()
+    keep := l.Messages[:0]
+    for _, m := range l.Messages {
+        t, perr := time.Parse(time.RFC3339, m.DeleteAt)
+        if perr != nil || t.After(now) {
+            keep = append(keep, m)
+            continue
+        }
+        if err := discordDeleteMessage(m.ThreadID, m.ID); err != nil && !isDiscordNotFound(err) {
+            _ = appendAppLog(base, "warn: discord announce delete failed: id="+m.ID+": "+err.Error())
+            keep = append(keep, m)
+            continue
+        }
+        _ = appendAppLog(base, "info: discord announce deleted: id="+m.ID)
+    }
+    if len(keep) == len(l.Messages) { return nil }
+    l.Messages = keep
+    return saveAnnounceLog(base, l)
+}
+
+// discordPostMessage posts a new message with the configured transport (bot
+// preferred), inside threadID when set, and returns its ID.
+func discordPostMessage(threadID string, payload DiscordMessage) (string, string, error) {
+    token := strings.TrimSpace(os.Getenv("DISCORD_BOT_TOKEN"))
+    channelID := strings.TrimSpace(os.Getenv("DISCORD_CHANNEL_ID"))
+    if token != "" && channelID != "" {
+        if threadID != "" { channelID = threadID }
+        id, err := discordBotPost(token, channelID, payload)
+        return id, "bot", err
+    }
+    if raw := strings.TrimSpace(os.Getenv("DISCORD_WEBHOOK_URL")); raw != "" {
+        info, err := parseWebhook(raw)
+        if err != nil { return "", "webhook", err }
+        info.Thread = threadID
+        id, err := discordWebhookPost(info, payload)
+        return id, "webhook", err
+    }
+    return "", "", errNoDiscordCredentials
+}
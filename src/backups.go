@@ -0,0 +1,398 @@
+package main
+
+import (
+    "bytes"
+    "compress/gzip"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+)
+
+// Backup retention and compression (setting.json "backupRetention").
+// After every backup, and with `gacha prune-backups`, the backups are sorted
+// newest first and a backup is kept when any rule selects it:
+//   keepLast N     the newest N backups
+//   keepDaily N    the newest backup of each of the last N days that have one
+//   keepWeekly N   the same per ISO week, keepMonthly N per month
+// Everything else is deleted (with its .js). With every keep* at 0 nothing is
+// deleted. compressAfter N gzips the kept backups older than the newest N to
+// NAME.json.gz and drops their .js wrapper; doRestore and genBackupIndex read
+// both forms, and the history view loads compressed ones through /api/backup.
+// The newest backup is never deleted or compressed.
+
+type BackupRetention struct {
+    KeepLast      int `json:"keepLast"`
+    KeepDaily     int `json:"keepDaily"`
+    KeepWeekly    int `json:"keepWeekly"`
+    KeepMonthly   int `json:"keepMonthly"`
+    CompressAfter int `json:"compressAfter"`
+}
+
+func (p BackupRetention) prunes() bool {
+    return p.KeepLast > 0 || p.KeepDaily > 0 || p.KeepWeekly > 0 || p.KeepMonthly > 0
+}
+
+func (p BackupRetention) enabled() bool { return p.prunes() || p.CompressAfter > 0 }
+
+const gzExt = ".gz"
+
+// backupStem returns the backup name without .json/.json.gz/.js.
+func backupStem(name string) string {
+    name = filepath.Base(name)
+    low := strings.ToLower(name)
+    for _, ext := range []string{".json.gz", ".json", ".js"} {
+        if strings.HasSuffix(low, ext) { return name[:len(name)-len(ext)] }
+    }
+    return name
+}
+
+func isBackupFile(name string) bool {
+    low := strings.ToLower(name)
+    return strings.HasSuffix(low, ".json") || strings.HasSuffix(low, ".json.gz")
+}
+
+// listBackups returns the backup file names (.json and .json.gz), newest first.
+func listBackups(base string) ([]string, error) {
+    entries, err := os.ReadDir(backupDir(base))
+    if err != nil {
+        if os.IsNotExist(err) { return nil, nil }
+        return nil, err
+    }
+    var files []string
+    for _, e := range entries {
+        if !e.IsDir() && isBackupFile(e.Name()) { files = append(files, e.Name()) }
+    }
+    sort.Slice(files, func(i, j int) bool { return files[i] > files[j] })
+    return files, nil
+}
+
+// findBackup resolves a backup given as NAME, NAME.json, NAME.js or
+// NAME.json.gz to the file on disk (plain JSON first).
+func findBackup(base, name string) (string, error) {
+    stem := backupStem(name)
+    for _, ext := range []string{".json", ".json" + gzExt} {
+        p := filepath.Join(backupDir(base), stem+ext)
+        if _, err := os.Stat(p); err == nil { return p, nil }
+    }
+    return "", fmt.Errorf("backup %s: %w", stem, os.ErrNotExist)
+}
+
+// readBackupFile returns the JSON of a backup file, decompressing .gz files.
+func readBackupFile(p string) ([]byte, error) {
+    b, err := os.ReadFile(p)
+    if err != nil || !strings.HasSuffix(strings.ToLower(p), gzExt) { return b, err }
+    zr, err := gzip.NewReader(bytes.NewReader(b))
+    if err != nil { return nil, fmt.Errorf("%s: %w", filepath.Base(p), err) }
+    defer zr.Close()
+    out, err := io.ReadAll(zr)
+    if err != nil { return nil, fmt.Errorf("%s: %w", filepath.Base(p), err) }
+    return out, nil
+}
+
+// compressBackup replaces NAME.json with NAME.json.gz and removes NAME.js.
+func compressBackup(p string) (string, error) {
+    b, err := os.ReadFile(p)
+    if err != nil { return "", err }
+    zb, err := gzipBytes(filepath.Base(p), b)
+    if err != nil { return "", err }
+    gz := p + gzExt
+    if err := writeFileAtomic(gz, zb); err != nil { return "", err }
+    if err := os.Remove(p); err != nil { return gz, err }
+    _ = os.Remove(strings.TrimSuffix(p, filepath.Ext(p)) + ".js")
+    return gz, nil
+}
+
+// backupTime is the time in the backup name (local time, as written by
+// doBackup), or the file's modification time for other names.
+func backupTime(dir, name string) time.Time {
+    if t, err := time.ParseInLocation("2006-01-02_150405", backupStem(name), time.Local); err == nil { return t }
+    if fi, err := os.Stat(filepath.Join(dir, name)); err == nil { return fi.ModTime() }
+    return time.Time{}
+}
+
+type pruneEntry struct {
+    Name   string `json:"name"`
+    Action string `json:"action"` // keep, compress, delete
+    Reason string `json:"reason,omitempty"`
+    Error  string `json:"error,omitempty"`
+}
+
+type pruneReport struct {
+    Kept       int          `json:"kept"`
+    Compressed int          `json:"compressed"`
+    Deleted    int          `json:"deleted"`
+    Errors     int          `json:"errors"`
+    Entries    []pruneEntry `json:"entries"`
+}
+
+// planPrune decides what happens to names (newest first, times alongside).
+func planPrune(names []string, times []time.Time, p BackupRetention) []pruneEntry {
+    reasons := make([][]string, len(names))
+    bucket := func(n int, label string, key func(time.Time) string) {
+        seen := map[string]bool{}
+        for i := range names {
+            if len(seen) >= n { break }
+            k := key(times[i])
+            if seen[k] { continue }
+            seen[k] = true
+            reasons[i] = append(reasons[i], label)
+        }
+    }
+    for i := range names {
+        if i < p.KeepLast { reasons[i] = append(reasons[i], "last") }
+    }
+    bucket(p.KeepDaily, "daily", func(t time.Time) string { return t.Format("2006-01-02") })
+    bucket(p.KeepWeekly, "weekly", func(t time.Time) string { y, w := t.ISOWeek(); return fmt.Sprintf("%d-W%02d", y, w) })
+    bucket(p.KeepMonthly, "monthly", func(t time.Time) string { return t.Format("2006-01") })
+    out := make([]pruneEntry, 0, len(names))
+    for i, n := range names {
+        e := pruneEntry{Name: n, Action: "keep", Reason: strings.Join(reasons[i], ",")}
+        switch {
+        case i == 0:
+            if e.Reason == "" { e.Reason = "newest" }
+        case p.prunes() && len(reasons[i]) == 0:
+            e.Action = "delete"
+        case p.CompressAfter > 0 && i >= p.CompressAfter && !strings.HasSuffix(strings.ToLower(n), gzExt):
+            e.Action = "compress"
+        }
+        out = append(out, e)
+    }
+    return out
+}
+
+// pruneBackups applies the backupRetention policy (only reports with dryRun).
+// Callers regenerate backups/index.js afterwards.
+func pruneBackups(base string, p BackupRetention, dryRun bool) (pruneReport, error) {
+    var rep pruneReport
+    names, err := listBackups(base)
+    if err != nil { return rep, err }
+    dir := backupDir(base)
+    times := make([]time.Time, len(names))
+    for i, n := range names {
+        times[i] = backupTime(dir, n)
+    }
+    rep.Entries = planPrune(names, times, p)
+    for i := range rep.Entries {
+        e := &rep.Entries[i]
+        path := filepath.Join(dir, e.Name)
+        if !dryRun {
+            var err error
+            switch e.Action {
+            case "delete":
+                err = os.Remove(path)
+                if err == nil && !strings.HasSuffix(strings.ToLower(e.Name), gzExt) {
+                    if rerr := os.Remove(strings.TrimSuffix(path, filepath.Ext(path)) + ".js"); rerr != nil && !errors.Is(rerr, os.ErrNotExist) { err = rerr }
+                }
+            case "compress":
+                _, err = compressBackup(path)
+            }
+            if err != nil {
+                e.Error = err.Error()
+                rep.Errors++
+                continue
+            }
+        }
+        switch e.Action {
+        case "keep":
+            rep.Kept++
+        case "compress":
+            rep.Compressed++
+        case "delete":
+            rep.Deleted++
+        }
+    }
+    if !dryRun && (rep.Deleted > 0 || rep.Compressed > 0) {
+        _ = appendAppLog(base, fmt.Sprintf("prune-backups: kept=%d compressed=%d deleted=%d errors=%d", rep.Kept, rep.Compressed, rep.Deleted, rep.Errors))
+    }
+    return rep, nil
+}
+
+func printPruneReport(w io.Writer, rep pruneReport, dryRun bool) {
+    verbs := map[string]string{"keep": "keep", "compress": "compressed", "delete": "deleted"}
+    if dryRun { verbs = map[string]string{"keep": "keep", "compress": "would compress", "delete": "would delete"} }
+    for _, e := range rep.Entries {
+        line := fmt.Sprintf("%-16s %s", verbs[e.Action], e.Name)
+        if e.Reason != "" { line += " (" + e.Reason + ")" }
+        if e.Error != "" { line += " error: " + e.Error }
+        fmt.Fprintln(w, line)
+    }
+    fmt.Fprintf(w, "prune-backups: kept=%d compressed=%d deleted=%d errors=%d\n", rep.Kept, rep.Compressed, rep.Deleted, rep.Errors)
+}
+
+// Backup metadata.
+// doBackup stores a "meta" object next to the state in the backup file, so it
+// travels with the file through compression; restore ignores it. Backups
+// written before metadata existed get the user count and totals derived from
+// their state. The label and note can be changed later (setBackupMeta).
+
+type BackupMeta struct {
+    SessionID    string         `json:"sessionId,omitempty"`
+    SessionStart string         `json:"sessionStart,omitempty"`
+    SessionEnd   string         `json:"sessionEnd,omitempty"` // when the backup was taken
+    Users        int            `json:"users"`
+    Totals       map[string]int `json:"totals"` // per-counter sum over all users
+    Label        string         `json:"label,omitempty"`
+    Note         string         `json:"note,omitempty"`
+}
+
+// backupFile is the layout of backups/*.json.
+type backupFile struct {
+    State
+    Meta *BackupMeta `json:"meta,omitempty"`
+}
+
+type backupInfo struct {
+    Name       string     `json:"name"`
+    Compressed bool       `json:"compressed,omitempty"`
+    Meta       BackupMeta `json:"meta"`
+}
+
+const (
+    backupLabelMax = 100
+    backupNoteMax  = 1000
+)
+
+func stateTotals(st State) map[string]int {
+    totals := map[string]int{}
+    for _, u := range st.Users {
+        for k, v := range u.Counts {
+            totals[k] += v
+        }
+    }
+    return totals
+}
+
+// newBackupMeta describes st as the end of the current session.
+func newBackupMeta(base string, st State, label, note string) BackupMeta {
+    m := BackupMeta{
+        SessionEnd: time.Now().UTC().Format(time.RFC3339), Users: len(st.Users), Totals: stateTotals(st),
+        Label: truncateRunes(strings.TrimSpace(label), backupLabelMax), Note: truncateRunes(strings.TrimSpace(note), backupNoteMax),
+    }
+    if s, ok := loadSession(base); ok {
+        m.SessionID, m.SessionStart = s.ID, s.StartedAt
+    }
+    return m
+}
+
+// gzipBytes compresses b, recording name as the original file name.
+func gzipBytes(name string, b []byte) ([]byte, error) {
+    var buf bytes.Buffer
+    zw := gzip.NewWriter(&buf)
+    zw.Name = name
+    if _, err := zw.Write(b); err != nil { return nil, err }
+    if err := zw.Close(); err != nil { return nil, err }
+    return buf.Bytes(), nil
+}
+
+// readBackupMeta returns the metadata of the backup file at p.
+func readBackupMeta(p string) (BackupMeta, error) {
+    b, err := readBackupFile(p)
+    if err != nil { return BackupMeta{}, err }
+    var f struct {
+        Meta *BackupMeta `json:"meta"`
+    }
+    if err := json.Unmarshal(b, &f); err != nil { return BackupMeta{}, fmt.Errorf("%s: %w", filepath.Base(p), err) }
+    if f.Meta != nil {
+        if f.Meta.Totals == nil { f.Meta.Totals = map[string]int{} }
+        return *f.Meta, nil
+    }
+    st, err := decodeState(b)
+    if err != nil { return BackupMeta{}, fmt.Errorf("%s: %w", filepath.Base(p), err) }
+    return BackupMeta{SessionEnd: st.UpdatedAt, Users: len(st.Users), Totals: stateTotals(st)}, nil
+}
+
+// listBackupInfo lists the backups with their metadata, newest first.
+// Unreadable backups are listed with empty metadata.
+func listBackupInfo(base string) ([]backupInfo, error) {
+    names, err := listBackups(base)
+    if err != nil { return nil, err }
+    out := make([]backupInfo, 0, len(names))
+    for _, n := range names {
+        meta, err := readBackupMeta(filepath.Join(backupDir(base), n))
+        if err != nil {
+            meta = BackupMeta{Totals: map[string]int{}}
+        }
+        out = append(out, backupInfo{Name: n, Compressed: strings.HasSuffix(strings.ToLower(n), gzExt), Meta: meta})
+    }
+    return out, nil
+}
+
+// setBackupMeta changes the label and/or note (nil leaves a field as it is) of
+// a backup and regenerates its .js and backups/index.js.
+func setBackupMeta(base, name string, label, note *string) (BackupMeta, error) {
+    var meta BackupMeta
+    err := withLock(base, func() error {
+        p, err := findBackup(base, name)
+        if err != nil { return err }
+        if meta, err = readBackupMeta(p); err != nil { return err }
+        b, err := readBackupFile(p)
+        if err != nil { return err }
+        // keep the document as written (no migration), only replace "meta"
+        var doc map[string]any
+        if err := json.Unmarshal(b, &doc); err != nil { return err }
+        if doc == nil { return fmt.Errorf("%s: not a backup", filepath.Base(p)) }
+        if label != nil { meta.Label = truncateRunes(strings.TrimSpace(*label), backupLabelMax) }
+        if note != nil { meta.Note = truncateRunes(strings.TrimSpace(*note), backupNoteMax) }
+        doc["meta"] = meta
+        nb, err := json.MarshalIndent(doc, "", "  ")
+        if err != nil { return err }
+        if strings.HasSuffix(strings.ToLower(p), gzExt) {
+            if nb, err = gzipBytes(strings.TrimSuffix(filepath.Base(p), gzExt), nb); err != nil { return err }
+            if err := writeFileAtomic(p, nb); err != nil { return err }
+        } else {
+            if err := writeFileAtomic(p, nb); err != nil { return err }
+            if err := ensureBackupJS(base, p); err != nil {
+                _ = appendAppLog(base, "warn: ensureBackupJS failed: "+err.Error())
+            }
+        }
+        if err := genBackupIndex(base); err != nil {
+            _ = appendAppLog(base, "warn: genBackupIndex failed: "+err.Error())
+        }
+        return appendAppLog(base, fmt.Sprintf("backup meta: %s label=%q", filepath.Base(p), meta.Label))
+    })
+    return meta, err
+}
+
+// parseBackupMetaFlags reads --label/--note from CLI arguments.
+func parseBackupMetaFlags(args []string) (label, note *string, err error) {
+    for i := 0; i < len(args); i++ {
+        a := args[i]
+        if (a == "--label" || a == "--note") && i+1 < len(args) {
+            v := args[i+1]
+            if a == "--label" { label = &v } else { note = &v }
+            i++
+            continue
+        }
+        return nil, nil, fmt.Errorf("unknown argument: %s", a)
+    }
+    return label, note, nil
+}
+
+// deref returns *p, or "" for nil.
+func deref(p *string) string {
+    if p == nil { return "" }
+    return *p
+}
+
+func printBackupInfo(w io.Writer, bi backupInfo) {
+    keys := make([]string, 0, len(bi.Meta.Totals))
+    for k := range bi.Meta.Totals {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    var tot []string
+    for _, k := range keys {
+        tot = append(tot, fmt.Sprintf("%s=%d", k, bi.Meta.Totals[k]))
+    }
+    line := fmt.Sprintf("%s  users=%d %s", bi.Name, bi.Meta.Users, strings.Join(tot, " "))
+    if bi.Meta.SessionID != "" { line += "  session=" + bi.Meta.SessionID }
+    if bi.Meta.Label != "" { line += fmt.Sprintf("  [%s]", bi.Meta.Label) }
+    fmt.Fprintln(w, line)
+    if bi.Meta.Note != "" { fmt.Fprintln(w, "    "+strings.ReplaceAll(bi.Meta.Note, "\n", "\n    ")) }
+}
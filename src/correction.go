@@ -0,0 +1,141 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "sort"
+    "strings"
+    "time"
+)
+
+// Corrections for mistaken wins (tanuesa misfires, moderator tests).
+// Both operations go through the journal as "adjust" entries so that rebuild and
+// replay stay consistent with current.json.
+
+var (
+    errNothingToUndo  = errors.New("nothing to undo")
+    errUserNotFound   = errors.New("not found")
+    errUnknownCounter = errors.New("unknown counter")
+)
+
+// undoCandidates returns up to n win entries of the current session (after the
+// last reset/restore) that have not been reverted yet, newest first.
+func undoCandidates(entries []JournalEntry, n int) []JournalEntry {
+    start := 0
+    undone := map[int64]bool{}
+    for i, e := range entries {
+        switch e.Type {
+        case journalReset, journalRestore, journalSnapshot:
+            start = i + 1
+        case journalAdjust:
+            if e.Undoes > 0 { undone[e.Undoes] = true }
+        }
+    }
+    var out []JournalEntry
+    for i := len(entries) - 1; i >= start && len(out) < n; i-- {
+        e := entries[i]
+        if e.Type == journalWin && !undone[e.Seq] {
+            out = append(out, e)
+        }
+    }
+    return out
+}
+
+// doUndo reverts the last n wins. Returns the reverted entries.
+func doUndo(base string, n int) ([]JournalEntry, error) {
+    if n <= 0 { n = 1 }
+    lk, err := acquireLock(base)
+    if err != nil { return nil, err }
+    targets, events, st, err := undoWins(base, n)
+    lk.release()
+    if err != nil { return nil, err }
+    notifyChanges(base, events, st)
+    return targets, nil
+}
+
+// undoWins journals the reverting adjustments of doUndo. Callers hold the data
+// lock.
+func undoWins(base string, n int) ([]JournalEntry, []ChangeEvent, State, error) {
+    entries, _, err := readJournal(journalPath(base))
+    if err != nil && !os.IsNotExist(err) { return nil, nil, State{}, err }
+    targets := undoCandidates(entries, n)
+    if len(targets) == 0 { return nil, nil, State{}, errNothingToUndo }
+    st, err := loadStateForWrite(base)
+    if err != nil { return nil, nil, State{}, err }
+    rules := loadRewardRules(base, loadSettings(base))
+    now := time.Now().UTC().Format(time.RFC3339)
+    events := make([]ChangeEvent, 0, len(targets))
+    for _, t := range targets {
+        counter := t.Counter
+        if counter == "" {
+            flag := 0
+            if t.HitFlag != nil { flag = *t.HitFlag }
+            counter = tierCounter(nil, flag)
+        }
+        // a win of a user that is gone (e.g. restored away) cannot be reverted
+        if !applyAdjust(&st, t.Name, map[string]int{counter: -1}, now, rules) {
+            return nil, nil, State{}, fmt.Errorf("%w: %s (win seq=%d)", errUserNotFound, t.Name, t.Seq)
+        }
+        events = append(events, ChangeEvent{Type: notifyUndo, At: now, Name: t.Name, Counter: counter, Undoes: t.Seq})
+    }
+    // journal only once every target was reverted
+    for _, ev := range events {
+        if err := appendJournal(base, JournalEntry{At: now, Type: journalAdjust, Name: ev.Name, Deltas: map[string]int{ev.Counter: -1}, Undoes: ev.Undoes}); err != nil {
+            return nil, nil, State{}, err
+        }
+        _ = appendAppLog(base, fmt.Sprintf("undo: winner=%q seq=%d %s=-1", ev.Name, ev.Undoes, ev.Counter))
+    }
+    if err := saveState(base, st); err != nil { return nil, nil, State{}, err }
+    if err := genDataJS(base); err != nil { return nil, nil, State{}, err }
+    for i := range events {
+        events[i] = newChangeEvent(events[i], st)
+    }
+    return targets, events, st, nil
+}
+
+// doAdjust applies manual deltas to a user's counters. Counter names must be
+// those of the configured tiers (case-insensitive).
+func doAdjust(base, name string, deltas map[string]int) (State, error) {
+    name = strings.TrimSpace(name)
+    if err := validateWinner(name); err != nil { return State{}, err }
+    tiers := loadTiers(base, loadSettings(base))
+    known := map[string]int{}
+    for k, d := range deltas {
+        counter := ""
+        for _, t := range tiers {
+            if strings.EqualFold(k, t.Counter) { counter = t.Counter }
+        }
+        if counter == "" { return State{}, fmt.Errorf("%w %q (tiers: %s)", errUnknownCounter, k, tierCountersText(tiers)) }
+        known[counter] += d
+    }
+    deltas = known
+    for k, d := range deltas {
+        if d == 0 { delete(deltas, k) }
+    }
+    if len(deltas) == 0 { return State{}, errors.New("nothing to adjust (use --hit/--jackpot)") }
+    var st State
+    now := time.Now().UTC().Format(time.RFC3339)
+    err := withLock(base, func() error {
+        var err error
+        st, err = loadStateForWrite(base)
+        if err != nil { return err }
+        if !applyAdjust(&st, name, deltas, now, loadRewardRules(base, loadSettings(base))) {
+            return fmt.Errorf("%w: %s", errUserNotFound, name)
+        }
+        if err := appendJournal(base, JournalEntry{At: now, Type: journalAdjust, Name: name, Deltas: deltas}); err != nil {
+            return err
+        }
+        if err := saveState(base, st); err != nil { return err }
+        return genDataJS(base)
+    })
+    if err != nil { return State{}, err }
+    notifyChange(base, ChangeEvent{Type: journalAdjust, At: now, Name: name, Deltas: deltas}, st)
+    parts := make([]string, 0, len(deltas))
+    for k, d := range deltas {
+        parts = append(parts, fmt.Sprintf("%s=%+d", k, d))
+    }
+    sort.Strings(parts)
+    _ = appendAppLog(base, fmt.Sprintf("adjust: name=%q %s", name, strings.Join(parts, " ")))
+    return st, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+// Duplicate-trigger suppression (T-05).
+// Each CLI invocation is a short-lived process, so the recent window is kept in
+// data/recent_events.json. Callers must hold the data lock.
+
+var errDuplicateSuppressed = errors.New("duplicate trigger suppressed")
+
+type recentEvent struct {
+    Winner  string `json:"winner"`
+    HitFlag int    `json:"hitFlag"`
+    At      int64  `json:"at"` // unix milliseconds
+}
+
+func recentEventsPath(base string) string { return filepath.Join(base, "data", "recent_events.json") }
+
+func debounceWindow(cfg Settings) time.Duration {
+    ms := cfg.DebounceWindowMs
+    if ms <= 0 { ms = 2000 }
+    return time.Duration(ms) * time.Millisecond
+}
+
+func loadRecentEvents(base string) []recentEvent {
+    b, err := os.ReadFile(recentEventsPath(base))
+    if err != nil { return nil }
+    var evs []recentEvent
+    if err := json.Unmarshal(b, &evs); err != nil { return nil }
+    return evs
+}
+
+// checkDebounce reports whether an identical <winner> <flag> call was accepted
+// within the window.
+func checkDebounce(base, winner string, flag int, window time.Duration) bool {
+    cutoff := time.Now().UnixMilli() - window.Milliseconds()
+    for _, ev := range loadRecentEvents(base) {
+        if ev.At > cutoff && ev.Winner == winner && ev.HitFlag == flag { return true }
+    }
+    return false
+}
+
+// recordDebounce records an accepted call as the newest event and forgets
+// those outside the window. It is called once the win is saved, so a call
+// that failed is not suppressed when it is retried.
+func recordDebounce(base, winner string, flag int, window time.Duration) error {
+    now := time.Now().UnixMilli()
+    cutoff := now - window.Milliseconds()
+    kept := make([]recentEvent, 0)
+    for _, ev := range loadRecentEvents(base) {
+        if ev.At <= cutoff || ev.At > now { continue }
+        kept = append(kept, ev)
+    }
+    kept = append(kept, recentEvent{Winner: winner, HitFlag: flag, At: now})
+    b, err := json.Marshal(kept)
+    if err != nil { return err }
+    return writeFileAtomic(recentEventsPath(base), b)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "mime/multipart"
+    "net/http"
+    "net/textproto"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+)
+
+// Deliverables: the finished artwork (PNG/GIF) of a user.
+// Files are registered with `gacha deliverable add` or POST /api/user/deliverable
+// and stored under data/deliverables/ (index.json maps user -> file). When the
+// user's status is done, the file is uploaded to Discord as an attachment with
+// the discordTemplates "deliverable" message; the message ID is recorded in
+// discord_map.json under __DELIVERABLE__::<session>::<name>, so a user who is
+// done again in a later session is posted again; newSession drops the markers of
+// earlier sessions. Uploads run without the data lock (a file may take a while
+// to send) but each under the notify lock, which also guards the completion
+// notices, so two processes never post the same file. Uploads that fail are
+// retried on the next Discord notification of the API server or by
+// `gacha discord flush`. Registering a new file for a user posts it again.
+
+const deliverableMaxBytes = 10 << 20 // Discord's upload limit without boosts
+
+var errNotImage = errors.New("deliverable must be a PNG or GIF image")
+
+type Deliverable struct {
+    Name         string `json:"name"`
+    File         string `json:"file"` // file name under data/deliverables/
+    OriginalName string `json:"originalName"`
+    ContentType  string `json:"contentType"`
+    Size         int64  `json:"size"`
+    RegisteredAt string `json:"registeredAt"`
+    MessageID    string `json:"messageId,omitempty"`
+    PostedAt     string `json:"postedAt,omitempty"`
+}
+
+type deliverableData struct {
+    User    User
+    File    string // original file name ("" for a completion notice without file)
+    Mention string // "<@id>" with discordMentionOnDone and a mapping, else ""
+}
+
+func deliverablesDir(base string) string { return filepath.Join(base, "data", "deliverables") }
+
+func deliverableIndexPath(base string) string { return filepath.Join(deliverablesDir(base), "index.json") }
+
+const deliverableKeyPrefix = "__DELIVERABLE__::"
+
+func deliverableKey(sessionID, name string) string { return deliverableKeyPrefix + sessionID + "::" + name }
+
+// dropDeliverableMarkers forgets the posted deliverables and completion notices
+// of earlier sessions. Callers hold the data lock.
+func dropDeliverableMarkers(base, sessionID string) error {
+    m, err := loadDiscordMap(base)
+    if err != nil { return err }
+    changed := false
+    for k := range m {
+        if strings.HasPrefix(k, deliverableKeyPrefix) && !strings.HasPrefix(k, deliverableKeyPrefix+sessionID+"::") {
+            delete(m, k)
+            changed = true
+        }
+    }
+    if !changed { return nil }
+    return saveDiscordMap(base, m)
+}
+
+func loadDeliverables(base string) (map[string]Deliverable, error) {
+    b, err := os.ReadFile(deliverableIndexPath(base))
+    if err != nil {
+        if os.IsNotExist(err) { return map[string]Deliverable{}, nil }
+        return nil, err
+    }
+    m := map[string]Deliverable{}
+    if err := json.Unmarshal(b, &m); err != nil { return nil, err }
+    return m, nil
+}
+
+func saveDeliverables(base string, m map[string]Deliverable) error {
+    if err := os.MkdirAll(deliverablesDir(base), 0o755); err != nil { return err }
+    b, err := json.MarshalIndent(m, "", "  ")
+    if err != nil { return err }
+    return writeFileAtomic(deliverableIndexPath(base), b)
+}
+
+// deliverableKind detects PNG/GIF by signature and returns extension and MIME type.
+func deliverableKind(data []byte) (string, string, error) {
+    switch {
+    case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+        return ".png", "image/png", nil
+    case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+        return ".gif", "image/gif", nil
+    }
+    return "", "", errNotImage
+}
+
+// doRegisterDeliverable stores the file of a user (replacing a previous one) and
+// posts it right away when the user is already done.
+func doRegisterDeliverable(base, name, filename string, data []byte) (Deliverable, error) {
+    name = strings.TrimSpace(name)
+    if len(data) == 0 { return Deliverable{}, errors.New("file is empty") }
+    if len(data) > deliverableMaxBytes {
+        return Deliverable{}, fmt.Errorf("file too large (%d bytes, max %d)", len(data), deliverableMaxBytes)
+    }
+    ext, ctype, err := deliverableKind(data)
+    if err != nil { return Deliverable{}, err }
+    var d Deliverable
+    err = withLock(base, func() error {
+        st, err := loadState(base)
+        if err != nil { return err }
+        found := false
+        for _, u := range st.Users {
+            if u.Name == name { found = true }
+        }
+        if !found { return fmt.Errorf("%w: %s", errUserNotFound, name) }
+        idx, err := loadDeliverables(base)
+        if err != nil { return err }
+        sum := sha256.Sum256([]byte(name))
+        d = Deliverable{
+            Name:         name,
+            File:         hex.EncodeToString(sum[:8]) + ext,
+            OriginalName: filepath.Base(filename),
+            ContentType:  ctype,
+            Size:         int64(len(data)),
+            RegisteredAt: time.Now().UTC().Format(time.RFC3339Nano),
+        }
+        if d.OriginalName == "" || d.OriginalName == "." { d.OriginalName = "deliverable" + ext }
+        if err := os.MkdirAll(deliverablesDir(base), 0o755); err != nil { return err }
+        if err := writeFileAtomic(filepath.Join(deliverablesDir(base), d.File), data); err != nil { return err }
+        if old, ok := idx[name]; ok && old.File != d.File {
+            _ = os.Remove(filepath.Join(deliverablesDir(base), old.File))
+        }
+        idx[name] = d
+        if err := saveDeliverables(base, idx); err != nil { return err }
+        // a new file is posted again
+        key := deliverableKey(currentSessionID(base), name)
+        if m, err := loadDiscordMap(base); err == nil && m[key] != "" {
+            delete(m, key)
+            _ = saveDiscordMap(base, m)
+        }
+        _ = appendAppLog(base, fmt.Sprintf("deliverable: registered name=%q file=%s size=%d", name, d.File, d.Size))
+        return nil
+    })
+    if err != nil { return Deliverable{}, err }
+    postPendingDeliverables(base)
+    if idx, err := loadDeliverables(base); err == nil { d = idx[name] }
+    return d, nil
+}
+
+func doRemoveDeliverable(base, name string) error {
+    name = strings.TrimSpace(name)
+    return withLock(base, func() error {
+        idx, err := loadDeliverables(base)
+        if err != nil { return err }
+        d, ok := idx[name]
+        if !ok { return fmt.Errorf("%w: %s", errUserNotFound, name) }
+        delete(idx, name)
+        if err := saveDeliverables(base, idx); err != nil { return err }
+        _ = os.Remove(filepath.Join(deliverablesDir(base), d.File))
+        _ = appendAppLog(base, fmt.Sprintf("deliverable: removed name=%q", name))
+        return nil
+    })
+}
+
+// pendingDeliverable is a file to upload, captured under the data lock.
+type pendingDeliverable struct {
+    Deliverable
+    Data    []byte
+    Payload DiscordMessage
+}
+
+// postPendingDeliverables uploads the files of done users that have not been
+// posted yet. The pending files are collected under the data lock; each one
+// is then claimed under the notify lock (skipped if another process posted it
+// meanwhile), uploaded without the data lock, and its message ID recorded
+// under a brief data lock. Callers must not hold either lock.
+func postPendingDeliverables(base string) {
+    cfg := loadSettings(base)
+    if !cfg.DiscordEnabled && !isTruthy(os.Getenv("DISCORD_NOTIFY")) { return }
+    if !discordConfigured() { return }
+    var pending []pendingDeliverable
+    var sid, thread string
+    if err := withLock(base, func() error {
+        var err error
+        pending, err = pendingDeliverables(base, cfg)
+        sid, thread = currentSessionID(base), currentThread(base)
+        return err
+    }); err != nil {
+        _ = appendAppLog(base, "warn: collect pending deliverables failed: "+err.Error())
+        return
+    }
+    for _, p := range pending {
+        if err := withNotifyLock(base, func() error { return postDeliverable(base, sid, thread, p) }); err != nil {
+            _ = appendAppLog(base, "warn: deliverable "+p.Name+": "+err.Error())
+        }
+    }
+}
+
+// postDeliverable uploads p unless it was posted in session sid meanwhile.
+// Callers hold the notify lock.
+func postDeliverable(base, sid, thread string, p pendingDeliverable) error {
+    if m, err := loadDiscordMap(base); err != nil {
+        return err
+    } else if m[deliverableKey(sid, p.Name)] != "" {
+        return nil
+    }
+    id, mode, err := discordPostFile(thread, p.Payload, p.OriginalName, p.ContentType, p.Data)
+    if err != nil {
+        _ = appendAppLog(base, "warn: discord "+mode+" deliverable upload failed (retried on next update): "+err.Error())
+        return nil
+    }
+    if id == "" { id = "posted" }
+    _ = appendAppLog(base, fmt.Sprintf("info: discord %s deliverable posted: name=%q id=%s", mode, p.Name, id))
+    err = withLock(base, func() error {
+        m, err := loadDiscordMap(base)
+        if err != nil { return err }
+        idx, err := loadDeliverables(base)
+        if err != nil { return err }
+        d, ok := idx[p.Name]
+        // a file registered during the upload is still to be posted
+        if ok && d.RegisteredAt != p.RegisteredAt { return nil }
+        m[deliverableKey(sid, p.Name)] = id
+        if err := saveDiscordMap(base, m); err != nil { return fmt.Errorf("save discord_map.json: %w", err) }
+        if !ok { return nil }
+        d.MessageID, d.PostedAt = id, time.Now().UTC().Format(time.RFC3339)
+        idx[p.Name] = d
+        if err := saveDeliverables(base, idx); err != nil { return fmt.Errorf("save deliverables index: %w", err) }
+        return nil
+    })
+    if err != nil { return fmt.Errorf("record posted deliverable failed: %w", err) }
+    return nil
+}
+
+// pendingDeliverables reads the files of done users that have not been posted
+// in this session and renders their messages. Callers hold the data lock.
+func pendingDeliverables(base string, cfg Settings) ([]pendingDeliverable, error) {
+    idx, err := loadDeliverables(base)
+    if err != nil || len(idx) == 0 { return nil, err }
+    st, err := loadState(base)
+    if err != nil { return nil, err }
+    m, err := loadDiscordMap(base)
+    if err != nil { return nil, err }
+    sid := currentSessionID(base)
+    var out []pendingDeliverable
+    var tpl summaryTemplates
+    var dir discordDirectory
+    loaded := false
+    for _, u := range st.Users {
+        d, ok := idx[u.Name]
+        if !ok || !(u.Done || u.Status == "done") || m[deliverableKey(sid, u.Name)] != "" { continue }
+        data, err := os.ReadFile(filepath.Join(deliverablesDir(base), d.File))
+        if err != nil {
+            _ = appendAppLog(base, "warn: deliverable read failed: "+err.Error())
+            continue
+        }
+        if !loaded {
+            tpl, _ = compileDiscordTemplates(cfg.DiscordTemplates)
+            if cfg.DiscordMentionOnDone { dir, _ = loadDiscordDirectory(base) }
+            loaded = true
+        }
+        content := tpl.deliverable.render(deliverableData{User: u, File: d.OriginalName, Mention: dir.mention(u.Name)})
+        payload := DiscordMessage{Content: truncateRunes(content, 2000), AllowedMentions: allowedMentions()}
+        if id := dir.lookup(u.Name); id != "" { payload.AllowedMentions = allowedMentions(id) }
+        out = append(out, pendingDeliverable{Deliverable: d, Data: data, Payload: payload})
+    }
+    return out, nil
+}
+
+// discordPostFile posts a message with one attachment (bot preferred), inside
+// threadID when set, and returns the new message ID.
+func discordPostFile(threadID string, payload DiscordMessage, filename, contentType string, data []byte) (string, string, error) {
+    var body bytes.Buffer
+    mw := multipart.NewWriter(&body)
+    if payload.AllowedMentions == nil { payload.AllowedMentions = allowedMentions() }
+    pj, _ := json.Marshal(struct {
+        DiscordMessage
+        Attachments []map[string]any `json:"attachments"`
+    }{payload, []map[string]any{{"id": 0, "filename": filename}}})
+    h := textproto.MIMEHeader{}
+    h.Set("Content-Disposition", `form-data; name="payload_json"`)
+    h.Set("Content-Type", "application/json")
+    pw, _ := mw.CreatePart(h)
+    _, _ = pw.Write(pj)
+    h = textproto.MIMEHeader{}
+    h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="files[0]"; filename=%q`, filename))
+    h.Set("Content-Type", contentType)
+    fw, _ := mw.CreatePart(h)
+    _, _ = fw.Write(data)
+    if err := mw.Close(); err != nil { return "", "", err }
+
+    mode, u := "", ""
+    token := strings.TrimSpace(os.Getenv("DISCORD_BOT_TOKEN"))
+    channelID := strings.TrimSpace(os.Getenv("DISCORD_CHANNEL_ID"))
+    if token != "" && channelID != "" {
+        if threadID != "" { channelID = threadID }
+        mode, u = "bot", fmt.Sprintf("%s/channels/%s/messages", discordAPI, channelID)
+    } else if raw := strings.TrimSpace(os.Getenv("DISCORD_WEBHOOK_URL")); raw != "" {
+        info, err := parseWebhook(raw)
+        if err != nil { return "", "webhook", err }
+        info.Thread = threadID
+        mode, u = "webhook", info.endpoint("", true)
+    } else {
+        return "", "", errNoDiscordCredentials
+    }
+    req, _ := http.NewRequest("POST", u, bytes.NewReader(body.Bytes()))
+    req.Header.Set("Content-Type", mw.FormDataContentType())
+    if mode == "bot" { req.Header.Set("Authorization", "Bot "+token) }
+    resp, err := discordDo(req)
+    if err != nil { return "", mode, err }
+    defer resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return "", mode, discordStatusError(mode+" upload", resp)
+    }
+    var res struct{ ID string `json:"id"` }
+    _ = json.NewDecoder(resp.Body).Decode(&res)
+    return res.ID, mode, nil
+}
+
+// sortedDeliverables lists the registered files by user name.
+func sortedDeliverables(idx map[string]Deliverable) []Deliverable {
+    out := make([]Deliverable, 0, len(idx))
+    for _, d := range idx {
+        out = append(out, d)
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+    return out
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+// Differences between two snapshots (`gacha diff`, /api/diff).
+// A snapshot is "current" (data/current.json) or a backup name as accepted by
+// restore. Users are matched by name; for each user the counter deltas (hit,
+// jackpot and any other tier), status and reference image changes are listed.
+
+type userDiff struct {
+    Name       string         `json:"name"`
+    Change     string         `json:"change"`           // added, removed, changed
+    Deltas     map[string]int `json:"deltas,omitempty"` // counter -> to - from
+    StatusFrom string         `json:"statusFrom,omitempty"`
+    StatusTo   string         `json:"statusTo,omitempty"`
+    RefFrom    *bool          `json:"refFrom,omitempty"`
+    RefTo      *bool          `json:"refTo,omitempty"`
+}
+
+type stateDiff struct {
+    From    string         `json:"from"`
+    To      string         `json:"to"`
+    Added   int            `json:"added"`
+    Removed int            `json:"removed"`
+    Changed int            `json:"changed"`
+    Totals  map[string]int `json:"totals"` // counter -> to - from over all users
+    Users   []userDiff     `json:"users"`
+}
+
+// userStatus is the effective status of u: none, progress or done.
+func userStatus(u User) string {
+    if u.Done || u.Status == "done" { return "done" }
+    if u.Status == "" { return "none" }
+    return u.Status
+}
+
+// diffStates compares two states; users are listed added, removed, changed,
+// each group by name.
+func diffStates(from, to State) stateDiff {
+    d := stateDiff{Totals: map[string]int{}, Users: []userDiff{}}
+    old := map[string]User{}
+    for _, u := range from.Users {
+        old[u.Name] = u
+    }
+    seen := map[string]bool{}
+    counterDeltas := func(a, b map[string]int) map[string]int {
+        out := map[string]int{}
+        for k, v := range b {
+            if v != a[k] { out[k] = v - a[k] }
+        }
+        for k, v := range a {
+            if _, ok := b[k]; !ok && v != 0 { out[k] = -v }
+        }
+        return out
+    }
+    for _, u := range to.Users {
+        seen[u.Name] = true
+        o, ok := old[u.Name]
+        if !ok {
+            ud := userDiff{Name: u.Name, Change: "added", Deltas: counterDeltas(nil, u.Counts), StatusTo: userStatus(u)}
+            ref := u.HasReference
+            ud.RefTo = &ref
+            d.Users = append(d.Users, ud)
+            continue
+        }
+        ud := userDiff{Name: u.Name, Change: "changed", Deltas: counterDeltas(o.Counts, u.Counts)}
+        if so, sn := userStatus(o), userStatus(u); so != sn {
+            ud.StatusFrom, ud.StatusTo = so, sn
+        }
+        if o.HasReference != u.HasReference {
+            rf, rt := o.HasReference, u.HasReference
+            ud.RefFrom, ud.RefTo = &rf, &rt
+        }
+        if len(ud.Deltas) == 0 && ud.StatusTo == "" && ud.RefTo == nil { continue }
+        d.Users = append(d.Users, ud)
+    }
+    for _, o := range from.Users {
+        if seen[o.Name] { continue }
+        ref := o.HasReference
+        d.Users = append(d.Users, userDiff{Name: o.Name, Change: "removed", Deltas: counterDeltas(o.Counts, nil), StatusFrom: userStatus(o), RefFrom: &ref})
+    }
+    rank := map[string]int{"added": 0, "removed": 1, "changed": 2}
+    sort.SliceStable(d.Users, func(i, j int) bool {
+        a, b := d.Users[i], d.Users[j]
+        if a.Change != b.Change { return rank[a.Change] < rank[b.Change] }
+        return a.Name < b.Name
+    })
+    for _, u := range d.Users {
+        switch u.Change {
+        case "added":
+            d.Added++
+        case "removed":
+            d.Removed++
+        default:
+            d.Changed++
+        }
+        for k, v := range u.Deltas {
+            d.Totals[k] += v
+        }
+    }
+    for k, v := range d.Totals {
+        if v == 0 { delete(d.Totals, k) }
+    }
+    return d
+}
+
+// loadSnapshot loads "current" or a backup and returns it with its display name.
+func loadSnapshot(base, name string) (State, string, error) {
+    if name == "" || strings.EqualFold(name, "current") {
+        st, err := loadState(base)
+        return st, "current", err
+    }
+    p, err := findBackup(base, name)
+    if err != nil { return State{}, "", err }
+    b, err := readBackupFile(p)
+    if err != nil { return State{}, "", err }
+    st, err := decodeState(b)
+    if err != nil { return State{}, "", fmt.Errorf("%s: %w", filepath.Base(p), err) }
+    return st, filepath.Base(p), nil
+}
+
+// diffSnapshots compares the snapshots from and to ("" means current).
+func diffSnapshots(base, from, to string) (stateDiff, error) {
+    a, an, err := loadSnapshot(base, from)
+    if err != nil { return stateDiff{}, err }
+    b, bn, err := loadSnapshot(base, to)
+    if err != nil { return stateDiff{}, err }
+    d := diffStates(a, b)
+    d.From, d.To = an, bn
+    return d, nil
+}
+
+// formatDeltas renders counter deltas as "hit +1 jackpot -2" (hit and jackpot first).
+func formatDeltas(m map[string]int) string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    order := func(k string) int {
+        switch k {
+        case "hit":
+            return 0
+        case "jackpot":
+            return 1
+        }
+        return 2
+    }
+    sort.Slice(keys, func(i, j int) bool {
+        if order(keys[i]) != order(keys[j]) { return order(keys[i]) < order(keys[j]) }
+        return keys[i] < keys[j]
+    })
+    parts := make([]string, 0, len(keys))
+    for _, k := range keys {
+        parts = append(parts, fmt.Sprintf("%s %+d", k, m[k]))
+    }
+    return strings.Join(parts, " ")
+}
+
+func printStateDiff(w io.Writer, d stateDiff) {
+    fmt.Fprintf(w, "diff %s -> %s\n", d.From, d.To)
+    fmt.Fprintf(w, "users: +%d -%d ~%d", d.Added, d.Removed, d.Changed)
+    if len(d.Totals) > 0 { fmt.Fprintf(w, "  totals: %s", formatDeltas(d.Totals)) }
+    fmt.Fprintln(w)
+    if len(d.Users) == 0 {
+        fmt.Fprintln(w, "no differences")
+        return
+    }
+    width := 4
+    for _, u := range d.Users {
+        if n := len([]rune(u.Name)); n > width { width = n }
+    }
+    marks := map[string]string{"added": "+", "removed": "-", "changed": "~"}
+    refLabel := func(b *bool) string {
+        if b != nil && *b { return "yes" }
+        return "no"
+    }
+    for _, u := range d.Users {
+        cols := []string{}
+        if s := formatDeltas(u.Deltas); s != "" { cols = append(cols, s) }
+        switch {
+        case u.StatusFrom != "" && u.StatusTo != "":
+            cols = append(cols, "status "+u.StatusFrom+" -> "+u.StatusTo)
+        case u.StatusTo != "":
+            cols = append(cols, "status "+u.StatusTo)
+        case u.StatusFrom != "":
+            cols = append(cols, "status "+u.StatusFrom)
+        }
+        if u.RefFrom != nil && u.RefTo != nil {
+            cols = append(cols, "ref "+refLabel(u.RefFrom)+" -> "+refLabel(u.RefTo))
+        }
+        pad := strings.Repeat(" ", width-len([]rune(u.Name)))
+        fmt.Fprintf(w, "%s %s%s  %s\n", marks[u.Change], u.Name, pad, strings.Join(cols, "  "))
+    }
+}
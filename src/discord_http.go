@@ -0,0 +1,179 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "math"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Shared HTTP client for Discord API calls.
+// Rate limit headers (X-RateLimit-Remaining / -Reset-After / -Global / -Scope)
+// are tracked per route so the next request waits for the bucket to reset.
+// Short waits are slept through; longer ones return a discordRateLimitError so
+// the caller can queue the update in the outbox instead of blocking.
+
+const (
+    discordTimeout   = 15 * time.Second
+    discordMaxWait   = 3 * time.Second // longest wait done inline (the notify lock is held)
+    discordMaxRetry  = 2               // 429 retries per request
+)
+
+const defaultDiscordAPI = "https://discord.com/api/v10"
+
+var discordClient = &http.Client{Timeout: discordTimeout}
+
+// discordAPI is the API root for bot and webhook calls (setting.json
+// "discordApiBase"; set at startup).
+var discordAPI = defaultDiscordAPI
+
+func discordAPIBase(cfg Settings) string {
+    b := strings.TrimRight(strings.TrimSpace(cfg.DiscordAPIBase), "/")
+    if b == "" { b = defaultDiscordAPI }
+    return b
+}
+
+var discordLimits = &discordLimiter{until: map[string]time.Time{}}
+
+type discordLimiter struct {
+    mu     sync.Mutex
+    until  map[string]time.Time // route -> blocked until
+    global time.Time
+}
+
+// discordAPIError is a non-2xx answer from Discord.
+type discordAPIError struct {
+    Op     string
+    Code   int
+    Status string
+}
+
+func (e *discordAPIError) Error() string { return fmt.Sprintf("%s failed: %s", e.Op, e.Status) }
+
+// discordRateLimitError means the request was not sent (or was rejected with
+// 429) and should be retried after RetryAfter.
+type discordRateLimitError struct {
+    RetryAfter time.Duration
+    Global     bool
+}
+
+func (e *discordRateLimitError) Error() string {
+    scope := "route"
+    if e.Global { scope = "global" }
+    return fmt.Sprintf("discord rate limited (%s), retry after %s", scope, e.RetryAfter.Round(time.Millisecond))
+}
+
+func discordStatusError(op string, resp *http.Response) error {
+    return &discordAPIError{Op: op, Code: resp.StatusCode, Status: resp.Status}
+}
+
+// isDiscordNotFound reports whether err means the message no longer exists.
+// Rate limits and server errors never count as "missing".
+func isDiscordNotFound(err error) bool {
+    var ae *discordAPIError
+    return errors.As(err, &ae) && ae.Code == http.StatusNotFound
+}
+
+// discordRetryAfter returns the delay requested by a rate limit error (0 otherwise).
+func discordRetryAfter(err error) time.Duration {
+    var rl *discordRateLimitError
+    if errors.As(err, &rl) { return rl.RetryAfter }
+    return 0
+}
+
+// discordRoute groups requests by their major parameter (channel or webhook),
+// which is how Discord scopes message rate limits.
+func discordRoute(path string) string {
+    parts := strings.Split(strings.Trim(path, "/"), "/")
+    for i, p := range parts {
+        if (p == "channels" || p == "webhooks") && i+1 < len(parts) {
+            return p + "/" + parts[i+1]
+        }
+    }
+    return path
+}
+
+func (l *discordLimiter) wait(route string, now time.Time) time.Duration {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    until := l.until[route]
+    if l.global.After(until) { until = l.global }
+    if until.After(now) { return until.Sub(now) }
+    return 0
+}
+
+func (l *discordLimiter) block(route string, d time.Duration, global bool) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    until := time.Now().Add(d)
+    if global {
+        if until.After(l.global) { l.global = until }
+        return
+    }
+    if until.After(l.until[route]) { l.until[route] = until }
+}
+
+// observe records the bucket state reported by a response.
+func (l *discordLimiter) observe(route string, resp *http.Response) {
+    if resp.Header.Get("X-RateLimit-Remaining") != "0" { return }
+    if d, ok := parseSeconds(resp.Header.Get("X-RateLimit-Reset-After")); ok {
+        l.block(route, d, false)
+    }
+}
+
+func parseSeconds(v string) (time.Duration, bool) {
+    f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+    if err != nil || f < 0 || math.IsInf(f, 0) || math.IsNaN(f) { return 0, false }
+    return time.Duration(f * float64(time.Second)), true
+}
+
+// rateLimitFrom reads the retry delay of a 429 response (headers first, then
+// the JSON body's retry_after).
+func rateLimitFrom(resp *http.Response) *discordRateLimitError {
+    rl := &discordRateLimitError{RetryAfter: time.Second}
+    rl.Global = strings.EqualFold(resp.Header.Get("X-RateLimit-Global"), "true") || resp.Header.Get("X-RateLimit-Scope") == "global"
+    if d, ok := parseSeconds(resp.Header.Get("Retry-After")); ok {
+        rl.RetryAfter = d
+    } else if d, ok := parseSeconds(resp.Header.Get("X-RateLimit-Reset-After")); ok {
+        rl.RetryAfter = d
+    }
+    var body struct{ RetryAfter float64 `json:"retry_after"`; Global bool `json:"global"` }
+    if b, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024)); err == nil && json.Unmarshal(b, &body) == nil {
+        if body.RetryAfter > 0 && resp.Header.Get("Retry-After") == "" {
+            rl.RetryAfter = time.Duration(body.RetryAfter * float64(time.Second))
+        }
+        if body.Global { rl.Global = true }
+    }
+    return rl
+}
+
+// discordDo sends req with the shared client, honoring known rate limits and
+// retrying 429 responses whose delay is short enough to wait for.
+func discordDo(req *http.Request) (*http.Response, error) {
+    route := discordRoute(req.URL.Path)
+    for attempt := 0; ; attempt++ {
+        if d := discordLimits.wait(route, time.Now()); d > 0 {
+            if d > discordMaxWait { return nil, &discordRateLimitError{RetryAfter: d} }
+            time.Sleep(d)
+        }
+        if attempt > 0 && req.GetBody != nil {
+            body, err := req.GetBody()
+            if err != nil { return nil, err }
+            req.Body = body
+        }
+        resp, err := discordClient.Do(req)
+        if err != nil { return nil, err }
+        discordLimits.observe(route, resp)
+        if resp.StatusCode != http.StatusTooManyRequests { return resp, nil }
+        rl := rateLimitFrom(resp)
+        resp.Body.Close()
+        discordLimits.block(route, rl.RetryAfter, rl.Global)
+        if attempt >= discordMaxRetry || rl.RetryAfter > discordMaxWait { return nil, rl }
+    }
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+)
+
+// Summary pagination.
+// Discord rejects embeds whose field values exceed 1024 characters or whose
+// total text exceeds 6000 characters (per message). Reward groups are split
+// into continuation fields, and fields are packed into pages of one embed each.
+// Page 1 keeps the summary key; page N (N >= 2) is tracked in discord_map.json
+// as "<summary key>#p<N>", e.g. "__SUMMARY__::<session>#p2" (before
+// discord_map v2 it was "<summary key>::<N>", which read like a session id).
+
+const (
+    discordFieldNameMax  = 256
+    discordFieldValueMax = 1024
+    discordFieldsMax     = 25
+    discordEmbedMax      = 6000
+    discordEmbedMargin   = 100 // headroom for the page suffix and counting differences
+)
+
+func runeLen(s string) int { return utf8.RuneCountInString(s) }
+
+func truncateRunes(s string, max int) string {
+    if runeLen(s) <= max { return s }
+    r := []rune(s)
+    return string(r[:max-1]) + "…"
+}
+
+// chunkLines splits value into chunks of at most max characters, breaking
+// only between lines (an overlong single line is truncated).
+func chunkLines(value string, max int) []string {
+    var out []string
+    cur, size := []string{}, 0
+    for _, ln := range strings.Split(value, "\n") {
+        ln = truncateRunes(ln, max)
+        n := runeLen(ln)
+        if len(cur) > 0 && size+1+n > max {
+            out = append(out, strings.Join(cur, "\n"))
+            cur, size = []string{}, 0
+        }
+        if len(cur) > 0 { size++ }
+        cur = append(cur, ln)
+        size += n
+    }
+    return append(out, strings.Join(cur, "\n"))
+}
+
+func embedTextLen(e DiscordEmbed) int {
+    n := runeLen(e.Title) + runeLen(e.Description)
+    if e.Footer != nil { n += runeLen(e.Footer.Text) }
+    for _, f := range e.Fields {
+        n += runeLen(f.Name) + runeLen(f.Value)
+    }
+    return n
+}
+
+// paginateSummary distributes fields over as many copies of tmpl as needed to
+// stay within Discord's limits. The title gets a " (i/n)" suffix when paged.
+func paginateSummary(tmpl DiscordEmbed, fields []EmbedField) []DiscordEmbed {
+    var parts []EmbedField
+    for _, f := range fields {
+        for i, c := range chunkLines(f.Value, discordFieldValueMax) {
+            name := f.Name
+            if i > 0 { name += "（続き）" }
+            parts = append(parts, EmbedField{Name: truncateRunes(name, discordFieldNameMax), Value: c, Inline: f.Inline})
+        }
+    }
+    budget := discordEmbedMax - discordEmbedMargin - embedTextLen(DiscordEmbed{Title: tmpl.Title, Description: tmpl.Description, Footer: tmpl.Footer})
+    var pages [][]EmbedField
+    var cur []EmbedField
+    size := 0
+    for _, f := range parts {
+        n := runeLen(f.Name) + runeLen(f.Value)
+        if len(cur) > 0 && (size+n > budget || len(cur) >= discordFieldsMax) {
+            pages = append(pages, cur)
+            cur, size = nil, 0
+        }
+        cur = append(cur, f)
+        size += n
+    }
+    if len(cur) > 0 || len(pages) == 0 { pages = append(pages, cur) }
+    out := make([]DiscordEmbed, 0, len(pages))
+    for i, fs := range pages {
+        e := tmpl
+        e.Fields = fs
+        if len(pages) > 1 { e.Title = fmt.Sprintf("%s (%d/%d)", tmpl.Title, i+1, len(pages)) }
+        out = append(out, e)
+    }
+    return out
+}
+
+// summaryPageKey returns the discord_map key of page n of a summary.
+func summaryPageKey(summaryKey string, n int) string {
+    if n <= 1 { return summaryKey }
+    return summaryKey + summaryPageSep + strconv.Itoa(n)
+}
+
+const summaryPageSep = "#p"
+
+// legacySummaryPageKey converts a page key written as "<summary key>::<N>"
+// (and its __ARCHIVED__:: form) to the current form.
+func legacySummaryPageKey(key string) (string, bool) {
+    rest, ok := strings.CutPrefix(strings.TrimPrefix(key, "__ARCHIVED__::"), "__SUMMARY__::")
+    if !ok { return "", false }
+    head, page := "", rest
+    if i := strings.LastIndex(rest, "::"); i >= 0 { head, page = "::"+rest[:i], rest[i+2:] }
+    // session ids contain '_', so an all-digit last part is a page number
+    n, err := strconv.Atoi(page)
+    if err != nil || n < 2 || strings.Trim(page, "0123456789") != "" { return "", false }
+    return strings.TrimSuffix(key[:len(key)-len(rest)], "::") + head + summaryPageSep + strconv.Itoa(n), true
+}
+
+// summaryPageNumber parses a page key of summaryKey (page 1 is summaryKey itself).
+func summaryPageNumber(key, summaryKey string) (int, bool) {
+    if key == summaryKey { return 1, true }
+    rest, ok := strings.CutPrefix(key, summaryKey+summaryPageSep)
+    if !ok { return 0, false }
+    n, err := strconv.Atoi(rest)
+    if err != nil || n < 2 { return 0, false }
+    return n, true
+}
+
+// summaryKeyOf reports whether key is summaryKey or one of its pages.
+func summaryKeyOf(key, summaryKey string) bool {
+    _, ok := summaryPageNumber(key, summaryKey)
+    return ok
+}
+
+// cleanupSummaryPages deletes the messages of pages beyond the current page
+// count (the list shrank) and forgets them. Failed deletions are retried on
+// the next refresh.
+func cleanupSummaryPages(base, summaryKey string, pages int) {
+    extra := func(key string) bool {
+        n, ok := summaryPageNumber(key, summaryKey)
+        return ok && n > pages
+    }
+    if err := dropOutboxItems(base, extra); err != nil {
+        _ = appendAppLog(base, "warn: discord outbox write failed: "+err.Error())
+    }
+    m, err := loadDiscordMap(base)
+    if err != nil { return }
+    var removed []string
+    for key, mid := range m {
+        if !extra(key) { continue }
+        if mid != "" {
+            if err := discordDeleteMessage(summaryThread(base, key), mid); err != nil && !isDiscordNotFound(err) {
+                _ = appendAppLog(base, "warn: discord summary page delete failed: key="+key+": "+err.Error())
+                continue
+            }
+        }
+        removed = append(removed, key)
+        _ = appendAppLog(base, "info: discord summary page removed: "+key)
+    }
+    if len(removed) > 0 {
+        if err := updateDiscordMap(base, func(m DiscordMap) {
+            for _, key := range removed {
+                delete(m, key)
+                delete(m, archivedKey(key))
+            }
+        }); err != nil {
+            _ = appendAppLog(base, "warn: save discord_map.json failed: "+err.Error())
+        }
+    }
+}
+
+// discordDeleteMessage deletes a message with the configured transport (bot
+// preferred); threadID is the thread the message was posted in ("" for the channel).
+func discordDeleteMessage(threadID, messageID string) error {
+    token := strings.TrimSpace(os.Getenv("DISCORD_BOT_TOKEN"))
+    channelID := strings.TrimSpace(os.Getenv("DISCORD_CHANNEL_ID"))
+    if token != "" && channelID != "" {
+        if threadID != "" { channelID = threadID }
+        return discordBotDeleteMessage(token, channelID, messageID)
+    }
+    if raw := strings.TrimSpace(os.Getenv("DISCORD_WEBHOOK_URL")); raw != "" {
+        info, err := parseWebhook(raw)
+        if err != nil { return err }
+        info.Thread = threadID
+        return discordWebhookDeleteMessage(info, messageID)
+    }
+    return errNoDiscordCredentials
+}
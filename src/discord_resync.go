@@ -0,0 +1,215 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "strings"
+    "time"
+)
+
+// discord_map.json maintenance (`gacha discord resync`, POST /api/discord/resync).
+// The map keeps one entry per summary page of every session. Resync checks
+// that each summary message still exists and forgets the deleted ones, marks
+// archived summaries as __ARCHIVED__::<key> (archiveOldSummaryMessages skips
+// them), archives leftovers of earlier sessions, and drops markers and forum
+// thread entries nothing refers to any more. With repost the current summary
+// is deleted and posted again as new messages. Deliverable entries are left
+// as they are.
+
+const archivedColor = 0x9CA3AF // gray-400
+
+func archivedKey(key string) string { return "__ARCHIVED__::" + key }
+
+// setArchivedMark records whether the summary message under key is archived.
+func setArchivedMark(base, key string, archived bool) {
+    m, err := loadDiscordMap(base)
+    if err != nil || (m[archivedKey(key)] != "") == archived { return }
+    if err := updateDiscordMap(base, func(m DiscordMap) {
+        if archived {
+            m[archivedKey(key)] = time.Now().UTC().Format(time.RFC3339)
+        } else {
+            delete(m, archivedKey(key))
+        }
+    }); err != nil {
+        _ = appendAppLog(base, "warn: save discord_map.json failed: "+err.Error())
+    }
+}
+
+// looksArchived reports whether a summary message already carries the archive
+// header (e.g. archived before markers existed).
+func looksArchived(content string, embeds []DiscordEmbed, cfg Settings) bool {
+    if len(embeds) > 0 { return embeds[0].Color == archivedColor || hasArchiveHeader(embeds[0].Title, cfg) }
+    return hasArchiveHeader(content, cfg)
+}
+
+type resyncEntry struct {
+    Key       string `json:"key"`
+    MessageID string `json:"messageId,omitempty"`
+    Result    string `json:"result"` // current, kept, archived, marked, retitled, missing, dropped, reposted, error
+    Error     string `json:"error,omitempty"`
+}
+
+type resyncReport struct {
+    Checked  int           `json:"checked"`
+    Marked   int           `json:"marked"`  // newly marked as archived (incl. retitled)
+    Missing  int           `json:"missing"` // entries of deleted messages removed
+    Dropped  int           `json:"dropped"` // orphaned markers / thread entries removed
+    Errors   int           `json:"errors"`
+    Reposted bool          `json:"reposted"`
+    Entries  []resyncEntry `json:"entries"`
+}
+
+// resyncDiscord verifies the summary entries of discord_map.json against
+// Discord and cleans them up (see above). It runs under the notify lock; the
+// changes are merged into discord_map.json under a brief data lock.
+func resyncDiscord(base string, repost bool) (resyncReport, error) {
+    rep := resyncReport{Entries: []resyncEntry{}}
+    if !discordConfigured() { return rep, errNoDiscordCredentials }
+    err := withNotifyLock(base, func() error {
+        cfg := loadSettings(base)
+        m, err := loadDiscordMap(base)
+        if err != nil { return err }
+        before := DiscordMap{}
+        for k, v := range m {
+            before[k] = v
+        }
+        sess, _ := loadSession(base)
+        current := summaryKeyFor(cfg, sess)
+        header := buildArchiveHeader(cfg)
+        now := time.Now().UTC().Format(time.RFC3339)
+        keys := sortedKeys(m)
+        for _, key := range keys {
+            if !strings.HasPrefix(key, "__SUMMARY__") { continue }
+            mid := m[key]
+            rep.Checked++
+            e := resyncEntry{Key: key, MessageID: mid}
+            var content string
+            var embeds []DiscordEmbed
+            if mid != "" {
+                content, embeds, err = discordGetMessage(summaryThread(base, key), mid)
+            }
+            switch {
+            case mid == "" || isDiscordNotFound(err):
+                delete(m, key)
+                delete(m, archivedKey(key))
+                e.Result = "missing"
+                rep.Missing++
+            case err != nil:
+                e.Result, e.Error = "error", err.Error()
+                rep.Errors++
+            case summaryKeyOf(key, current):
+                e.Result = "current"
+            case m[archivedKey(key)] != "":
+                e.Result = "archived"
+            case looksArchived(content, embeds, cfg):
+                m[archivedKey(key)] = now
+                e.Result = "marked"
+                rep.Marked++
+            case cfg.DiscordArchiveOldSummary:
+                if aerr := archiveSummaryMessage(base, key, mid, header, cfg); aerr != nil {
+                    e.Result, e.Error = "error", aerr.Error()
+                    rep.Errors++
+                    break
+                }
+                m[archivedKey(key)] = now
+                e.Result = "retitled"
+                rep.Marked++
+            default:
+                e.Result = "kept"
+            }
+            rep.Entries = append(rep.Entries, e)
+        }
+        // markers and forum threads whose summary is gone
+        for _, key := range keys {
+            if _, ok := m[key]; !ok { continue }
+            orphan := false
+            if k, ok := strings.CutPrefix(key, "__ARCHIVED__::"); ok {
+                orphan = m[k] == ""
+            } else if sid, ok := strings.CutPrefix(key, "__THREAD__::"); ok && sid != sess.ID {
+                orphan = true
+                for k := range m {
+                    if summarySessionID(k) == sid { orphan = false; break }
+                }
+            }
+            if !orphan { continue }
+            delete(m, key)
+            rep.Dropped++
+            rep.Entries = append(rep.Entries, resyncEntry{Key: key, Result: "dropped"})
+        }
+        if repost {
+            if err := dropOutboxItems(base, func(k string) bool { return summaryKeyOf(k, current) }); err != nil { return err }
+            for key, mid := range m {
+                if !summaryKeyOf(key, current) { continue }
+                if err := discordDeleteMessage(summaryThread(base, key), mid); err != nil && !isDiscordNotFound(err) {
+                    _ = appendAppLog(base, "warn: discord resync delete failed: key="+key+": "+err.Error())
+                }
+                delete(m, key)
+                delete(m, archivedKey(key))
+            }
+        }
+        if err := mergeDiscordMap(base, before, m); err != nil { return err }
+        if !repost { return nil }
+        var st State
+        if err := withLock(base, func() error {
+            var err error
+            st, err = loadState(base)
+            return err
+        }); err != nil { return err }
+        refreshDiscordSummary(base, st)
+        m, err = loadDiscordMap(base)
+        if err != nil { return err }
+        if m[current] == "" {
+            rep.Errors++
+            rep.Entries = append(rep.Entries, resyncEntry{Key: current, Result: "error", Error: "repost failed (see app.log; queued updates are retried)"})
+            return nil
+        }
+        rep.Reposted = true
+        for _, key := range sortedKeys(m) {
+            if summaryKeyOf(key, current) { rep.Entries = append(rep.Entries, resyncEntry{Key: key, MessageID: m[key], Result: "reposted"}) }
+        }
+        return nil
+    })
+    if err == nil {
+        _ = appendAppLog(base, fmt.Sprintf("info: discord resync: checked=%d marked=%d missing=%d dropped=%d errors=%d reposted=%t", rep.Checked, rep.Marked, rep.Missing, rep.Dropped, rep.Errors, rep.Reposted))
+    }
+    return rep, err
+}
+
+func sortedKeys(m DiscordMap) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// discordGetMessage reads a message with the configured transport (bot
+// preferred); threadID is the thread the message was posted in ("" for the channel).
+func discordGetMessage(threadID, messageID string) (string, []DiscordEmbed, error) {
+    token := strings.TrimSpace(os.Getenv("DISCORD_BOT_TOKEN"))
+    channelID := strings.TrimSpace(os.Getenv("DISCORD_CHANNEL_ID"))
+    if token != "" && channelID != "" {
+        if threadID != "" { channelID = threadID }
+        return discordBotGetMessage(token, channelID, messageID)
+    }
+    if raw := strings.TrimSpace(os.Getenv("DISCORD_WEBHOOK_URL")); raw != "" {
+        info, err := parseWebhook(raw)
+        if err != nil { return "", nil, err }
+        info.Thread = threadID
+        return discordWebhookGetMessage(info, messageID)
+    }
+    return "", nil, errNoDiscordCredentials
+}
+
+func printResyncReport(w io.Writer, rep resyncReport) {
+    for _, e := range rep.Entries {
+        line := fmt.Sprintf("%-9s %s", e.Result, e.Key)
+        if e.MessageID != "" { line += " (" + e.MessageID + ")" }
+        if e.Error != "" { line += ": " + e.Error }
+        fmt.Fprintln(w, line)
+    }
+    fmt.Fprintf(w, "discord resync: checked=%d marked=%d missing=%d dropped=%d errors=%d reposted=%t\n", rep.Checked, rep.Marked, rep.Missing, rep.Dropped, rep.Errors, rep.Reposted)
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "mime"
+    "mime/multipart"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// `gacha fake-discord [port]`: an in-memory stand-in for the Discord API used
+// to test the upsert/archive/outbox paths offline. Point setting.json
+// "discordApiBase" at http://127.0.0.1:<port>/api/v10 (webhook URLs are
+// rebased onto it). Implemented endpoints:
+//   POST   /webhooks/{id}/{token}                     create (returns the message; JSON or multipart with files)
+//   GET|PATCH|DELETE /webhooks/{id}/{token}/messages/{mid}
+//   POST   /channels/{cid}/messages                    create (needs "Authorization: Bot ...")
+//   GET|PATCH|DELETE /channels/{cid}/messages/{mid}
+//   PUT|GET /applications/{app}[/guilds/{gid}]/commands   slash command registration
+//   PATCH  /webhooks/{app}/{token}/messages/@original     interaction reply (recorded only)
+//   POST   /channels/{cid}/messages/{mid}/threads         start a thread (bot)
+//   PATCH  /channels/{thread}                             archive/lock a thread (bot)
+//   webhook ?thread_id= posts into a thread; "thread_name" in the payload creates one (forum post)
+// Control endpoints:
+//   GET    /_fake/messages     current messages
+//   GET    /_fake/requests     recorded requests (DELETE clears)
+//   GET    /_fake/threads      threads created so far
+//   POST   /_fake/inject       {"method":"PATCH","path":"/messages/","status":429,"count":1,"retryAfter":1.5,"global":false}
+//   POST   /_fake/reset        drop messages, requests and pending faults
+
+type fakeMessage struct {
+    ID          string           `json:"id"`
+    ChannelID   string           `json:"channel_id"`
+    WebhookID   string           `json:"webhook_id,omitempty"`
+    Content     string           `json:"content"`
+    Embeds      []DiscordEmbed   `json:"embeds"`
+    Attachments []fakeAttachment `json:"attachments"`
+    Timestamp   string           `json:"timestamp"`
+    EditedAt    string           `json:"edited_timestamp,omitempty"`
+}
+
+type fakeAttachment struct {
+    ID          string `json:"id"`
+    Filename    string `json:"filename"`
+    ContentType string `json:"content_type"`
+    Size        int    `json:"size"`
+}
+
+type fakeRequest struct {
+    At     string          `json:"at"`
+    Method string          `json:"method"`
+    Path   string          `json:"path"`
+    Status int             `json:"status"`
+    Body   json.RawMessage `json:"body,omitempty"`
+}
+
+type fakeFault struct {
+    Method     string  `json:"method"` // empty: any
+    Path       string  `json:"path"`   // substring of the API path; empty: any
+    Status     int     `json:"status"` // 404, 429, 500, ...
+    Count      int     `json:"count"`  // number of requests to fail (default 1)
+    RetryAfter float64 `json:"retryAfter,omitempty"`
+    Global     bool    `json:"global,omitempty"`
+}
+
+type fakeDiscord struct {
+    mu       sync.Mutex
+    nextID   int64
+    messages map[string]*fakeMessage
+    requests []fakeRequest
+    faults   []fakeFault
+    commands map[string]json.RawMessage // application path -> registered commands
+    threads  map[string]*fakeThread
+}
+
+type fakeThread struct {
+    ID       string `json:"id"`
+    ParentID string `json:"parent_id"`
+    Name     string `json:"name"`
+    Archived bool   `json:"archived"`
+    Locked   bool   `json:"locked"`
+}
+
+func newFakeDiscord() *fakeDiscord {
+    return &fakeDiscord{nextID: 1000000000000000000, messages: map[string]*fakeMessage{}, commands: map[string]json.RawMessage{}, threads: map[string]*fakeThread{}}
+}
+
+func serveFakeDiscord(port int) error {
+    addr := fmt.Sprintf("127.0.0.1:%d", port)
+    fmt.Printf("fake-discord: listening on http://%s (discordApiBase: http://%s/api/v10)\n", addr, addr)
+    return http.ListenAndServe(addr, newFakeDiscord())
+}
+
+func (f *fakeDiscord) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    body, _ := io.ReadAll(io.LimitReader(r.Body, 8<<20))
+    if strings.HasPrefix(r.URL.Path, "/_fake/") {
+        f.control(w, r, body)
+        return
+    }
+    path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api"), "/v10")
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    status := f.handle(w, r, path, body)
+    rec := fakeRequest{At: time.Now().UTC().Format(time.RFC3339Nano), Method: r.Method, Path: path, Status: status}
+    if json.Valid(body) { rec.Body = body }
+    f.requests = append(f.requests, rec)
+}
+
+func (f *fakeDiscord) control(w http.ResponseWriter, r *http.Request, body []byte) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    switch {
+    case r.URL.Path == "/_fake/messages" && r.Method == http.MethodGet:
+        list := make([]*fakeMessage, 0, len(f.messages))
+        for _, m := range f.messages {
+            list = append(list, m)
+        }
+        sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+        fakeJSON(w, 200, list)
+    case r.URL.Path == "/_fake/threads" && r.Method == http.MethodGet:
+        list := make([]*fakeThread, 0, len(f.threads))
+        for _, t := range f.threads {
+            list = append(list, t)
+        }
+        sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+        fakeJSON(w, 200, list)
+    case r.URL.Path == "/_fake/requests" && r.Method == http.MethodGet:
+        fakeJSON(w, 200, f.requests)
+    case r.URL.Path == "/_fake/requests" && r.Method == http.MethodDelete:
+        f.requests = nil
+        w.WriteHeader(204)
+    case r.URL.Path == "/_fake/inject" && r.Method == http.MethodPost:
+        var ft fakeFault
+        if err := json.Unmarshal(body, &ft); err != nil || ft.Status < 400 {
+            fakeJSON(w, 400, map[string]any{"error": "expected {method,path,status>=400,count}"})
+            return
+        }
+        if ft.Count <= 0 { ft.Count = 1 }
+        ft.Method = strings.ToUpper(ft.Method)
+        f.faults = append(f.faults, ft)
+        fakeJSON(w, 200, map[string]any{"ok": true, "pending": len(f.faults)})
+    case r.URL.Path == "/_fake/reset" && r.Method == http.MethodPost:
+        f.messages = map[string]*fakeMessage{}
+        f.requests = nil
+        f.faults = nil
+        f.commands = map[string]json.RawMessage{}
+        f.threads = map[string]*fakeThread{}
+        w.WriteHeader(204)
+    default:
+        fakeJSON(w, 404, map[string]any{"error": "unknown control endpoint"})
+    }
+}
+
+// takeFault pops the first injected fault matching the request.
+func (f *fakeDiscord) takeFault(method, path string) (fakeFault, bool) {
+    for i := range f.faults {
+        ft := &f.faults[i]
+        if ft.Method != "" && ft.Method != method { continue }
+        if ft.Path != "" && !strings.Contains(path, ft.Path) { continue }
+        out := *ft
+        ft.Count--
+        if ft.Count <= 0 { f.faults = append(f.faults[:i], f.faults[i+1:]...) }
+        return out, true
+    }
+    return fakeFault{}, false
+}
+
+func (f *fakeDiscord) handle(w http.ResponseWriter, r *http.Request, path string, body []byte) int {
+    if ft, ok := f.takeFault(r.Method, path); ok {
+        return fakeError(w, ft)
+    }
+    parts := strings.Split(strings.Trim(path, "/"), "/")
+    if parts[0] == "applications" && parts[len(parts)-1] == "commands" {
+        return f.handleCommands(w, r, path, body)
+    }
+    if len(parts) == 5 && parts[0] == "webhooks" && parts[4] == "@original" && r.Method == http.MethodPatch {
+        return fakeJSON(w, 200, json.RawMessage(body))
+    }
+    if parts[0] == "channels" && (len(parts) == 2 || len(parts) == 5 && parts[4] == "threads") {
+        return f.handleThreads(w, r, parts, body)
+    }
+    var channelID, webhookID, msgID string
+    switch {
+    case len(parts) >= 3 && parts[0] == "webhooks":
+        webhookID = parts[1]
+        channelID = "webhook-" + webhookID
+        if tid := r.URL.Query().Get("thread_id"); tid != "" {
+            if f.threads[tid] == nil { return fakeJSON(w, 400, map[string]any{"message": "Unknown Channel", "code": 10003}) }
+            channelID = tid
+        }
+        if len(parts) == 5 && parts[3] == "messages" {
+            msgID = parts[4]
+        } else if len(parts) != 3 {
+            return fakeJSON(w, 404, map[string]any{"message": "404: Not Found", "code": 0})
+        }
+    case len(parts) >= 3 && parts[0] == "channels" && parts[2] == "messages":
+        if !strings.HasPrefix(r.Header.Get("Authorization"), "Bot ") {
+            return fakeJSON(w, 401, map[string]any{"message": "401: Unauthorized", "code": 0})
+        }
+        channelID = parts[1]
+        if len(parts) == 4 {
+            msgID = parts[3]
+        } else if len(parts) != 3 {
+            return fakeJSON(w, 404, map[string]any{"message": "404: Not Found", "code": 0})
+        }
+    default:
+        return fakeJSON(w, 404, map[string]any{"message": "404: Not Found", "code": 0})
+    }
+    now := time.Now().UTC().Format(time.RFC3339Nano)
+    if msgID == "" {
+        if r.Method != http.MethodPost { return fakeJSON(w, 405, map[string]any{"message": "405: Method Not Allowed", "code": 0}) }
+        var in DiscordMessage
+        var files []fakeAttachment
+        if mt, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "multipart/form-data" {
+            var err error
+            if body, files, err = fakeMultipart(body, params["boundary"]); err != nil { return fakeJSON(w, 400, map[string]any{"message": "Invalid Form Body", "code": 50035}) }
+        }
+        if err := json.Unmarshal(body, &in); err != nil { return fakeJSON(w, 400, map[string]any{"message": "Invalid JSON", "code": 50109}) }
+        var forum struct{ ThreadName string `json:"thread_name"` }
+        _ = json.Unmarshal(body, &forum)
+        if forum.ThreadName != "" && webhookID != "" {
+            f.nextID++
+            t := &fakeThread{ID: strconv.FormatInt(f.nextID, 10), ParentID: channelID, Name: forum.ThreadName}
+            f.threads[t.ID] = t
+            channelID = t.ID
+        }
+        f.nextID++
+        m := &fakeMessage{ID: strconv.FormatInt(f.nextID, 10), ChannelID: channelID, WebhookID: webhookID, Content: in.Content, Embeds: in.Embeds, Attachments: files, Timestamp: now}
+        if m.Embeds == nil { m.Embeds = []DiscordEmbed{} }
+        if m.Attachments == nil { m.Attachments = []fakeAttachment{} }
+        for i := range m.Attachments {
+            f.nextID++
+            m.Attachments[i].ID = strconv.FormatInt(f.nextID, 10)
+        }
+        f.messages[m.ID] = m
+        if webhookID != "" && r.URL.Query().Get("wait") != "true" {
+            w.WriteHeader(204)
+            return 204
+        }
+        return fakeJSON(w, 200, m)
+    }
+    m, ok := f.messages[msgID]
+    if !ok || m.ChannelID != channelID {
+        return fakeJSON(w, 404, map[string]any{"message": "Unknown Message", "code": 10008})
+    }
+    switch r.Method {
+    case http.MethodGet:
+        return fakeJSON(w, 200, m)
+    case http.MethodPatch:
+        var in struct {
+            Content *string         `json:"content"`
+            Embeds  *[]DiscordEmbed `json:"embeds"`
+        }
+        if err := json.Unmarshal(body, &in); err != nil { return fakeJSON(w, 400, map[string]any{"message": "Invalid JSON", "code": 50109}) }
+        if in.Content != nil { m.Content = *in.Content }
+        if in.Embeds != nil { m.Embeds = *in.Embeds }
+        m.EditedAt = now
+        return fakeJSON(w, 200, m)
+    case http.MethodDelete:
+        delete(f.messages, msgID)
+        w.WriteHeader(204)
+        return 204
+    }
+    return fakeJSON(w, 405, map[string]any{"message": "405: Method Not Allowed", "code": 0})
+}
+
+// handleThreads starts a thread from a message or archives/locks one.
+func (f *fakeDiscord) handleThreads(w http.ResponseWriter, r *http.Request, parts []string, body []byte) int {
+    if !strings.HasPrefix(r.Header.Get("Authorization"), "Bot ") {
+        return fakeJSON(w, 401, map[string]any{"message": "401: Unauthorized", "code": 0})
+    }
+    if len(parts) == 5 {
+        if r.Method != http.MethodPost { return fakeJSON(w, 405, map[string]any{"message": "405: Method Not Allowed", "code": 0}) }
+        if m, ok := f.messages[parts[3]]; !ok || m.ChannelID != parts[1] {
+            return fakeJSON(w, 404, map[string]any{"message": "Unknown Message", "code": 10008})
+        }
+        var in struct{ Name string `json:"name"` }
+        _ = json.Unmarshal(body, &in)
+        // like Discord, the thread takes the ID of its starter message
+        t := &fakeThread{ID: parts[3], ParentID: parts[1], Name: in.Name}
+        f.threads[t.ID] = t
+        return fakeJSON(w, 201, map[string]any{"id": t.ID, "type": 11, "parent_id": t.ParentID, "name": t.Name})
+    }
+    t := f.threads[parts[1]]
+    if t == nil { return fakeJSON(w, 404, map[string]any{"message": "Unknown Channel", "code": 10003}) }
+    if r.Method != http.MethodPatch { return fakeJSON(w, 405, map[string]any{"message": "405: Method Not Allowed", "code": 0}) }
+    var in struct{ Archived *bool `json:"archived"`; Locked *bool `json:"locked"` }
+    _ = json.Unmarshal(body, &in)
+    if in.Archived != nil { t.Archived = *in.Archived }
+    if in.Locked != nil { t.Locked = *in.Locked }
+    return fakeJSON(w, 200, map[string]any{"id": t.ID, "type": 11, "thread_metadata": map[string]any{"archived": t.Archived, "locked": t.Locked}})
+}
+
+func (f *fakeDiscord) handleCommands(w http.ResponseWriter, r *http.Request, path string, body []byte) int {
+    if !strings.HasPrefix(r.Header.Get("Authorization"), "Bot ") {
+        return fakeJSON(w, 401, map[string]any{"message": "401: Unauthorized", "code": 0})
+    }
+    switch r.Method {
+    case http.MethodPut:
+        if !json.Valid(body) { return fakeJSON(w, 400, map[string]any{"message": "Invalid JSON", "code": 50109}) }
+        f.commands[path] = body
+        return fakeJSON(w, 200, json.RawMessage(body))
+    case http.MethodGet:
+        if c, ok := f.commands[path]; ok { return fakeJSON(w, 200, c) }
+        return fakeJSON(w, 200, []any{})
+    }
+    return fakeJSON(w, 405, map[string]any{"message": "405: Method Not Allowed", "code": 0})
+}
+
+// fakeMultipart returns payload_json and the uploaded files of a multipart body.
+func fakeMultipart(body []byte, boundary string) ([]byte, []fakeAttachment, error) {
+    mr := multipart.NewReader(bytes.NewReader(body), boundary)
+    payload := []byte("{}")
+    var files []fakeAttachment
+    for {
+        p, err := mr.NextPart()
+        if err == io.EOF { break }
+        if err != nil { return nil, nil, err }
+        b, err := io.ReadAll(p)
+        if err != nil { return nil, nil, err }
+        if p.FormName() == "payload_json" {
+            payload = b
+        } else if p.FileName() != "" {
+            files = append(files, fakeAttachment{Filename: p.FileName(), ContentType: p.Header.Get("Content-Type"), Size: len(b)})
+        }
+    }
+    return payload, files, nil
+}
+
+func fakeError(w http.ResponseWriter, ft fakeFault) int {
+    switch ft.Status {
+    case http.StatusTooManyRequests:
+        ra := ft.RetryAfter
+        if ra <= 0 { ra = 1 }
+        scope := "user"
+        if ft.Global {
+            scope = "global"
+            w.Header().Set("X-RateLimit-Global", "true")
+        }
+        w.Header().Set("Retry-After", strconv.FormatFloat(ra, 'f', -1, 64))
+        w.Header().Set("X-RateLimit-Remaining", "0")
+        w.Header().Set("X-RateLimit-Reset-After", strconv.FormatFloat(ra, 'f', -1, 64))
+        w.Header().Set("X-RateLimit-Scope", scope)
+        return fakeJSON(w, 429, map[string]any{"message": "You are being rate limited.", "retry_after": ra, "global": ft.Global})
+    case http.StatusNotFound:
+        return fakeJSON(w, 404, map[string]any{"message": "Unknown Message", "code": 10008})
+    }
+    return fakeJSON(w, ft.Status, map[string]any{"message": http.StatusText(ft.Status), "code": 0})
+}
+
+func fakeJSON(w http.ResponseWriter, code int, v any) int {
+    w.Header().Set("Content-Type", "application/json")
+    if code < 300 { w.Header().Set("X-RateLimit-Remaining", "4") }
+    w.WriteHeader(code)
+    _ = json.NewEncoder(w).Encode(v)
+    return code
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+    "bytes"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "os"
+    "strconv"
+    "time"
+)
+
+// Single-writer mode (singleWriter): the tanuesa-launched CLI hands the win to
+// the running API server via POST /api/event so that one process owns the
+// state and Discord calls happen asynchronously there. When the server is not
+// healthy the CLI falls back to writing files itself.
+
+func newEventID() string {
+    b := make([]byte, 8)
+    if _, err := rand.Read(b); err != nil {
+        return strconv.FormatInt(time.Now().UnixNano(), 36)
+    }
+    return hex.EncodeToString(b)
+}
+
+// forwardUpdate posts the event to the local API server. handled reports
+// whether the server produced a definitive answer (applied, suppressed or
+// rejected); when false the caller should apply the event directly.
+func forwardUpdate(port int, winner string, flag int, eventID string) (handled bool, err error) {
+    if port <= 0 { port = 3010 }
+    baseURL := fmt.Sprintf("http://127.0.0.1:%d", port)
+    hc := &http.Client{Timeout: 800 * time.Millisecond}
+    resp, err := hc.Get(baseURL + "/api/health")
+    if err != nil {
+        return false, nil // not running: direct write, nothing to report
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return false, nil
+    }
+
+    body, _ := json.Marshal(map[string]string{"winner": winner, "hitFlag": strconv.Itoa(flag), "eventId": eventID})
+    pc := &http.Client{Timeout: lockTimeout + 5*time.Second}
+    resp, err = pc.Post(baseURL+"/api/event", "application/json", bytes.NewReader(body))
+    if err != nil {
+        return false, err
+    }
+    defer resp.Body.Close()
+    var res struct {
+        OK         bool   `json:"ok"`
+        Suppressed bool   `json:"suppressed"`
+        Error      string `json:"error"`
+    }
+    _ = json.NewDecoder(resp.Body).Decode(&res)
+    switch {
+    case resp.StatusCode == http.StatusOK && res.Suppressed:
+        return true, errDuplicateSuppressed
+    case resp.StatusCode == http.StatusOK:
+        return true, nil
+    case resp.StatusCode == http.StatusBadRequest, resp.StatusCode == http.StatusConflict:
+        // rejected (400), or the server recovered a corrupted current.json and
+        // applied the win on top of it (409): reported, but not written again
+        return true, errors.New(res.Error)
+    case resp.StatusCode == http.StatusNotFound:
+        // older server without /api/event
+        return false, nil
+    }
+    return false, fmt.Errorf("api server: %s %s", resp.Status, res.Error)
+}
+
+// journalHasEvent reports whether a forwarded event id was already applied.
+// Only used on the fallback path, so a full journal scan is acceptable.
+func journalHasEvent(base, eventID string) bool {
+    entries, _, err := readJournal(journalPath(base))
+    if err != nil {
+        if !os.IsNotExist(err) {
+            _ = appendAppLog(base, "warn: journal read failed: "+err.Error())
+        }
+        return false
+    }
+    for i := len(entries) - 1; i >= 0; i-- {
+        if entries[i].EventID == eventID { return true }
+    }
+    return false
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+    "bytes"
+    "crypto/ed25519"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "sort"
+    "strings"
+)
+
+// Discord slash commands (HTTP interactions).
+// `gacha serve` answers POST /api/discord/interactions; set it (through a
+// tunnel, the server only listens on 127.0.0.1) as the application's
+// Interactions Endpoint URL. Requests are verified with the application's
+// public key (DISCORD_PUBLIC_KEY). Commands:
+//   /gacha status <user> <none|progress|done>
+//   /gacha ref <user> <on|off>
+//   /gacha list
+// status/ref go through doSetStatus / doSetRef like the HTTP API (journal,
+// data.js, notifiers); the reply is deferred and edited afterwards because a
+// summary refresh can take longer than Discord's 3 second window.
+// `gacha discord register-commands` registers the command (guild-scoped with
+// DISCORD_GUILD_ID, otherwise global).
+
+const (
+    interactionPing         = 1
+    interactionCommand      = 2
+    interactionAutocomplete = 4
+    responsePong            = 1
+    responseMessage         = 4
+    responseDeferredMessage = 5
+    responseAutocomplete    = 8
+    messageFlagEphemeral    = 64
+    discordContentMax       = 2000
+)
+
+type interactionOption struct {
+    Name    string              `json:"name"`
+    Type    int                 `json:"type"`
+    Value   any                 `json:"value,omitempty"`
+    Focused bool                `json:"focused,omitempty"`
+    Options []interactionOption `json:"options,omitempty"`
+}
+
+type interaction struct {
+    Type          int    `json:"type"`
+    ApplicationID string `json:"application_id"`
+    Token         string `json:"token"`
+    Data          struct {
+        Name    string              `json:"name"`
+        Options []interactionOption `json:"options"`
+    } `json:"data"`
+    Member *struct {
+        User struct{ Username string `json:"username"` } `json:"user"`
+    } `json:"member,omitempty"`
+    User *struct{ Username string `json:"username"` } `json:"user,omitempty"`
+}
+
+func (in interaction) username() string {
+    if in.Member != nil { return in.Member.User.Username }
+    if in.User != nil { return in.User.Username }
+    return ""
+}
+
+// optionString returns the string value of a named option.
+func optionString(opts []interactionOption, name string) string {
+    for _, o := range opts {
+        if o.Name == name {
+            if s, ok := o.Value.(string); ok { return strings.TrimSpace(s) }
+            return strings.TrimSpace(fmt.Sprint(o.Value))
+        }
+    }
+    return ""
+}
+
+// verifyDiscordSignature checks X-Signature-Ed25519 over timestamp+body.
+func verifyDiscordSignature(publicKeyHex, sigHex, timestamp string, body []byte) bool {
+    pk, err := hex.DecodeString(strings.TrimSpace(publicKeyHex))
+    if err != nil || len(pk) != ed25519.PublicKeySize { return false }
+    sig, err := hex.DecodeString(sigHex)
+    if err != nil || len(sig) != ed25519.SignatureSize || timestamp == "" { return false }
+    return ed25519.Verify(ed25519.PublicKey(pk), append([]byte(timestamp), body...), sig)
+}
+
+func interactionReply(w http.ResponseWriter, v any) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(200)
+    _ = json.NewEncoder(w).Encode(v)
+}
+
+func interactionMessage(content string) map[string]any {
+    return map[string]any{
+        "content":          truncateRunes(content, discordContentMax),
+        "flags":            messageFlagEphemeral,
+        "allowed_mentions": map[string]any{"parse": []string{}},
+    }
+}
+
+// handleDiscordInteraction serves /api/discord/interactions.
+func handleDiscordInteraction(base string, w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost { http.Error(w, "method", 405); return }
+    pub := strings.TrimSpace(os.Getenv("DISCORD_PUBLIC_KEY"))
+    if pub == "" {
+        _ = appendAppLog(base, "warn: discord interaction received but DISCORD_PUBLIC_KEY is not set")
+        http.Error(w, "interactions not configured", 503)
+        return
+    }
+    body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+    if err != nil { http.Error(w, "read", 400); return }
+    if !verifyDiscordSignature(pub, r.Header.Get("X-Signature-Ed25519"), r.Header.Get("X-Signature-Timestamp"), body) {
+        http.Error(w, "invalid request signature", 401)
+        return
+    }
+    var in interaction
+    if err := json.Unmarshal(body, &in); err != nil { http.Error(w, "bad json", 400); return }
+    switch in.Type {
+    case interactionPing:
+        interactionReply(w, map[string]any{"type": responsePong})
+        return
+    case interactionAutocomplete:
+        interactionReply(w, map[string]any{"type": responseAutocomplete, "data": map[string]any{"choices": userChoices(base, in)}})
+        return
+    case interactionCommand:
+    default:
+        http.Error(w, "unsupported interaction type", 400)
+        return
+    }
+    if in.Data.Name != "gacha" || len(in.Data.Options) == 0 {
+        interactionReply(w, map[string]any{"type": responseMessage, "data": interactionMessage("不明なコマンドです")})
+        return
+    }
+    sub := in.Data.Options[0]
+    switch sub.Name {
+    case "list":
+        st, err := loadState(base)
+        msg := ""
+        if err != nil { msg = "読み込みに失敗しました: " + err.Error() } else { msg = interactionList(st, loadSettings(base)) }
+        interactionReply(w, map[string]any{"type": responseMessage, "data": interactionMessage(msg)})
+    case "status", "ref":
+        // acknowledge now; the change (and summary refresh) may take longer than 3s
+        interactionReply(w, map[string]any{"type": responseDeferredMessage, "data": map[string]any{"flags": messageFlagEphemeral}})
+        go func() {
+            msg := runInteractionCommand(base, sub, in.username())
+            if err := editInteractionReply(in.ApplicationID, in.Token, msg); err != nil {
+                _ = appendAppLog(base, "warn: discord interaction reply failed: "+err.Error())
+            }
+        }()
+    default:
+        interactionReply(w, map[string]any{"type": responseMessage, "data": interactionMessage("不明なサブコマンドです: " + sub.Name)})
+    }
+}
+
+// runInteractionCommand applies /gacha status or /gacha ref and returns the reply text.
+func runInteractionCommand(base string, sub interactionOption, by string) string {
+    name := optionString(sub.Options, "user")
+    var err error
+    var done string
+    switch sub.Name {
+    case "status":
+        status := strings.ToLower(optionString(sub.Options, "status"))
+        _, err = doSetStatus(base, name, status)
+        done = fmt.Sprintf("%s の状態を %s にしました", name, status)
+    case "ref":
+        v := strings.ToLower(optionString(sub.Options, "value"))
+        if v != "on" && v != "off" {
+            err = errors.New("value は on / off で指定してください")
+            break
+        }
+        _, err = doSetRef(base, name, v == "on")
+        done = fmt.Sprintf("%s の参考画像を %s にしました", name, v)
+    }
+    if err != nil {
+        _ = appendAppLog(base, fmt.Sprintf("warn: discord /gacha %s by %q failed: %s", sub.Name, by, err.Error()))
+        if errors.Is(err, errUserNotFound) { return "ユーザーが見つかりません: " + escapeDiscordMarkdown(name) }
+        return "失敗しました: " + err.Error()
+    }
+    _ = appendAppLog(base, fmt.Sprintf("info: discord /gacha %s by %q: name=%q", sub.Name, by, name))
+    return escapeDiscordMarkdown(done)
+}
+
+// interactionList renders the summary groups as plain message text.
+func interactionList(st State, cfg Settings) string {
+    var b strings.Builder
+    for _, g := range buildSummaryGroups(st, cfg) {
+        lines := make([]string, 0, len(g.Lines))
+        for _, l := range g.Lines {
+            lines = append(lines, l.Emoji+" "+escapeDiscordMarkdown(l.Ref)+" "+escapeDiscordMarkdown(l.Name))
+        }
+        sort.Strings(lines)
+        if len(lines) == 0 { lines = []string{"なし"} }
+        fmt.Fprintf(&b, "**%s**\n%s\n", escapeDiscordMarkdown(g.Header), strings.Join(lines, "\n"))
+    }
+    out := strings.TrimRight(b.String(), "\n")
+    if runeLen(out) > discordContentMax {
+        out = truncateRunes(out, discordContentMax-20) + "\n…（省略）"
+    }
+    return out
+}
+
+// userChoices answers autocomplete for the user option (up to 25 names).
+func userChoices(base string, in interaction) []map[string]any {
+    prefix := ""
+    if len(in.Data.Options) > 0 {
+        for _, o := range in.Data.Options[0].Options {
+            if o.Focused { prefix = strings.ToLower(strings.TrimSpace(fmt.Sprint(o.Value))) }
+        }
+    }
+    st, _ := loadState(base)
+    choices := []map[string]any{}
+    for _, u := range st.Users {
+        if prefix != "" && !strings.Contains(strings.ToLower(u.Name), prefix) { continue }
+        choices = append(choices, map[string]any{"name": truncateRunes(u.Name, 100), "value": u.Name})
+        if len(choices) == 25 { break }
+    }
+    return choices
+}
+
+// editInteractionReply replaces the deferred "thinking" reply.
+func editInteractionReply(appID, token, content string) error {
+    u := fmt.Sprintf("%s/webhooks/%s/%s/messages/@original", discordAPI, appID, token)
+    b, _ := json.Marshal(interactionMessage(content))
+    req, _ := http.NewRequest("PATCH", u, bytes.NewReader(b))
+    req.Header.Set("Content-Type", "application/json")
+    resp, err := discordDo(req)
+    if err != nil { return err }
+    defer resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return discordStatusError("interaction reply", resp)
+    }
+    return nil
+}
+
+func gachaCommandDefinition() map[string]any {
+    user := map[string]any{"type": 3, "name": "user", "description": "ユーザー名", "required": true, "autocomplete": true}
+    return map[string]any{
+        "name":        "gacha",
+        "description": "ガチャ集計",
+        "type":        1,
+        // only members with Manage Server (0x20) see and run it by default;
+        // server admins can widen this under Integrations
+        "default_member_permissions": "32",
+        "dm_permission":              false,
+        "options": []map[string]any{
+            {"type": 1, "name": "status", "description": "制作状況を変更", "options": []map[string]any{
+                user,
+                {"type": 3, "name": "status", "description": "状態", "required": true, "choices": []map[string]any{
+                    {"name": "none（未着手）", "value": "none"},
+                    {"name": "progress（制作中）", "value": "progress"},
+                    {"name": "done（完了）", "value": "done"},
+                }},
+            }},
+            {"type": 1, "name": "ref", "description": "参考画像の有無を変更", "options": []map[string]any{
+                user,
+                {"type": 3, "name": "value", "description": "参考画像", "required": true, "choices": []map[string]any{
+                    {"name": "on（あり）", "value": "on"},
+                    {"name": "off（なし）", "value": "off"},
+                }},
+            }},
+            {"type": 1, "name": "list", "description": "当選者の一覧を表示"},
+        },
+    }
+}
+
+// registerDiscordCommands overwrites the application's commands with /gacha
+// and returns where they were registered.
+func registerDiscordCommands() (string, error) {
+    token := strings.TrimSpace(os.Getenv("DISCORD_BOT_TOKEN"))
+    appID := strings.TrimSpace(os.Getenv("DISCORD_APPLICATION_ID"))
+    guildID := strings.TrimSpace(os.Getenv("DISCORD_GUILD_ID"))
+    if token == "" || appID == "" {
+        return "", errors.New("DISCORD_BOT_TOKEN and DISCORD_APPLICATION_ID are required")
+    }
+    scope := "global"
+    u := fmt.Sprintf("%s/applications/%s/commands", discordAPI, appID)
+    if guildID != "" {
+        scope = "guild " + guildID
+        u = fmt.Sprintf("%s/applications/%s/guilds/%s/commands", discordAPI, appID, guildID)
+    }
+    b, _ := json.Marshal([]map[string]any{gachaCommandDefinition()})
+    req, _ := http.NewRequest("PUT", u, bytes.NewReader(b))
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("Authorization", "Bot "+token)
+    resp, err := discordDo(req)
+    if err != nil { return scope, err }
+    defer resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return scope, discordStatusError("register commands", resp)
+    }
+    return scope, nil
+}
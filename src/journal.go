@@ -0,0 +1,239 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// Append-only event journal (data/journal.jsonl).
+// Every mutation of current.json is appended here with a sequence number so that
+// the state can be rebuilt (`gacha rebuild`) or inspected at any point in time
+// (`gacha replay --until <time>`). Callers must hold the data lock and append
+// before saving current.json.
+
+const (
+    journalWin      = "win"
+    journalStatus   = "status"
+    journalRef      = "ref"
+    journalReset    = "reset"
+    journalRestore  = "restore"
+    journalAdjust   = "adjust"  // manual correction or undo of a win
+    journalSnapshot = "snapshot" // baseline written when the journal is first created
+)
+
+type JournalEntry struct {
+    Seq          int64  `json:"seq"`
+    At           string `json:"at"`
+    Type         string `json:"type"`
+    Name         string `json:"name,omitempty"`
+    HitFlag      *int   `json:"hitFlag,omitempty"`
+    Status       string `json:"status,omitempty"`
+    HasReference *bool  `json:"hasReference,omitempty"`
+    Counter      string `json:"counter,omitempty"` // win: counter incremented (see tiers)
+    EventID      string `json:"eventId,omitempty"` // win: id of a CLI event forwarded to serve
+    Deltas       map[string]int `json:"deltas,omitempty"` // adjust: counter -> delta
+    Hit          int    `json:"hit,omitempty"`     // adjust (legacy): delta
+    Jackpot      int    `json:"jackpot,omitempty"` // adjust (legacy): delta
+    Undoes       int64  `json:"undoes,omitempty"`  // adjust: seq of the reverted win
+    Backup       string `json:"backup,omitempty"`
+    State        *State `json:"state,omitempty"`
+}
+
+func journalPath(base string) string { return filepath.Join(base, "data", "journal.jsonl") }
+
+func appendJournal(base string, e JournalEntry) error {
+    p := journalPath(base)
+    var lines [][]byte
+    seq, err := lastJournalSeq(p)
+    if err != nil {
+        if !os.IsNotExist(err) { return err }
+        // first entry: record the pre-journal state so rebuild does not lose it
+        if st, lerr := loadState(base); lerr == nil && len(st.Users) > 0 {
+            seq++
+            b, merr := json.Marshal(JournalEntry{Seq: seq, At: time.Now().UTC().Format(time.RFC3339), Type: journalSnapshot, State: &st})
+            if merr != nil { return merr }
+            lines = append(lines, b)
+        }
+    }
+    seq++
+    e.Seq = seq
+    if e.At == "" { e.At = time.Now().UTC().Format(time.RFC3339) }
+    b, err := json.Marshal(e)
+    if err != nil { return err }
+    lines = append(lines, b)
+
+    if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil { return err }
+    f, err := os.OpenFile(p, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+    if err != nil { return err }
+    defer f.Close()
+    var buf bytes.Buffer
+    // a crash mid-write may leave a partial last line; start on a fresh line
+    if fi, err := f.Stat(); err == nil && fi.Size() > 0 {
+        last := make([]byte, 1)
+        if _, err := f.ReadAt(last, fi.Size()-1); err == nil && last[0] != '\n' {
+            buf.WriteByte('\n')
+        }
+    }
+    for _, ln := range lines {
+        buf.Write(ln)
+        buf.WriteByte('\n')
+    }
+    if _, err := f.Write(buf.Bytes()); err != nil { return err }
+    return f.Sync()
+}
+
+// lastJournalSeq reads the sequence number of the last entry without scanning
+// the whole file. Falls back to a full scan when the tail is unreadable.
+func lastJournalSeq(p string) (int64, error) {
+    f, err := os.Open(p)
+    if err != nil { return 0, err }
+    defer f.Close()
+    fi, err := f.Stat()
+    if err != nil { return 0, err }
+    size := fi.Size()
+    if size == 0 { return 0, nil }
+    chunk := int64(4096)
+    for {
+        if chunk > size { chunk = size }
+        buf := make([]byte, chunk)
+        if _, err := f.ReadAt(buf, size-chunk); err != nil && err != io.EOF { return 0, err }
+        trimmed := bytes.TrimRight(buf, "\r\n")
+        i := bytes.LastIndexByte(trimmed, '\n')
+        if i >= 0 || chunk == size {
+            var e struct{ Seq int64 `json:"seq"` }
+            if json.Unmarshal(trimmed[i+1:], &e) == nil && e.Seq > 0 {
+                return e.Seq, nil
+            }
+            break
+        }
+        chunk *= 4
+    }
+    entries, _, err := readJournal(p)
+    if err != nil { return 0, err }
+    var max int64
+    for _, e := range entries {
+        if e.Seq > max { max = e.Seq }
+    }
+    return max, nil
+}
+
+// readJournal returns all parsable entries and the number of skipped lines.
+func readJournal(p string) ([]JournalEntry, int, error) {
+    f, err := os.Open(p)
+    if err != nil { return nil, 0, err }
+    defer f.Close()
+    sc := bufio.NewScanner(f)
+    sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+    var out []JournalEntry
+    skipped := 0
+    for sc.Scan() {
+        ln := bytes.TrimSpace(sc.Bytes())
+        if len(ln) == 0 { continue }
+        var e JournalEntry
+        if err := json.Unmarshal(ln, &e); err != nil || e.Type == "" {
+            skipped++
+            continue
+        }
+        out = append(out, e)
+    }
+    if err := sc.Err(); err != nil { return out, skipped, err }
+    return out, skipped, nil
+}
+
+// replayJournal folds entries into a State. Entries after until are ignored
+// when until is non-zero. Returns the state and the number of applied entries.
+func replayJournal(entries []JournalEntry, until time.Time, rules []rewardRule) (State, int) {
+    st := State{Users: []User{}}
+    applied := 0
+    for _, e := range entries {
+        if !until.IsZero() {
+            at, err := time.Parse(time.RFC3339, e.At)
+            if err == nil && at.After(until) { break }
+        }
+        applyJournalEntry(&st, e, rules)
+        applied++
+    }
+    return st, applied
+}
+
+func applyJournalEntry(st *State, e JournalEntry, rules []rewardRule) {
+    switch e.Type {
+    case journalWin:
+        counter := e.Counter
+        if counter == "" {
+            flag := 0
+            if e.HitFlag != nil { flag = *e.HitFlag }
+            counter = tierCounter(nil, flag)
+        }
+        applyWin(st, e.Name, counter, e.At, rules)
+    case journalStatus:
+        applyStatus(st, e.Name, e.Status, e.At)
+    case journalRef:
+        if e.HasReference != nil { applyRef(st, e.Name, *e.HasReference, e.At) }
+    case journalAdjust:
+        deltas := e.Deltas
+        if deltas == nil {
+            deltas = map[string]int{"hit": e.Hit, "jackpot": e.Jackpot}
+        }
+        applyAdjust(st, e.Name, deltas, e.At, rules)
+    case journalReset:
+        *st = State{Users: []User{}, UpdatedAt: e.At}
+    case journalRestore, journalSnapshot:
+        if e.State != nil {
+            users := make([]User, len(e.State.Users))
+            copy(users, e.State.Users)
+            *st = State{Users: users, UpdatedAt: e.State.UpdatedAt}
+            normalizeStateCounts(st)
+        }
+    }
+}
+
+// parseTimeArg accepts RFC3339 or local "2006-01-02 15:04[:05]" / "2006-01-02T15:04[:05]".
+func parseTimeArg(s string) (time.Time, error) {
+    s = strings.TrimSpace(s)
+    if t, err := time.Parse(time.RFC3339, s); err == nil { return t, nil }
+    for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"} {
+        if t, err := time.ParseInLocation(layout, s, time.Local); err == nil { return t, nil }
+    }
+    return time.Time{}, fmt.Errorf("invalid time: %q (use RFC3339 or 2006-01-02 15:04:05)", s)
+}
+
+// doRebuild recomputes current.json from the journal. The previous file is kept
+// as data/current.before-rebuild.json.
+func doRebuild(base string) (int, error) {
+    lk, err := acquireLock(base)
+    if err != nil { return 0, err }
+    defer lk.release()
+    entries, skipped, err := readJournal(journalPath(base))
+    if err != nil {
+        if os.IsNotExist(err) { return 0, errors.New("journal not found: " + journalPath(base)) }
+        return 0, err
+    }
+    if len(entries) == 0 { return 0, errors.New("journal is empty") }
+    st, applied := replayJournal(entries, time.Time{}, loadRewardRules(base, loadSettings(base)))
+    if b, err := os.ReadFile(statePath(base)); err == nil {
+        if err := writeFileAtomic(filepath.Join(base, "data", "current.before-rebuild.json"), b); err != nil { return 0, err }
+    }
+    if err := saveState(base, st); err != nil { return 0, err }
+    if err := genDataJS(base); err != nil { return 0, err }
+    if skipped > 0 {
+        _ = appendAppLog(base, fmt.Sprintf("warn: rebuild skipped %d unreadable journal lines", skipped))
+    }
+    return applied, appendAppLog(base, fmt.Sprintf("rebuild: applied %d journal entries (users=%d)", applied, len(st.Users)))
+}
+
+// doReplay returns the state as of until without touching any file.
+func doReplay(base string, until time.Time) (State, int, error) {
+    entries, _, err := readJournal(journalPath(base))
+    if err != nil { return State{}, 0, err }
+    st, applied := replayJournal(entries, until, loadRewardRules(base, loadSettings(base)))
+    return st, applied, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+// Cross-process exclusive lock for data/*.json.
+// gacha.exe is started once per win by tanuesa, so several processes (and the
+// serve goroutines) may read-modify-write current.json / discord_map.json /
+// session.json at the same time. Every mutating entry point takes this lock.
+// Notifications (Discord, Slack, outgoing webhooks) run under a second lock,
+// data/.notify.lock, so a slow delivery does not block wins: notifiers take
+// the data lock only briefly to read state or persist discord_map.json and
+// session.json. Lock order is notify -> data; never wait for the notify lock
+// while holding the data lock.
+const (
+    lockTimeout      = 20 * time.Second
+    lockStaleAfter   = 30 * time.Second
+    lockHeartbeat    = 5 * time.Second
+    lockPollInterval = 25 * time.Millisecond
+)
+
+var (
+    errLockTimeout       = errors.New("lock timeout: another gacha process is still updating data")
+    errNotifyLockTimeout = errors.New("notify lock timeout: another gacha process is still delivering notifications")
+)
+
+func lockPath(base string) string { return filepath.Join(base, "data", ".lock") }
+
+func notifyLockPath(base string) string { return filepath.Join(base, "data", ".notify.lock") }
+
+type fileLock struct {
+    path string
+    stop chan struct{}
+    done chan struct{}
+}
+
+// acquireLock creates data/.lock exclusively, waiting up to lockTimeout.
+// A lock whose mtime is older than lockStaleAfter is treated as left behind by a
+// crashed process and removed. The holder refreshes mtime periodically so that
+// long operations (e.g. slow Discord requests) are not mistaken for stale.
+func acquireLock(base string) (*fileLock, error) {
+    return acquireFileLock(base, lockPath(base), errLockTimeout)
+}
+
+// acquireNotifyLock takes data/.notify.lock like acquireLock.
+func acquireNotifyLock(base string) (*fileLock, error) {
+    return acquireFileLock(base, notifyLockPath(base), errNotifyLockTimeout)
+}
+
+func acquireFileLock(base, p string, timeoutErr error) (*fileLock, error) {
+    if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+        return nil, err
+    }
+    deadline := time.Now().Add(lockTimeout)
+    for {
+        f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+        if err == nil {
+            _, _ = fmt.Fprintf(f, "pid=%d at=%s\n", os.Getpid(), time.Now().UTC().Format(time.RFC3339))
+            f.Close()
+            l := &fileLock{path: p, stop: make(chan struct{}), done: make(chan struct{})}
+            go l.heartbeat()
+            return l, nil
+        }
+        if !os.IsExist(err) && !os.IsPermission(err) {
+            return nil, err
+        }
+        if fi, serr := os.Stat(p); serr == nil && time.Since(fi.ModTime()) > lockStaleAfter {
+            // re-check right before removal to narrow the race with a fresh holder
+            if fi2, serr2 := os.Stat(p); serr2 == nil && fi2.ModTime().Equal(fi.ModTime()) {
+                if os.Remove(p) == nil {
+                    _ = appendAppLog(base, fmt.Sprintf("warn: removed stale lock %s (age=%s)", filepath.Base(p), time.Since(fi.ModTime()).Round(time.Second)))
+                }
+                continue
+            }
+        }
+        if time.Now().After(deadline) {
+            return nil, timeoutErr
+        }
+        time.Sleep(lockPollInterval)
+    }
+}
+
+func (l *fileLock) heartbeat() {
+    defer close(l.done)
+    t := time.NewTicker(lockHeartbeat)
+    defer t.Stop()
+    for {
+        select {
+        case <-l.stop:
+            return
+        case <-t.C:
+            now := time.Now()
+            _ = os.Chtimes(l.path, now, now)
+        }
+    }
+}
+
+func (l *fileLock) release() {
+    if l == nil { return }
+    close(l.stop)
+    <-l.done
+    _ = os.Remove(l.path)
+}
+
+// withLock runs fn while holding the data lock.
+func withLock(base string, fn func() error) error {
+    l, err := acquireLock(base)
+    if err != nil {
+        return err
+    }
+    defer l.release()
+    return fn()
+}
+
+// withNotifyLock runs fn while holding the notify lock. Callers must not hold
+// the data lock.
+func withNotifyLock(base string, fn func() error) error {
+    l, err := acquireNotifyLock(base)
+    if err != nil {
+        return err
+    }
+    defer l.release()
+    return fn()
+}
@@ -29,15 +29,18 @@ type User struct {
     Name    string `json:"name"`
     Hit     int    `json:"hit"`
     Jackpot int    `json:"jackpot"`
+    Counts  map[string]int `json:"counts"` // counter name -> wins (hit/jackpot above mirror this)
     Flags   Flags  `json:"flags"`
     Done    bool   `json:"done"`
     Order   int    `json:"order"`
     Status  string `json:"status"`
     Present string `json:"present"`
     HasReference bool `json:"hasReference"`
+    Rewards []string `json:"rewards,omitempty"`
 }
 
 type State struct {
+    SchemaVersion int `json:"schemaVersion,omitempty"`
     Users     []User `json:"users"`
     UpdatedAt string `json:"updatedAt"`
 }
@@ -46,6 +49,7 @@ type State struct {
 type DiscordMap map[string]string
 
 type Settings struct {
+    SchemaVersion int `json:"schemaVersion"`
     EventJSONLog bool `json:"eventJsonLog"`
     AutoServe    bool `json:"autoServe"`
     ServerPort   int  `json:"serverPort"`
@@ -61,6 +65,23 @@ type Settings struct {
     DiscordHeaderIllustration string `json:"discordHeaderIllustration"`
     DiscordRefLabelYes string `json:"discordRefLabelYes"`
     DiscordRefLabelNo  string `json:"discordRefLabelNo"`
+    DebounceEnabled bool `json:"debounceEnabled"`
+    DebounceWindowMs int `json:"debounceWindowMs"`
+    Rewards []RewardRule `json:"rewards,omitempty"`
+    Tiers []PrizeTier `json:"tiers,omitempty"`
+    SingleWriter bool `json:"singleWriter"`
+    Webhooks []OutgoingWebhook `json:"webhooks,omitempty"`
+    SlackEnabled bool `json:"slackEnabled"`
+    SlackAPIBase string `json:"slackApiBase"`
+    DiscordAPIBase string `json:"discordApiBase"`
+    DiscordTemplates DiscordTemplates `json:"discordTemplates"`
+    BackupRetention BackupRetention `json:"backupRetention"`
+    DiscordAnnounceEnabled bool `json:"discordAnnounceEnabled"`
+    DiscordAnnouncePerMinute int `json:"discordAnnouncePerMinute"`
+    DiscordAnnounceDeleteAfterMin int `json:"discordAnnounceDeleteAfterMin"`
+    DiscordThreadPerSession bool `json:"discordThreadPerSession"`
+    DiscordMentionInSummary bool `json:"discordMentionInSummary"`
+    DiscordMentionOnDone bool `json:"discordMentionOnDone"`
 }
 
 type Event struct {
@@ -73,6 +94,11 @@ type Event struct {
 type Session struct {
     ID        string `json:"id"`
     StartedAt string `json:"startedAt"`
+    ThreadID  string `json:"threadId,omitempty"`  // Discord thread of this session (threads.go)
+    ThreadVia string `json:"threadVia,omitempty"` // "bot" or "webhook" (forum post)
+    // set by newSession until the notifier archived the previous session
+    ArchivePending bool   `json:"archivePending,omitempty"`
+    PrevThreadID   string `json:"prevThreadId,omitempty"`
 }
 
 // Discord embed payloads
@@ -96,8 +122,9 @@ type DiscordEmbed struct {
 }
 
 type DiscordMessage struct {
-    Content string         `json:"content,omitempty"`
-    Embeds  []DiscordEmbed `json:"embeds,omitempty"`
+    Content         string         `json:"content,omitempty"`
+    Embeds          []DiscordEmbed `json:"embeds,omitempty"`
+    AllowedMentions map[string]any `json:"allowed_mentions,omitempty"`
 }
 
 // Escape Discord markdown meta characters to avoid unintended formatting
@@ -121,6 +148,16 @@ func escapeDiscordMarkdown(s string) string {
     return discordMarkdownEscaper.Replace(s)
 }
 
+// needsStartupMigration reports whether the command reads or writes data files.
+func needsStartupMigration(args []string) bool {
+    if len(args) == 0 { return false }
+    switch strings.ToLower(args[0]) {
+    case "-h", "--help", "help", "-v", "--version", "version", "migrate":
+        return false
+    }
+    return true
+}
+
 func main() {
     base := baseDir()
     // Load .env.local if present (simple dotenv)
@@ -128,19 +165,22 @@ func main() {
     if err := ensureDirs(base); err != nil {
         fatal(err)
     }
-    // Migrate current.json to remove legacy Japanese keys
-    if err := migrateCurrentJSON(base); err != nil {
-        _ = appendAppLog(base, "warn: migrate current.json failed: "+err.Error())
-    }
-    if err := ensureDiscordMapExists(base); err != nil {
-        _ = appendAppLog(base, "warn: ensure discord_map.json failed: "+err.Error())
-    }
     if err := ensureSettingsExists(base); err != nil {
         _ = appendAppLog(base, "warn: ensure setting.json failed: "+err.Error())
     }
-    // Upgrade settings for backward-compatibility (add new fields with defaults)
-    if err := ensureSettingsUpgraded(base); err != nil {
-        _ = appendAppLog(base, "warn: upgrade setting.json failed: "+err.Error())
+    // Bring data files to the current schema (`gacha migrate` does it by hand);
+    // help and version do not touch data
+    if needsStartupMigration(os.Args[1:]) {
+        if err := migrateLiveFiles(base); err != nil {
+            if errors.Is(err, errSchemaTooNew) {
+                _ = appendAppLog(base, "error: "+err.Error())
+                fatal(err)
+            }
+            _ = appendAppLog(base, "warn: startup migration skipped: "+err.Error())
+        }
+    }
+    if _, err := compileDiscordTemplates(loadSettings(base).DiscordTemplates); err != nil {
+        _ = appendAppLog(base, "warn: invalid discordTemplates in setting.json, using defaults: "+err.Error())
     }
 
     args := os.Args[1:]
@@ -150,8 +190,9 @@ func main() {
     }
 
     cmd := strings.ToLower(args[0])
+    discordAPI = discordAPIBase(loadSettings(base))
     // Auto-serve: spawn API server if enabled and not serving now
-    if s := loadSettings(base); s.AutoServe && cmd != "serve" {
+    if s := loadSettings(base); s.AutoServe && cmd != "serve" && cmd != "fake-discord" {
         ensureAPISpawned(base, s.ServerPort)
     }
     switch cmd {
@@ -162,7 +203,11 @@ func main() {
         fmt.Println(version)
         return
     case "reset":
-        if err := doReset(base); err != nil {
+        label, note, err := parseBackupMetaFlags(args[1:])
+        if err != nil {
+            fatal(fmt.Errorf("%v (usage: gacha reset [--label <text>] [--note <text>])", err))
+        }
+        if err := doReset(base, deref(label), deref(note)); err != nil {
             fatal(err)
         }
         fmt.Println("reset: completed")
@@ -174,11 +219,74 @@ func main() {
         fmt.Println("gen-datajs: completed")
         return
     case "backup":
-        if _, err := doBackup(base); err != nil {
+        label, note, err := parseBackupMetaFlags(args[1:])
+        if err != nil {
+            fatal(fmt.Errorf("%v (usage: gacha backup [--label <text>] [--note <text>])", err))
+        }
+        if _, err := doBackup(base, deref(label), deref(note)); err != nil {
             fatal(err)
         }
         fmt.Println("backup: completed")
         return
+    case "backups":
+        infos, err := listBackupInfo(base)
+        if err != nil {
+            fatal(err)
+        }
+        if len(args) >= 2 && args[1] == "--json" {
+            b, _ := json.MarshalIndent(infos, "", "  ")
+            fmt.Println(string(b))
+            return
+        }
+        for _, bi := range infos {
+            printBackupInfo(os.Stdout, bi)
+        }
+        return
+    case "diff":
+        var names []string
+        asJSON := false
+        for _, a := range args[1:] {
+            if a == "--json" { asJSON = true; continue }
+            names = append(names, a)
+        }
+        if len(names) < 1 || len(names) > 2 {
+            fatal(errors.New("usage: gacha diff <from> [<to>] [--json]  (backup name or \"current\"; <to> defaults to current)"))
+        }
+        names = append(names, "current")
+        d, err := diffSnapshots(base, names[0], names[1])
+        if err != nil {
+            fatal(err)
+        }
+        if asJSON {
+            b, _ := json.MarshalIndent(d, "", "  ")
+            fmt.Println(string(b))
+        } else {
+            printStateDiff(os.Stdout, d)
+        }
+        return
+    case "backup-meta":
+        if len(args) < 2 {
+            fatal(errors.New("usage: gacha backup-meta <backupName> [--label <text>] [--note <text>]"))
+        }
+        label, note, err := parseBackupMetaFlags(args[2:])
+        if err != nil {
+            fatal(fmt.Errorf("%v (usage: gacha backup-meta <backupName> [--label <text>] [--note <text>])", err))
+        }
+        p, err := findBackup(base, args[1])
+        if err != nil {
+            fatal(err)
+        }
+        var meta BackupMeta
+        if label == nil && note == nil {
+            meta, err = readBackupMeta(p)
+        } else {
+            meta, err = setBackupMeta(base, args[1], label, note)
+        }
+        if err != nil {
+            fatal(err)
+        }
+        printBackupInfo(os.Stdout, backupInfo{Name: filepath.Base(p), Compressed: strings.HasSuffix(p, gzExt), Meta: meta})
+        return
     case "serve":
         port := 3010
         if len(args) >= 2 {
@@ -190,6 +298,17 @@ func main() {
             fatal(err)
         }
         return
+    case "fake-discord":
+        port := 3011
+        if len(args) >= 2 {
+            if p, err := strconv.Atoi(args[1]); err == nil && p > 0 {
+                port = p
+            }
+        }
+        if err := serveFakeDiscord(port); err != nil {
+            fatal(err)
+        }
+        return
     case "gen-backup-index":
         if err := genBackupIndex(base); err != nil {
             fatal(err)
@@ -205,12 +324,305 @@ func main() {
         }
         fmt.Println("restore: completed")
         return
+    case "rebuild":
+        n, err := doRebuild(base)
+        if err != nil {
+            fatal(err)
+        }
+        fmt.Printf("rebuild: completed (%d entries)\n", n)
+        return
+    case "migrate":
+        dryRun, asJSON := false, false
+        for _, a := range args[1:] {
+            switch a {
+            case "--dry-run":
+                dryRun = true
+            case "--json":
+                asJSON = true
+            default:
+                fatal(errors.New("usage: gacha migrate [--dry-run] [--json]"))
+            }
+        }
+        var reps []migrationReport
+        var merr error
+        if err := withLock(base, func() error {
+            reps, merr = migrateDataFiles(base, dryRun)
+            return nil
+        }); err != nil {
+            fatal(err)
+        }
+        if asJSON {
+            b, _ := json.MarshalIndent(reps, "", "  ")
+            fmt.Println(string(b))
+        } else {
+            printMigrationReports(os.Stdout, reps, dryRun)
+        }
+        if merr != nil {
+            fatal(merr)
+        }
+        for _, r := range reps {
+            if r.Error != "" { os.Exit(1) }
+        }
+        return
+    case "prune-backups":
+        dryRun, asJSON := false, false
+        for _, a := range args[1:] {
+            switch a {
+            case "--dry-run":
+                dryRun = true
+            case "--json":
+                asJSON = true
+            default:
+                fatal(errors.New("usage: gacha prune-backups [--dry-run] [--json]"))
+            }
+        }
+        pol := loadSettings(base).BackupRetention
+        if !pol.enabled() {
+            fmt.Fprintln(os.Stderr, "prune-backups: backupRetention in setting.json keeps everything (set keepLast/keepDaily/keepWeekly/keepMonthly or compressAfter)")
+        }
+        var rep pruneReport
+        if err := withLock(base, func() error {
+            var err error
+            if rep, err = pruneBackups(base, pol, dryRun); err != nil || dryRun { return err }
+            return genBackupIndex(base)
+        }); err != nil {
+            fatal(err)
+        }
+        if asJSON {
+            b, _ := json.MarshalIndent(rep, "", "  ")
+            fmt.Println(string(b))
+        } else {
+            printPruneReport(os.Stdout, rep, dryRun)
+        }
+        if rep.Errors > 0 {
+            os.Exit(1)
+        }
+        return
+    case "undo":
+        n := 1
+        if len(args) >= 2 {
+            v, err := strconv.Atoi(args[1])
+            if err != nil || v <= 0 {
+                fatal(errors.New("usage: gacha undo [count]"))
+            }
+            n = v
+        }
+        undone, err := doUndo(base, n)
+        if err != nil {
+            fatal(err)
+        }
+        for _, e := range undone {
+            fmt.Printf("undo: seq=%d %s\n", e.Seq, e.Name)
+        }
+        fmt.Printf("undo: completed (%d)\n", len(undone))
+        return
+    case "adjust":
+        if len(args) < 3 {
+            fatal(errors.New("usage: gacha adjust <name> [--hit <+n|-n>] [--jackpot <+n|-n>] [--<counter> <+n|-n>]"))
+        }
+        tiers := loadTiers(base, loadSettings(base))
+        deltas := map[string]int{}
+        for i := 2; i < len(args); i++ {
+            key, val := args[i], ""
+            if k, v, ok := strings.Cut(key, "="); ok {
+                key, val = k, v
+            } else if i+1 < len(args) {
+                i++
+                val = args[i]
+            }
+            n, err := strconv.Atoi(strings.TrimSpace(val))
+            if err != nil {
+                fatal(fmt.Errorf("invalid value for %s: %q", key, val))
+            }
+            counter := ""
+            for _, t := range tiers {
+                if strings.EqualFold(key, "--"+t.Counter) { counter = t.Counter }
+            }
+            if counter == "" {
+                fatal(fmt.Errorf("unknown option: %s", key))
+            }
+            deltas[counter] += n
+        }
+        if _, err := doAdjust(base, args[1], deltas); err != nil {
+            fatal(err)
+        }
+        fmt.Println("adjust: completed")
+        return
+    case "recompute":
+        n, err := doRecompute(base)
+        if err != nil {
+            fatal(err)
+        }
+        fmt.Printf("recompute: completed (%d changed)\n", n)
+        return
+    case "replay":
+        var until time.Time
+        for i := 1; i < len(args); i++ {
+            a := args[i]
+            v := ""
+            if strings.HasPrefix(a, "--until=") {
+                v = strings.TrimPrefix(a, "--until=")
+            } else if a == "--until" && i+1 < len(args) {
+                i++
+                v = args[i]
+            } else {
+                fatal(errors.New("usage: gacha replay [--until <time>]"))
+            }
+            t, err := parseTimeArg(v)
+            if err != nil {
+                fatal(err)
+            }
+            until = t
+        }
+        st, _, err := doReplay(base, until)
+        if err != nil {
+            fatal(err)
+        }
+        b, _ := json.MarshalIndent(st, "", "  ")
+        fmt.Println(string(b))
+        return
+    case "deliverable":
+        sub := ""
+        if len(args) >= 2 { sub = strings.ToLower(args[1]) }
+        switch {
+        case sub == "add" && len(args) == 4:
+            data, err := os.ReadFile(args[3])
+            if err != nil {
+                fatal(err)
+            }
+            d, err := doRegisterDeliverable(base, args[2], args[3], data)
+            if err != nil {
+                fatal(err)
+            }
+            fmt.Printf("deliverable: registered %s -> data/deliverables/%s\n", d.Name, d.File)
+            if d.MessageID != "" {
+                fmt.Println("deliverable: posted to discord (" + d.MessageID + ")")
+            }
+        case sub == "remove" && len(args) == 3:
+            if err := doRemoveDeliverable(base, args[2]); err != nil {
+                fatal(err)
+            }
+            fmt.Println("deliverable: removed")
+        case sub == "list" && len(args) == 2:
+            idx, err := loadDeliverables(base)
+            if err != nil {
+                fatal(err)
+            }
+            for _, d := range sortedDeliverables(idx) {
+                posted := "-"
+                if d.MessageID != "" { posted = d.PostedAt }
+                fmt.Printf("%s\t%s\t%d\t%s\n", d.Name, d.OriginalName, d.Size, posted)
+            }
+        default:
+            fatal(errors.New("usage: gacha deliverable add <name> <file.png|gif> | remove <name> | list"))
+        }
+        return
+    case "discord":
+        sub := ""
+        if len(args) >= 2 { sub = strings.ToLower(args[1]) }
+        switch sub {
+        case "flush":
+            var sent, queued int
+            err := withNotifyLock(base, func() error {
+                var ferr error
+                sent, queued, ferr = flushOutbox(base, true)
+                return ferr
+            })
+            if err != nil {
+                fatal(err)
+            }
+            postPendingDeliverables(base)
+            fmt.Printf("discord flush: sent=%d queued=%d\n", sent, queued)
+            if queued > 0 {
+                os.Exit(1)
+            }
+        case "preview":
+            asJSON, sample := false, false
+            for _, a := range args[2:] {
+                switch a {
+                case "--json":
+                    asJSON = true
+                case "--sample":
+                    sample = true
+                default:
+                    fatal(errors.New("usage: gacha discord preview [--json] [--sample]"))
+                }
+            }
+            if err := previewDiscordSummary(base, os.Stdout, asJSON, sample); err != nil {
+                fmt.Fprintln(os.Stderr, "discordTemplates:", err)
+                os.Exit(1)
+            }
+        case "register-commands":
+            scope, err := registerDiscordCommands()
+            if err != nil {
+                fatal(err)
+            }
+            fmt.Println("discord register-commands: /gacha registered (" + scope + ")")
+        case "resync":
+            repost, asJSON := false, false
+            for _, a := range args[2:] {
+                switch a {
+                case "--repost":
+                    repost = true
+                case "--json":
+                    asJSON = true
+                default:
+                    fatal(errors.New("usage: gacha discord resync [--repost] [--json]"))
+                }
+            }
+            rep, err := resyncDiscord(base, repost)
+            if err != nil {
+                fatal(err)
+            }
+            if asJSON {
+                b, _ := json.MarshalIndent(rep, "", "  ")
+                fmt.Println(string(b))
+            } else {
+                printResyncReport(os.Stdout, rep)
+            }
+            if rep.Errors > 0 {
+                os.Exit(1)
+            }
+        case "user":
+            op := ""
+            if len(args) >= 3 { op = strings.ToLower(args[2]) }
+            switch {
+            case op == "set" && len(args) == 5:
+                id, err := doSetDiscordUser(base, args[3], args[4])
+                if err != nil {
+                    fatal(err)
+                }
+                fmt.Printf("discord user: %s -> %s\n", strings.TrimSpace(args[3]), id)
+            case op == "remove" && len(args) == 4:
+                if err := doRemoveDiscordUser(base, args[3]); err != nil {
+                    fatal(err)
+                }
+                fmt.Println("discord user: removed")
+            case op == "list" && len(args) == 3:
+                d, err := loadDiscordDirectory(base)
+                if err != nil {
+                    fatal(err)
+                }
+                for _, name := range d.sortedNames() {
+                    fmt.Printf("%s\t%s\n", name, d[name])
+                }
+            default:
+                fatal(errors.New("usage: gacha discord user set <name> <discordId> | remove <name> | list"))
+            }
+        default:
+            fatal(errors.New("usage: gacha discord flush|preview|register-commands|resync|user"))
+        }
+        return
     default:
         // Update mode: expect 2 args: <winnerName> <hitFlag>
         if len(args) == 2 {
             winner := strings.TrimSpace(args[0])
             hitFlagStr := strings.TrimSpace(args[1])
             if err := handleUpdate(base, winner, hitFlagStr); err != nil {
+                if errors.Is(err, errDuplicateSuppressed) {
+                    fmt.Println("update: suppressed (duplicate)")
+                    return
+                }
                 fatal(err)
             }
             fmt.Println("update: completed")
@@ -222,16 +634,34 @@ func main() {
 }
 
 func usage() {
-    fmt.Println(`gacha ` + version + `
+    fmt.Print(`gacha ` + version + `
 
 Usage:
-  gacha <winnerName> <hitFlag>   # hitFlag: 0=当たり, 1=大当たり
-  gacha reset                    # バックアップ作成→初期化
+  gacha <winnerName> <hitFlag>   # hitFlag: 0=当たり, 1=大当たり（setting.json の tiers で追加可）
+  gacha reset [--label <text>] [--note <text>]  # バックアップ作成→初期化（ラベル/メモをバックアップに記録）
   gacha gen-datajs               # data/data.js を再生成
-  gacha backup                   # 現在値のバックアップのみ
+  gacha backup [--label <text>] [--note <text>]  # 現在値のバックアップのみ
+  gacha backups [--json]         # バックアップ一覧（セッション・人数・合計・ラベル/メモ）
+  gacha diff <from> [<to>] [--json]  # 2つのスナップショット（バックアップ名 / current）の差分を表示（<to> 既定: current）
+  gacha backup-meta <backupName> [--label <text>] [--note <text>]  # バックアップのラベル/メモを表示・変更
   gacha restore <backupName>     # backups の JSON/JS を現在値へ復元
   gacha gen-backup-index         # backups/index.js を再生成
+  gacha prune-backups [--dry-run] [--json]  # setting.json の backupRetention でバックアップを整理（古いものは削除/gzip圧縮）
   gacha serve [port]             # ローカルAPIサーバーを起動
+  gacha undo [count]             # 直近の当選を取り消し（既定: 1件）
+  gacha adjust <name> --hit -1 --jackpot +1  # 当たり/大当たり回数を手動補正
+  gacha recompute                # setting.json の rewards を既存データに再適用
+  gacha rebuild                  # data/journal.jsonl から current.json を再構築
+  gacha replay [--until <time>]  # 指定時刻時点の状態をJSONで表示（ファイルは変更しない）
+  gacha migrate [--dry-run] [--json]  # データファイルを現在の schemaVersion へ移行（--dry-run は変更内容の表示のみ）
+  gacha deliverable add <name> <file>  # 完成作品（PNG/GIF）を登録（完了時にDiscordへ添付投稿）
+  gacha deliverable remove <name> | list
+  gacha discord flush            # 送信待ちのDiscord更新（data/discord_outbox.json）を今すぐ再送
+  gacha discord preview [--json] [--sample]  # discordTemplates で集計メッセージを試し描画（送信しない）
+  gacha discord register-commands  # Discordのスラッシュコマンド /gacha を登録
+  gacha discord resync [--repost] [--json]  # discord_map.json を実際のメッセージと照合して整理（--repost で集計を再投稿）
+  gacha discord user set <name> <discordId> | remove <name> | list  # メンション用の名前→DiscordユーザーID対応表
+  gacha fake-discord [port]      # テスト用の疑似Discord APIサーバーを起動（既定: 3011）
 
 Notes:
   - 名前に空白/日本語がある場合は二重引用符で囲んでください。
@@ -242,13 +672,126 @@ func handleUpdate(base, winner, hitFlagStr string) error {
     if err := validateWinner(winner); err != nil {
         return err
     }
-    flag, err := parseHitFlag(hitFlagStr)
+    cfg := loadSettings(base)
+    tiers := loadTiers(base, cfg)
+    flag, err := parseHitFlag(hitFlagStr, tiers)
+    if err != nil {
+        return err
+    }
+
+    // single-writer mode: hand the event to the running API server
+    eventID := ""
+    if cfg.SingleWriter {
+        eventID = newEventID()
+        handled, err := forwardUpdate(cfg.ServerPort, winner, flag, eventID)
+        if handled {
+            return err
+        }
+        if err != nil {
+            // the server may have applied it before failing; dedupe by eventID
+            _ = appendAppLog(base, "warn: forward to api server failed, writing directly: "+err.Error())
+        } else {
+            eventID = "" // server not running: nothing to dedupe against
+        }
+    }
+    return applyUpdate(base, winner, flag, eventID, func(ev ChangeEvent, st State) { notifyChange(base, ev, st) })
+}
+
+// applyUpdate records one win under the data lock. notify is called with the
+// change and the new state after the lock is released (CLI: synchronous
+// notifyChange, serve: queue for the background notifier). A non-empty eventID already in the journal is
+// treated as applied (a forwarded event whose response was lost).
+func applyUpdate(base, winner string, flag int, eventID string, notify func(ChangeEvent, State)) error {
+    cfg := loadSettings(base)
+    tiers := loadTiers(base, cfg)
+
+    // serialize read-modify-write with other gacha processes / API server
+    lk, err := acquireLock(base)
     if err != nil {
+        _ = appendAppLog(base, fmt.Sprintf("error: update winner=%q flag=%d: %s", winner, flag, err.Error()))
         return err
     }
+    ev, st, err := recordWin(base, cfg, tiers, winner, flag, eventID)
+    lk.release()
+    if ev.Type == "" { return err }
+    recovered := err
+
+    // notifiers (Discord summary, outgoing webhooks) must not delay other writers
+    if notify != nil {
+        notify(ev, st)
+    }
+
+    // write per-event JSON log if enabled
+    if cfg.EventJSONLog {
+        if err := writeEvent(base, Event{
+            At:        time.Now().UTC().Format(time.RFC3339),
+            Winner:    winner,
+            HitFlag:   flag,
+            Operation: "update",
+        }); err != nil {
+            // non-fatal
+            _ = appendAppLog(base, "warn: writeEvent failed: "+err.Error())
+        }
+    }
+
+    if recovered != nil {
+        _ = appendAppLog(base, fmt.Sprintf("update: winner=%q flag=%d (after recovery)", winner, flag))
+        return fmt.Errorf("%w; the win was applied on top of the recovered state", recovered)
+    }
+    return appendAppLog(base, fmt.Sprintf("update: winner=%q flag=%d", winner, flag))
+}
+
+// recordWin applies one win to current.json and the journal. The event is zero
+// when nothing was applied (eventID already journaled, duplicate, error); an
+// errStateRecovered error with an event means the win was applied after a
+// recovery. Callers hold the data lock.
+func recordWin(base string, cfg Settings, tiers []PrizeTier, winner string, flag int, eventID string) (ChangeEvent, State, error) {
+    if eventID != "" && journalHasEvent(base, eventID) {
+        _ = appendAppLog(base, fmt.Sprintf("info: update already applied by api server: winner=%q event=%s", winner, eventID))
+        return ChangeEvent{}, State{}, nil
+    }
+
+    // suppress identical calls within the debounce window (debounceEnabled)
+    if cfg.DebounceEnabled && checkDebounce(base, winner, flag, debounceWindow(cfg)) {
+        _ = appendAppLog(base, fmt.Sprintf("info: update suppressed (duplicate within %dms): winner=%q flag=%d", debounceWindow(cfg).Milliseconds(), winner, flag))
+        return ChangeEvent{}, State{}, errDuplicateSuppressed
+    }
+
+    // after a recovery the win is still applied, but the caller is told so the
+    // corruption does not go unnoticed
+    st, recovered := loadStateRecovering(base)
+    if err := recovered; err != nil && !errors.Is(err, errStateRecovered) {
+        _ = appendAppLog(base, fmt.Sprintf("error: update winner=%q flag=%d: %s", winner, flag, err.Error()))
+        return ChangeEvent{}, State{}, err
+    }
+    now := time.Now().UTC().Format(time.RFC3339)
+    counter := tierCounter(tiers, flag)
+    applyWin(&st, winner, counter, now, loadRewardRules(base, cfg))
+
+    hf := flag
+    if err := appendJournal(base, JournalEntry{At: now, Type: journalWin, Name: winner, HitFlag: &hf, Counter: counter, EventID: eventID}); err != nil {
+        _ = appendAppLog(base, "warn: journal append failed: "+err.Error())
+    }
+
+    if err := saveState(base, st); err != nil {
+        return ChangeEvent{}, State{}, err
+    }
 
-    st, _ := loadState(base)
-    // update
+    if cfg.DebounceEnabled {
+        if err := recordDebounce(base, winner, flag, debounceWindow(cfg)); err != nil {
+            _ = appendAppLog(base, "warn: debounce record failed: "+err.Error())
+        }
+    }
+
+    if err := genDataJS(base); err != nil {
+        return ChangeEvent{}, State{}, err
+    }
+    return newChangeEvent(ChangeEvent{Type: journalWin, At: now, EventID: eventID, Name: winner, HitFlag: &hf, Counter: counter}, st), st, recovered
+}
+
+// applyWin adds one win on counter (see tiers) to winner and recomputes
+// flags/present. Shared by the live update path and journal replay.
+func applyWin(st *State, winner, counter string, at string, rules []rewardRule) {
     idx := -1
     for i, u := range st.Users {
         if u.Name == winner {
@@ -261,11 +804,9 @@ func handleUpdate(base, winner, hitFlagStr string) error {
         idx = len(st.Users) - 1
     }
 
-    if flag == 0 {
-        st.Users[idx].Hit++
-    } else {
-        st.Users[idx].Jackpot++
-    }
+    normalizeUserCounts(&st.Users[idx])
+    st.Users[idx].Counts[counter]++
+    normalizeUserCounts(&st.Users[idx])
     // assign order on first win
     if st.Users[idx].Order == 0 {
         max := 0
@@ -274,74 +815,153 @@ func handleUpdate(base, winner, hitFlagStr string) error {
         }
         st.Users[idx].Order = max + 1
     }
-    // recompute flags per rule
-    st.Users[idx].Flags.Illust = st.Users[idx].Hit >= 1 // 当たり>=1
-    st.Users[idx].Flags.Gif = st.Users[idx].Hit >= 3 || st.Users[idx].Jackpot >= 1
+    recomputeUser(&st.Users[idx], rules)
+    st.UpdatedAt = at
+}
+
+// recomputeUser derives Rewards, Present and Flags from the counters via the
+// reward rules. Present is the qualifying reward with the highest priority.
+func recomputeUser(u *User, rules []rewardRule) {
+    u.Rewards = evaluateRewards(*u, rules)
+    u.Present = ""
+    if len(u.Rewards) > 0 {
+        u.Present = u.Rewards[0]
+    }
+    // legacy flags kept for data.js / backups compatibility
+    u.Flags.Illust = hasReward(u.Rewards, "Illustration")
+    u.Flags.Gif = hasReward(u.Rewards, "Gif")
+}
 
-    // set Present from flags (優先: Gif > イラスト)
-    if st.Users[idx].Flags.Gif {
-        st.Users[idx].Present = "Gif"
-    } else if st.Users[idx].Flags.Illust {
-        st.Users[idx].Present = "Illustration"
+// applyAdjust changes the counters of name by the given deltas (clamped at 0).
+// A user whose counters all reach 0 is removed; a missing user is created only
+// for positive deltas.
+func applyAdjust(st *State, name string, deltas map[string]int, at string, rules []rewardRule) bool {
+    idx := -1
+    for i, u := range st.Users {
+        if u.Name == name {
+            idx = i
+            break
+        }
+    }
+    if idx == -1 {
+        positive := false
+        for _, d := range deltas {
+            if d > 0 { positive = true }
+        }
+        if !positive { return false }
+        st.Users = append(st.Users, User{Name: name})
+        idx = len(st.Users) - 1
+    }
+    u := &st.Users[idx]
+    normalizeUserCounts(u)
+    for counter, d := range deltas {
+        u.Counts[counter] += d
+    }
+    normalizeUserCounts(u) // drops counters that went <= 0
+    if totalCount(*u) == 0 {
+        st.Users = append(st.Users[:idx], st.Users[idx+1:]...)
     } else {
-        st.Users[idx].Present = ""
+        if u.Order == 0 {
+            max := 0
+            for _, o := range st.Users {
+                if o.Order > max { max = o.Order }
+            }
+            u.Order = max + 1
+        }
+        recomputeUser(u, rules)
     }
+    st.UpdatedAt = at
+    return true
+}
 
-    st.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-
-    if err := saveState(base, st); err != nil {
-        return err
+// applyStatus sets status (none/progress/done) and keeps Done in sync.
+func applyStatus(st *State, name, status, at string) bool {
+    for i := range st.Users {
+        if st.Users[i].Name == name {
+            st.Users[i].Status = status
+            st.Users[i].Done = (status == "done")
+            st.UpdatedAt = at
+            return true
+        }
     }
+    return false
+}
 
-    if err := genDataJS(base); err != nil {
-        return err
+// applyRef sets the reference image flag.
+func applyRef(st *State, name string, hasRef bool, at string) bool {
+    for i := range st.Users {
+        if st.Users[i].Name == name {
+            st.Users[i].HasReference = hasRef
+            st.UpdatedAt = at
+            return true
+        }
     }
+    return false
+}
 
-    // Discord notify (optional)
-    cfg := loadSettings(base)
-    enabled := cfg.DiscordEnabled || isTruthy(os.Getenv("DISCORD_NOTIFY"))
-    if enabled {
-        // ensure session exists (used for per-session summary mapping)
-        sess, _ := ensureSession(base)
-        embed := buildLatestSummaryEmbed(st, cfg)
-        payload := DiscordMessage{Embeds: []DiscordEmbed{embed}}
-        token := strings.TrimSpace(os.Getenv("DISCORD_BOT_TOKEN"))
-        channelID := strings.TrimSpace(os.Getenv("DISCORD_CHANNEL_ID"))
-        summaryKey := "__SUMMARY__"
-        if cfg.DiscordNewMessagePerSession && sess.ID != "" {
-            summaryKey = summaryKey + "::" + sess.ID
-        }
-        if token != "" && channelID != "" {
-            if err := discordBotUpsertEmbed(base, token, channelID, summaryKey, payload); err != nil {
-                _ = appendAppLog(base, "warn: discord bot notify failed: "+err.Error())
-            } else {
-                _ = appendAppLog(base, "info: discord bot upsert ok (summary)")
-            }
-        } else if url := strings.TrimSpace(os.Getenv("DISCORD_WEBHOOK_URL")); url != "" {
-            if err := discordUpsertEmbed(base, url, summaryKey, payload); err != nil {
-                _ = appendAppLog(base, "warn: discord webhook notify failed: "+err.Error())
-            } else {
-                _ = appendAppLog(base, "info: discord webhook upsert ok (summary)")
-            }
-        } else {
-            _ = appendAppLog(base, "info: discord enabled but no credentials; skipping")
+var errBadStatus = errors.New("bad status")
+
+// doSetStatus records a status change under the data lock and notifies it
+// after the lock is released (/api/user/status, /api/user/done and the Discord
+// /gacha status command), then uploads the deliverable of a user that became
+// done.
+func doSetStatus(base, name, status string) (State, error) {
+    status = strings.ToLower(strings.TrimSpace(status))
+    if status != "none" && status != "progress" && status != "done" { return State{}, errBadStatus }
+    var st State
+    var now string
+    err := withLock(base, func() error {
+        var err error
+        st, err = loadStateForWrite(base)
+        if err != nil { return err }
+        now = time.Now().UTC().Format(time.RFC3339)
+        if !applyStatus(&st, name, status, now) { return fmt.Errorf("%w: %s", errUserNotFound, name) }
+        if err := appendJournal(base, JournalEntry{At: now, Type: journalStatus, Name: name, Status: status}); err != nil {
+            _ = appendAppLog(base, "warn: journal append failed: "+err.Error())
         }
-    }
+        if err := saveState(base, st); err != nil { return err }
+        return genDataJS(base)
+    })
+    if err != nil { return State{}, err }
+    notifyChange(base, ChangeEvent{Type: journalStatus, At: now, Name: name, Status: status}, st)
+    if status == "done" { postPendingDeliverables(base) }
+    return st, nil
+}
 
-    // write per-event JSON log if enabled
-    if loadSettings(base).EventJSONLog {
-        if err := writeEvent(base, Event{
-            At:        time.Now().UTC().Format(time.RFC3339),
-            Winner:    winner,
-            HitFlag:   flag,
-            Operation: "update",
-        }); err != nil {
-            // non-fatal
-            _ = appendAppLog(base, "warn: writeEvent failed: "+err.Error())
+// doSetRef records a reference image flag change like doSetStatus.
+func doSetRef(base, name string, hasRef bool) (State, error) {
+    var st State
+    var now string
+    err := withLock(base, func() error {
+        var err error
+        st, err = loadStateForWrite(base)
+        if err != nil { return err }
+        now = time.Now().UTC().Format(time.RFC3339)
+        if !applyRef(&st, name, hasRef, now) { return fmt.Errorf("%w: %s", errUserNotFound, name) }
+        if err := appendJournal(base, JournalEntry{At: now, Type: journalRef, Name: name, HasReference: &hasRef}); err != nil {
+            _ = appendAppLog(base, "warn: journal append failed: "+err.Error())
         }
-    }
+        if err := saveState(base, st); err != nil { return err }
+        return genDataJS(base)
+    })
+    if err != nil { return State{}, err }
+    notifyChange(base, ChangeEvent{Type: journalRef, At: now, Name: name, HasReference: &hasRef}, st)
+    return st, nil
+}
 
-    return appendAppLog(base, fmt.Sprintf("update: winner=%q flag=%d", winner, flag))
+// userErrorCode maps doSetStatus / doSetRef errors to HTTP status codes.
+func userErrorCode(err error) int {
+    switch {
+    case errors.Is(err, errBadStatus), errors.Is(err, errBadDiscordID):
+        return 400
+    case errors.Is(err, errUserNotFound):
+        return 404
+    case errors.Is(err, errLockTimeout):
+        return 503
+    case errors.Is(err, errStateRecovered):
+        return 409
+    }
+    return 500
 }
 
 func validateWinner(name string) error {
@@ -360,13 +980,13 @@ func validateWinner(name string) error {
     return nil
 }
 
-func parseHitFlag(s string) (int, error) {
+func parseHitFlag(s string, tiers []PrizeTier) (int, error) {
     n, err := strconv.Atoi(s)
     if err != nil {
-        return 0, errors.New("hitFlag must be 0 or 1")
+        return 0, errors.New("hitFlag must be one of " + tierIDsText(tiers))
     }
-    if n != 0 && n != 1 {
-        return 0, errors.New("hitFlag must be 0 or 1")
+    if _, ok := findTier(tiers, n); !ok {
+        return 0, errors.New("hitFlag must be one of " + tierIDsText(tiers))
     }
     return n, nil
 }
@@ -406,17 +1026,25 @@ func loadState(base string) (State, error) {
     b, err := os.ReadFile(p)
     if err != nil {
         if os.IsNotExist(err) {
-            return State{Users: []User{}, UpdatedAt: time.Now().UTC().Format(time.RFC3339)}, nil
+            // a write interrupted between removing and renaming leaves only the temp file
+            if _, terr := os.Stat(stateTempPath(base)); terr == nil {
+                return st, fmt.Errorf("%w: missing, but a temp file of an interrupted write exists", errStateCorrupted)
+            }
+            return State{SchemaVersion: stateSchema.latest(), Users: []User{}, UpdatedAt: time.Now().UTC().Format(time.RFC3339)}, nil
         }
         return st, err
     }
-    if err := json.Unmarshal(b, &st); err != nil {
-        return st, err
+    st, err = decodeState(b)
+    if err != nil {
+        if errors.Is(err, errSchemaTooNew) { return st, fmt.Errorf("current.json: %w", err) }
+        return st, fmt.Errorf("%w: %v", errStateCorrupted, err)
     }
     return st, nil
 }
 
 func saveState(base string, st State) error {
+    st.SchemaVersion = stateSchema.latest()
+    normalizeStateCounts(&st)
     b, err := json.MarshalIndent(st, "", "  ")
     if err != nil {
         return err
@@ -429,14 +1057,11 @@ func genDataJS(base string) error {
     if err != nil {
         return err
     }
+    rules := loadRewardRules(base, loadSettings(base))
     // ensure Present fields are populated for all users (migration safety)
     for i := range st.Users {
         if strings.TrimSpace(st.Users[i].Present) == "" {
-            if st.Users[i].Flags.Gif {
-                st.Users[i].Present = "Gif"
-            } else if st.Users[i].Flags.Illust {
-                st.Users[i].Present = "Illustration"
-            }
+            recomputeUser(&st.Users[i], rules)
         }
     }
     // Build ASCII-only export structure for data.js
@@ -444,27 +1069,37 @@ func genDataJS(base string) error {
         Name         string `json:"name"`
         Hit          int    `json:"hit"`
         Jackpot      int    `json:"jackpot"`
+        Counts       map[string]int `json:"counts"`
         Flags        Flags  `json:"flags"`
         Done         bool   `json:"done"`
         Order        int    `json:"order"`
         Status       string `json:"status"`
         Present      string `json:"present"`
         HasReference bool   `json:"hasReference"`
+        Rewards      []string `json:"rewards"`
+    }
+    type rewardOut struct {
+        Name     string `json:"name"`
+        Label    string `json:"label"`
+        Priority int    `json:"priority"`
     }
     type out struct {
-        Users     []userOut `json:"users"`
-        UpdatedAt string    `json:"updatedAt"`
+        Users     []userOut   `json:"users"`
+        UpdatedAt string      `json:"updatedAt"`
+        Rewards   []rewardOut `json:"rewards"`
+        Tiers     []PrizeTier `json:"tiers"`
+    }
+    o := out{Users: make([]userOut, 0, len(st.Users)), UpdatedAt: st.UpdatedAt, Rewards: make([]rewardOut, 0, len(rules)), Tiers: loadTiers(base, loadSettings(base))}
+    for _, r := range rules {
+        o.Rewards = append(o.Rewards, rewardOut{Name: r.Name, Label: r.Label, Priority: r.Priority})
     }
-    o := out{Users: make([]userOut, 0, len(st.Users)), UpdatedAt: st.UpdatedAt}
     for _, u := range st.Users {
-        po := u.Present
-        if po == "" {
-            if u.Flags.Gif { po = "Gif" } else if u.Flags.Illust { po = "Illustration" }
-        }
+        rw := u.Rewards
+        if rw == nil { rw = []string{} }
         o.Users = append(o.Users, userOut{
-            Name: u.Name, Hit: u.Hit, Jackpot: u.Jackpot, Flags: u.Flags,
-            Done: u.Done, Order: u.Order, Status: u.Status, Present: po,
-            HasReference: u.HasReference,
+            Name: u.Name, Hit: u.Hit, Jackpot: u.Jackpot, Counts: u.Counts, Flags: u.Flags,
+            Done: u.Done, Order: u.Order, Status: u.Status, Present: u.Present,
+            HasReference: u.HasReference, Rewards: rw,
         })
     }
     payload, err := json.Marshal(o)
@@ -477,30 +1112,31 @@ func genDataJS(base string) error {
 
 func genBackupIndex(base string) error {
     dir := backupDir(base)
-    entries, err := os.ReadDir(dir)
-    if err != nil {
+    if _, err := os.Stat(dir); err != nil {
         if os.IsNotExist(err) {
             return nil
         }
         return err
     }
-    type item struct{ Name, JS string }
-    var files []string
-    for _, e := range entries {
-        if e.IsDir() { continue }
-        name := e.Name()
-        if strings.HasSuffix(strings.ToLower(name), ".json") {
-            files = append(files, name)
-        }
+    type item struct {
+        Name, JS string
+        Compressed bool `json:",omitempty"` // no .js wrapper; the view loads it via /api/backup
+        Meta BackupMeta
     }
-    sort.Slice(files, func(i, j int) bool { return files[i] > files[j] })
+    infos, err := listBackupInfo(base)
+    if err != nil { return err }
     var items []item
-    for _, f := range files {
+    for _, bi := range infos {
+        f := bi.Name
+        if bi.Compressed {
+            items = append(items, item{ Name: f, Compressed: true, Meta: bi.Meta })
+            continue
+        }
         baseName := strings.TrimSuffix(f, filepath.Ext(f))
         jsName := baseName + ".js"
         // ensure wrapper js exists (best-effort)
         _ = ensureBackupJS(base, filepath.Join(dir, f))
-        items = append(items, item{ Name: f, JS: jsName })
+        items = append(items, item{ Name: f, JS: jsName, Meta: bi.Meta })
     }
     b, err := json.Marshal(items)
     if err != nil { return err }
@@ -522,24 +1158,25 @@ func ensureBackupJS(base, jsonPath string) error {
 }
 
 func doRestore(base, name string) error {
-    // Accept JS or JSON file name (with or without extension)
-    fname := name
-    // If JS, map to JSON
-    low := strings.ToLower(fname)
-    if strings.HasSuffix(low, ".js") {
-        fname = strings.TrimSuffix(fname, filepath.Ext(fname)) + ".json"
-    } else if !strings.HasSuffix(low, ".json") {
-        // try with .json
-        fname = fname + ".json"
-    }
-    p := filepath.Join(backupDir(base), filepath.Base(fname))
-    b, err := os.ReadFile(p)
+    // Accept JS, JSON or JSON.GZ file name (with or without extension)
+    p, err := findBackup(base, name)
     if err != nil { return err }
-    var st State
-    if err := json.Unmarshal(b, &st); err != nil { return err }
-    // Overwrite current.json
-    if err := saveState(base, st); err != nil { return err }
-    if err := genDataJS(base); err != nil { return err }
+    b, err := readBackupFile(p)
+    if err != nil { return err }
+    // old backups are migrated to the current schema; newer ones are refused
+    st, err := decodeState(b)
+    if err != nil { return fmt.Errorf("%s: %w", filepath.Base(p), err) }
+    err = withLock(base, func() error {
+        snap := st
+        if err := appendJournal(base, JournalEntry{At: time.Now().UTC().Format(time.RFC3339), Type: journalRestore, Backup: filepath.Base(p), State: &snap}); err != nil {
+            _ = appendAppLog(base, "warn: journal append failed: "+err.Error())
+        }
+        // Overwrite current.json
+        if err := saveState(base, st); err != nil { return err }
+        return genDataJS(base)
+    })
+    if err != nil { return err }
+    notifyChange(base, ChangeEvent{Type: journalRestore, Backup: filepath.Base(p)}, st)
     return appendAppLog(base, "restore: "+filepath.Base(p))
 }
 
@@ -554,14 +1191,15 @@ func writeEvent(base string, ev Event) error {
     return writeFileAtomic(p, b)
 }
 
-func doBackup(base string) (string, error) {
+func doBackup(base, label, note string) (string, error) {
     st, err := loadState(base)
     if err != nil {
         return "", err
     }
     ts := time.Now().Format("2006-01-02_150405")
     p := filepath.Join(backupDir(base), fmt.Sprintf("%s.json", ts))
-    b, err := json.MarshalIndent(st, "", "  ")
+    meta := newBackupMeta(base, st, label, note)
+    b, err := json.MarshalIndent(backupFile{State: st, Meta: &meta}, "", "  ")
     if err != nil {
         return "", err
     }
@@ -572,6 +1210,11 @@ func doBackup(base string) (string, error) {
     if err := ensureBackupJS(base, p); err != nil {
         _ = appendAppLog(base, "warn: ensureBackupJS failed: "+err.Error())
     }
+    if pol := loadSettings(base).BackupRetention; pol.enabled() {
+        if _, err := pruneBackups(base, pol, false); err != nil {
+            _ = appendAppLog(base, "warn: prune backups failed: "+err.Error())
+        }
+    }
     if err := genBackupIndex(base); err != nil {
         _ = appendAppLog(base, "warn: genBackupIndex failed: "+err.Error())
     }
@@ -581,20 +1224,34 @@ func doBackup(base string) (string, error) {
     return p, nil
 }
 
-func doReset(base string) error {
-    if _, err := doBackup(base); err != nil {
-        return err
-    }
-    st := State{Users: []User{}, UpdatedAt: time.Now().UTC().Format(time.RFC3339)}
-    if err := saveState(base, st); err != nil {
-        return err
-    }
-    if err := genDataJS(base); err != nil {
+func doReset(base, label, note string) error {
+    var bp string
+    st := State{Users: []User{}}
+    err := withLock(base, func() error {
+        var err error
+        bp, err = doBackup(base, label, note)
+        if err != nil {
+            return err
+        }
+        st.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+        if err := appendJournal(base, JournalEntry{At: st.UpdatedAt, Type: journalReset, Backup: filepath.Base(bp)}); err != nil {
+            _ = appendAppLog(base, "warn: journal append failed: "+err.Error())
+        }
+        if err := saveState(base, st); err != nil {
+            return err
+        }
+        if err := genDataJS(base); err != nil {
+            return err
+        }
+        if _, err := newSession(base); err != nil {
+            _ = appendAppLog(base, "warn: newSession failed: "+err.Error())
+        }
+        return nil
+    })
+    if err != nil {
         return err
     }
-    if _, err := newSession(base); err != nil {
-        _ = appendAppLog(base, "warn: newSession failed: "+err.Error())
-    }
+    notifyChange(base, ChangeEvent{Type: journalReset, At: st.UpdatedAt, Backup: filepath.Base(bp)}, st)
     return appendAppLog(base, "reset: completed")
 }
 
@@ -662,8 +1319,8 @@ func serve(base string, port int) error {
         reqH := r.Header.Get("Access-Control-Request-Headers")
         if strings.TrimSpace(reqH) == "" { reqH = "Content-Type" }
         w.Header().Set("Access-Control-Allow-Headers", reqH)
-        // 許可メソッドを固定で提示（POST/GET/PATCH/OPTIONS）
-        w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PATCH,OPTIONS")
+        // 許可メソッドを固定で提示（POST/GET/PATCH/DELETE/OPTIONS）
+        w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PATCH,DELETE,OPTIONS")
         w.Header().Set("Access-Control-Max-Age", "600")
     }
     writeJSON := func(w http.ResponseWriter, r *http.Request, v interface{}, code int) {
@@ -672,6 +1329,61 @@ func serve(base string, port int) error {
         w.WriteHeader(code)
         _ = json.NewEncoder(w).Encode(v)
     }
+    // Notifications for /api/event run in the background; events queued while a
+    // delivery is in progress are handled as one batch (one summary refresh).
+    notifyCh := make(chan ChangeEvent, 256)
+    go func() {
+        for ev := range notifyCh {
+            batch := []ChangeEvent{ev}
+            for more := true; more; {
+                select {
+                case e := <-notifyCh:
+                    batch = append(batch, e)
+                default:
+                    more = false
+                }
+            }
+            // snapshot the state under the data lock; deliver without it
+            var st State
+            if err := withLock(base, func() error {
+                var err error
+                st, err = loadState(base)
+                return err
+            }); err != nil {
+                _ = appendAppLog(base, "warn: async notify failed: "+err.Error())
+                continue
+            }
+            notifyChanges(base, batch, st)
+            // retry deliverable uploads that failed earlier
+            postPendingDeliverables(base)
+        }
+    }()
+    // retry summary updates that failed (also those queued before a restart)
+    go runOutboxWorker(base)
+    queueNotify := func(ev ChangeEvent, _ State) {
+        select {
+        case notifyCh <- ev:
+        default:
+            _ = appendAppLog(base, fmt.Sprintf("warn: notify queue full, dropped %s event for %q", ev.Type, ev.Name))
+        }
+    }
+    mux.HandleFunc("/api/event", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == http.MethodOptions { setCORS(w, r); w.WriteHeader(204); return }
+        if r.Method != http.MethodPost { writeJSON(w, r, map[string]any{"ok": false, "error": "method"}, 405); return }
+        var req struct{ Winner string `json:"winner"`; HitFlag string `json:"hitFlag"`; EventID string `json:"eventId"` }
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": "bad json"}, 400); return }
+        winner := strings.TrimSpace(req.Winner)
+        if err := validateWinner(winner); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 400); return }
+        flag, err := parseHitFlag(strings.TrimSpace(req.HitFlag), loadTiers(base, loadSettings(base)))
+        if err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 400); return }
+        if err := applyUpdate(base, winner, flag, req.EventID, queueNotify); err != nil {
+            if errors.Is(err, errDuplicateSuppressed) { writeJSON(w, r, map[string]any{"ok": true, "suppressed": true}, 200); return }
+            code := 500
+            if errors.Is(err, errLockTimeout) { code = 503 } else if errors.Is(err, errStateRecovered) { code = 409 }
+            writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, code); return
+        }
+        writeJSON(w, r, map[string]any{"ok": true}, 200)
+    })
     mux.HandleFunc("/api/restore", func(w http.ResponseWriter, r *http.Request) {
         if r.Method == http.MethodOptions { setCORS(w, r); w.WriteHeader(204); return }
         name := r.URL.Query().Get("name")
@@ -698,17 +1410,25 @@ func serve(base string, port int) error {
         eDone := strings.TrimSpace(cfg.DiscordEmojiDone); if eDone == "" { eDone = "✅" }
         refYes := strings.TrimSpace(cfg.DiscordRefLabelYes); if refYes == "" { refYes = "参考画像あり" }
         refNo := strings.TrimSpace(cfg.DiscordRefLabelNo); if refNo == "" { refNo = "参考画像なし" }
+        rules, _ := rulesFromSettings(cfg)
+        rewards := make([]map[string]any, 0, len(rules))
+        for _, rr := range rules {
+            rewards = append(rewards, map[string]any{"name": rr.Name, "label": rr.Label, "priority": rr.Priority})
+        }
         writeJSON(w, r, map[string]any{
             "emojiNone": eNone,
             "emojiProgress": eProg,
             "emojiDone": eDone,
             "refLabelYes": refYes,
             "refLabelNo": refNo,
+            "rewards": rewards,
+            "tiers": loadTiers(base, cfg),
         }, 200)
     })
     mux.HandleFunc("/api/reset", func(w http.ResponseWriter, r *http.Request) {
         if r.Method == http.MethodOptions { setCORS(w, r); w.WriteHeader(204); return }
-        if err := doReset(base); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 500); return }
+        q := r.URL.Query()
+        if err := doReset(base, q.Get("label"), q.Get("note")); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 500); return }
         writeJSON(w, r, map[string]any{"ok": true}, 200)
     })
     mux.HandleFunc("/api/user/done", func(w http.ResponseWriter, r *http.Request) {
@@ -717,37 +1437,9 @@ func serve(base string, port int) error {
         var req struct{ Name string `json:"name"`; Done bool `json:"done"` }
         if err := json.NewDecoder(r.Body).Decode(&req); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": "bad json"}, 400); return }
         if strings.TrimSpace(req.Name) == "" { writeJSON(w, r, map[string]any{"ok": false, "error": "missing name"}, 400); return }
-        st, err := loadState(base)
-        if err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 500); return }
-        found := false
-        for i := range st.Users {
-            if st.Users[i].Name == req.Name {
-                st.Users[i].Done = req.Done
-                if req.Done { st.Users[i].Status = "done" } else { st.Users[i].Status = "none" }
-                found = true
-                break
-            }
-        }
-        if !found { writeJSON(w, r, map[string]any{"ok": false, "error": "not found"}, 404); return }
-        st.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-        if err := saveState(base, st); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 500); return }
-        if err := genDataJS(base); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 500); return }
-        // update discord summary as well
-        cfg := loadSettings(base)
-        if cfg.DiscordEnabled || isTruthy(os.Getenv("DISCORD_NOTIFY")) {
-            // no session change, just replace summary
-            embed := buildLatestSummaryEmbed(st, cfg)
-            payload := DiscordMessage{Embeds: []DiscordEmbed{embed}}
-            // build key
-            sess, _ := ensureSession(base)
-            key := "__SUMMARY__"
-            if cfg.DiscordNewMessagePerSession && sess.ID != "" { key = key+"::"+sess.ID }
-            if t := strings.TrimSpace(os.Getenv("DISCORD_BOT_TOKEN")); t != "" && strings.TrimSpace(os.Getenv("DISCORD_CHANNEL_ID")) != "" {
-                _ = discordBotUpsertEmbed(base, t, os.Getenv("DISCORD_CHANNEL_ID"), key, payload)
-            } else if u := strings.TrimSpace(os.Getenv("DISCORD_WEBHOOK_URL")); u != "" {
-                _ = discordUpsertEmbed(base, u, key, payload)
-            }
-        }
+        status := "none"
+        if req.Done { status = "done" }
+        if _, err := doSetStatus(base, req.Name, status); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, userErrorCode(err)); return }
         writeJSON(w, r, map[string]any{"ok": true}, 200)
     })
     // toggle reference image flag
@@ -756,34 +1448,7 @@ func serve(base string, port int) error {
         if r.Method != http.MethodPost { writeJSON(w, r, map[string]any{"ok": false, "error": "method"}, 405); return }
         var req struct{ Name string `json:"name"`; HasReference bool `json:"hasReference"` }
         if err := json.NewDecoder(r.Body).Decode(&req); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": "bad json"}, 400); return }
-        st, err := loadState(base)
-        if err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 500); return }
-        found := false
-        for i := range st.Users {
-            if st.Users[i].Name == req.Name {
-                st.Users[i].HasReference = req.HasReference
-                found = true
-                break
-            }
-        }
-        if !found { writeJSON(w, r, map[string]any{"ok": false, "error": "not found"}, 404); return }
-        st.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-        if err := saveState(base, st); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 500); return }
-        if err := genDataJS(base); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 500); return }
-        // refresh discord summary
-        cfg := loadSettings(base)
-        if cfg.DiscordEnabled || isTruthy(os.Getenv("DISCORD_NOTIFY")) {
-            embed := buildLatestSummaryEmbed(st, cfg)
-            payload := DiscordMessage{Embeds: []DiscordEmbed{embed}}
-            sess, _ := ensureSession(base)
-            key := "__SUMMARY__"
-            if cfg.DiscordNewMessagePerSession && sess.ID != "" { key = key+"::"+sess.ID }
-            if t := strings.TrimSpace(os.Getenv("DISCORD_BOT_TOKEN")); t != "" && strings.TrimSpace(os.Getenv("DISCORD_CHANNEL_ID")) != "" {
-                _ = discordBotUpsertEmbed(base, t, os.Getenv("DISCORD_CHANNEL_ID"), key, payload)
-            } else if u := strings.TrimSpace(os.Getenv("DISCORD_WEBHOOK_URL")); u != "" {
-                _ = discordUpsertEmbed(base, u, key, payload)
-            }
-        }
+        if _, err := doSetRef(base, req.Name, req.HasReference); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, userErrorCode(err)); return }
         writeJSON(w, r, map[string]any{"ok": true}, 200)
     })
     mux.HandleFunc("/api/gen-backup-index", func(w http.ResponseWriter, r *http.Request) {
@@ -791,60 +1456,198 @@ func serve(base string, port int) error {
         if err := genBackupIndex(base); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 500); return }
         writeJSON(w, r, map[string]any{"ok": true}, 200)
     })
+    // backup names; with ?meta=1 also compression and label/note/totals
     mux.HandleFunc("/api/backups", func(w http.ResponseWriter, r *http.Request) {
         if r.Method == http.MethodOptions { setCORS(w, r); w.WriteHeader(204); return }
-        dir := backupDir(base)
-        entries, err := os.ReadDir(dir)
+        if isTruthy(r.URL.Query().Get("meta")) {
+            infos, err := listBackupInfo(base)
+            if err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 500); return }
+            writeJSON(w, r, infos, 200)
+            return
+        }
+        files, err := listBackups(base)
+        if err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 500); return }
+        if files == nil { files = []string{} }
+        writeJSON(w, r, files, 200)
+    })
+    // edit the label/note of a backup: {"name":"2025-09-13_213000.json","label":"...","note":"..."} (omitted fields stay)
+    mux.HandleFunc("/api/backups/meta", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == http.MethodOptions { setCORS(w, r); w.WriteHeader(204); return }
+        if r.Method != http.MethodPost { writeJSON(w, r, map[string]any{"ok": false, "error": "method"}, 405); return }
+        var req struct{ Name string `json:"name"`; Label *string `json:"label"`; Note *string `json:"note"` }
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" { writeJSON(w, r, map[string]any{"ok": false, "error": "bad json"}, 400); return }
+        meta, err := setBackupMeta(base, req.Name, req.Label, req.Note)
         if err != nil {
-            if os.IsNotExist(err) { writeJSON(w, r, []string{}, 200); return }
-            writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 500); return
+            code := 500
+            if errors.Is(err, os.ErrNotExist) { code = 404 }
+            writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, code); return
         }
-        var files []string
-        for _, e := range entries {
-            if e.IsDir() { continue }
-            name := e.Name()
-            if strings.HasSuffix(strings.ToLower(name), ".json") { files = append(files, name) }
+        writeJSON(w, r, map[string]any{"ok": true, "meta": meta}, 200)
+    })
+    // differences between two snapshots: ?from=<backup|current>&to=<backup|current> (to defaults to current)
+    mux.HandleFunc("/api/diff", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == http.MethodOptions { setCORS(w, r); w.WriteHeader(204); return }
+        q := r.URL.Query()
+        if q.Get("from") == "" { writeJSON(w, r, map[string]any{"ok": false, "error": "missing from"}, 400); return }
+        d, err := diffSnapshots(base, q.Get("from"), q.Get("to"))
+        if err != nil {
+            code := 500
+            if errors.Is(err, os.ErrNotExist) { code = 404 }
+            writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, code); return
         }
-        sort.Slice(files, func(i, j int) bool { return files[i] > files[j] })
-        writeJSON(w, r, files, 200)
+        writeJSON(w, r, d, 200)
+    })
+    // contents of one backup (plain or compressed), for the history view
+    mux.HandleFunc("/api/backup", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == http.MethodOptions { setCORS(w, r); w.WriteHeader(204); return }
+        p, err := findBackup(base, r.URL.Query().Get("name"))
+        if err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 404); return }
+        b, err := readBackupFile(p)
+        if err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 500); return }
+        st, err := decodeState(b)
+        if err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 500); return }
+        writeJSON(w, r, st, 200)
     })
     mux.HandleFunc("/api/user/status", func(w http.ResponseWriter, r *http.Request) {
         if r.Method == http.MethodOptions { setCORS(w, r); w.WriteHeader(204); return }
         if r.Method != http.MethodPost { writeJSON(w, r, map[string]any{"ok": false, "error": "method"}, 405); return }
         var req struct{ Name string `json:"name"`; Status string `json:"status"` }
         if err := json.NewDecoder(r.Body).Decode(&req); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": "bad json"}, 400); return }
-        status := strings.ToLower(strings.TrimSpace(req.Status))
-        if status != "none" && status != "progress" && status != "done" { writeJSON(w, r, map[string]any{"ok": false, "error": "bad status"}, 400); return }
-        st, err := loadState(base)
-        if err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 500); return }
-        found := false
-        for i := range st.Users {
-            if st.Users[i].Name == req.Name {
-                st.Users[i].Status = status
-                st.Users[i].Done = (status == "done")
-                found = true
-                break
+        if _, err := doSetStatus(base, req.Name, req.Status); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, userErrorCode(err)); return }
+        writeJSON(w, r, map[string]any{"ok": true}, 200)
+    })
+    // deliverable file of a user: GET lists (or ?name=), POST multipart name+file, DELETE ?name=
+    mux.HandleFunc("/api/user/deliverable", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == http.MethodOptions { setCORS(w, r); w.WriteHeader(204); return }
+        switch r.Method {
+        case http.MethodGet:
+            idx, err := loadDeliverables(base)
+            if err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 500); return }
+            if name := r.URL.Query().Get("name"); name != "" {
+                d, ok := idx[name]
+                if !ok { writeJSON(w, r, map[string]any{"ok": false, "error": "not found"}, 404); return }
+                writeJSON(w, r, map[string]any{"ok": true, "deliverable": d}, 200); return
             }
-        }
-        if !found { writeJSON(w, r, map[string]any{"ok": false, "error": "not found"}, 404); return }
-        st.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-        if err := saveState(base, st); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 500); return }
-        if err := genDataJS(base); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 500); return }
-        cfg := loadSettings(base)
-        if cfg.DiscordEnabled || isTruthy(os.Getenv("DISCORD_NOTIFY")) {
-            embed := buildLatestSummaryEmbed(st, cfg)
-            payload := DiscordMessage{Embeds: []DiscordEmbed{embed}}
-            sess, _ := ensureSession(base)
-            key := "__SUMMARY__"
-            if cfg.DiscordNewMessagePerSession && sess.ID != "" { key = key+"::"+sess.ID }
-            if t := strings.TrimSpace(os.Getenv("DISCORD_BOT_TOKEN")); t != "" && strings.TrimSpace(os.Getenv("DISCORD_CHANNEL_ID")) != "" {
-                _ = discordBotUpsertEmbed(base, t, os.Getenv("DISCORD_CHANNEL_ID"), key, payload)
-            } else if u := strings.TrimSpace(os.Getenv("DISCORD_WEBHOOK_URL")); u != "" {
-                _ = discordUpsertEmbed(base, u, key, payload)
+            writeJSON(w, r, map[string]any{"ok": true, "deliverables": sortedDeliverables(idx)}, 200)
+        case http.MethodPost:
+            if err := r.ParseMultipartForm(deliverableMaxBytes + 1<<20); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": "expected multipart form (name, file)"}, 400); return }
+            f, fh, err := r.FormFile("file")
+            if err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": "missing file"}, 400); return }
+            defer f.Close()
+            data, err := io.ReadAll(io.LimitReader(f, deliverableMaxBytes+1))
+            if err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 400); return }
+            d, err := doRegisterDeliverable(base, r.FormValue("name"), fh.Filename, data)
+            if err != nil {
+                code := 400
+                if errors.Is(err, errUserNotFound) { code = 404 } else if errors.Is(err, errLockTimeout) { code = 503 }
+                writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, code); return
             }
+            writeJSON(w, r, map[string]any{"ok": true, "deliverable": d}, 200)
+        case http.MethodDelete:
+            if err := doRemoveDeliverable(base, r.URL.Query().Get("name")); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, userErrorCode(err)); return }
+            writeJSON(w, r, map[string]any{"ok": true}, 200)
+        default:
+            writeJSON(w, r, map[string]any{"ok": false, "error": "method"}, 405)
+        }
+    })
+    mux.HandleFunc("/api/user/adjust", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == http.MethodOptions { setCORS(w, r); w.WriteHeader(204); return }
+        if r.Method != http.MethodPost { writeJSON(w, r, map[string]any{"ok": false, "error": "method"}, 405); return }
+        var req struct{ Name string `json:"name"`; Hit int `json:"hit"`; Jackpot int `json:"jackpot"`; Counts map[string]int `json:"counts"` }
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": "bad json"}, 400); return }
+        if strings.TrimSpace(req.Name) == "" { writeJSON(w, r, map[string]any{"ok": false, "error": "missing name"}, 400); return }
+        deltas := map[string]int{}
+        for k, v := range req.Counts { deltas[k] += v }
+        if req.Hit != 0 { deltas["hit"] += req.Hit }
+        if req.Jackpot != 0 { deltas["jackpot"] += req.Jackpot }
+        if _, err := doAdjust(base, req.Name, deltas); err != nil {
+            code := 500
+            if errors.Is(err, errUserNotFound) { code = 404 } else if errors.Is(err, errLockTimeout) { code = 503 } else if errors.Is(err, errUnknownCounter) { code = 400 }
+            writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, code); return
         }
         writeJSON(w, r, map[string]any{"ok": true}, 200)
     })
+    mux.HandleFunc("/api/undo", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == http.MethodOptions { setCORS(w, r); w.WriteHeader(204); return }
+        if r.Method != http.MethodPost { writeJSON(w, r, map[string]any{"ok": false, "error": "method"}, 405); return }
+        var req struct{ Count int `json:"count"` }
+        if r.ContentLength != 0 {
+            if err := json.NewDecoder(r.Body).Decode(&req); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": "bad json"}, 400); return }
+        }
+        undone, err := doUndo(base, req.Count)
+        if err != nil {
+            code := 500
+            if errors.Is(err, errNothingToUndo) || errors.Is(err, errUserNotFound) { code = 409 } else if errors.Is(err, errLockTimeout) { code = 503 }
+            writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, code); return
+        }
+        writeJSON(w, r, map[string]any{"ok": true, "undone": undone}, 200)
+    })
+    // pending Discord updates; POST sends them immediately
+    mux.HandleFunc("/api/discord/queue", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == http.MethodOptions { setCORS(w, r); w.WriteHeader(204); return }
+        switch r.Method {
+        case http.MethodGet:
+            items, err := loadOutbox(base)
+            if err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 500); return }
+            writeJSON(w, r, map[string]any{"ok": true, "items": items}, 200)
+        case http.MethodPost:
+            var sent, queued int
+            err := withNotifyLock(base, func() error {
+                var ferr error
+                sent, queued, ferr = flushOutbox(base, true)
+                return ferr
+            })
+            if err != nil {
+                code := 500
+                if errors.Is(err, errNotifyLockTimeout) || errors.Is(err, errLockTimeout) { code = 503 }
+                writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, code); return
+            }
+            writeJSON(w, r, map[string]any{"ok": true, "sent": sent, "queued": queued}, 200)
+        default:
+            writeJSON(w, r, map[string]any{"ok": false, "error": "method"}, 405)
+        }
+    })
+
+    // verify/clean discord_map.json; POST ?repost=1 also reposts the current summary
+    mux.HandleFunc("/api/discord/resync", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == http.MethodOptions { setCORS(w, r); w.WriteHeader(204); return }
+        if r.Method != http.MethodPost { writeJSON(w, r, map[string]any{"ok": false, "error": "method"}, 405); return }
+        rep, err := resyncDiscord(base, isTruthy(r.URL.Query().Get("repost")))
+        if err != nil {
+            code := 500
+            if errors.Is(err, errNotifyLockTimeout) || errors.Is(err, errLockTimeout) { code = 503 } else if errors.Is(err, errNoDiscordCredentials) { code = 400 }
+            writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, code); return
+        }
+        writeJSON(w, r, map[string]any{"ok": rep.Errors == 0, "report": rep}, 200)
+    })
+
+    // name -> Discord user ID directory: GET lists, POST {name,id} sets, DELETE ?name=
+    mux.HandleFunc("/api/discord/users", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == http.MethodOptions { setCORS(w, r); w.WriteHeader(204); return }
+        switch r.Method {
+        case http.MethodGet:
+            d, err := loadDiscordDirectory(base)
+            if err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, 500); return }
+            writeJSON(w, r, map[string]any{"ok": true, "users": d}, 200)
+        case http.MethodPost:
+            var req struct{ Name string `json:"name"`; ID string `json:"id"` }
+            if err := json.NewDecoder(r.Body).Decode(&req); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": "bad json"}, 400); return }
+            if strings.TrimSpace(req.Name) == "" { writeJSON(w, r, map[string]any{"ok": false, "error": "missing name"}, 400); return }
+            id, err := doSetDiscordUser(base, req.Name, req.ID)
+            if err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, userErrorCode(err)); return }
+            writeJSON(w, r, map[string]any{"ok": true, "name": strings.TrimSpace(req.Name), "id": id}, 200)
+        case http.MethodDelete:
+            if err := doRemoveDiscordUser(base, r.URL.Query().Get("name")); err != nil { writeJSON(w, r, map[string]any{"ok": false, "error": err.Error()}, userErrorCode(err)); return }
+            writeJSON(w, r, map[string]any{"ok": true}, 200)
+        default:
+            writeJSON(w, r, map[string]any{"ok": false, "error": "method"}, 405)
+        }
+    })
+
+    // Discord slash commands (signature-verified, see interactions.go)
+    mux.HandleFunc("/api/discord/interactions", func(w http.ResponseWriter, r *http.Request) {
+        handleDiscordInteraction(base, w, r)
+    })
 
     addr := fmt.Sprintf("127.0.0.1:%d", port)
     fmt.Println("serve: listening on http://" + addr)
@@ -878,69 +1681,198 @@ func ensureAPISpawned(base string, port int) {
 
 // ---------- Discord integration (Webhook) ----------
 
-func buildLatestSummaryEmbed(st State, cfg Settings) DiscordEmbed {
-    // Build fields for [Gif] and [Ilst]
-    var gifs, ilsts []string
+// summaryLine is one user in the summary, before platform-specific escaping.
+type summaryLine struct {
+    Emoji string // status emoji
+    Ref   string // reference tag, e.g. [参考画像あり]
+    Name  string
+    User  User
+}
+
+type summaryGroup struct {
+    Reward rewardRule
+    Header string
+    Lines  []summaryLine
+}
+
+// buildSummaryGroups groups users by reward (priority order), e.g. [Gif] then
+// [Ilst]. Shared by the Discord and Slack summaries.
+func buildSummaryGroups(st State, cfg Settings) []summaryGroup {
+    rules, _ := rulesFromSettings(cfg)
+    // status emoji from settings (fallback to defaults)
+    eNone := cfg.DiscordEmojiNone
+    if strings.TrimSpace(eNone) == "" { eNone = "⏳" }
+    eProg := cfg.DiscordEmojiProgress
+    if strings.TrimSpace(eProg) == "" { eProg = "🎨" }
+    eDone := cfg.DiscordEmojiDone
+    if strings.TrimSpace(eDone) == "" { eDone = "✅" }
+    // reference note (先に表示) ※行フォーマット: 絵文字 + [参考画像○] + ユーザー名
+    yes := strings.TrimSpace(cfg.DiscordRefLabelYes)
+    no := strings.TrimSpace(cfg.DiscordRefLabelNo)
+    if yes == "" { yes = "参考画像あり" }
+    if no == "" { no = "参考画像なし" }
+    byReward := map[string][]summaryLine{}
     for _, u := range st.Users {
         present := strings.TrimSpace(u.Present)
         if present == "" {
-            if u.Flags.Gif { present = "Gif" } else if u.Flags.Illust { present = "Illustration" }
-        }
-        // status emoji from settings (fallback to defaults)
-        eNone := cfg.DiscordEmojiNone
-        if strings.TrimSpace(eNone) == "" { eNone = "⏳" }
-        eProg := cfg.DiscordEmojiProgress
-        if strings.TrimSpace(eProg) == "" { eProg = "🎨" }
-        eDone := cfg.DiscordEmojiDone
-        if strings.TrimSpace(eDone) == "" { eDone = "✅" }
-        // reference note (先に表示) ※行フォーマット: 絵文字 + [参考画像○] + ユーザー名
-        yes := strings.TrimSpace(cfg.DiscordRefLabelYes)
-        no := strings.TrimSpace(cfg.DiscordRefLabelNo)
-        if yes == "" { yes = "参考画像あり" }
-        if no == "" { no = "参考画像なし" }
+            if rw := evaluateRewards(u, rules); len(rw) > 0 { present = rw[0] }
+        }
+        if _, ok := findRewardRule(rules, present); !ok { continue }
         refTag := "[" + no + "]"
         if u.HasReference { refTag = "[" + yes + "]" }
-        // Escape user-visible fragments to avoid Discord markdown effects
-        safeRef := escapeDiscordMarkdown(refTag)
-        safeName := escapeDiscordMarkdown(u.Name)
-
-        if present == "Gif" {
-            prefix := eNone + " "
-            if u.Status == "progress" { prefix = eProg + " " }
-            if u.Done || u.Status == "done" { prefix = eDone + " " }
-            line := prefix + safeRef + " " + safeName
-            gifs = append(gifs, line)
-        } else if present == "Illustration" {
-            prefix := eNone + " "
-            if u.Status == "progress" { prefix = eProg + " " }
-            if u.Done || u.Status == "done" { prefix = eDone + " " }
-            line := prefix + safeRef + " " + safeName
-            ilsts = append(ilsts, line)
-        }
-    }
-    sort.Strings(gifs)
-    sort.Strings(ilsts)
-    gh := cfg.DiscordHeaderGif
-    if strings.TrimSpace(gh) == "" { gh = "---大当たり（Gif）---" }
-    ih := cfg.DiscordHeaderIllustration
-    if strings.TrimSpace(ih) == "" { ih = "---当たり（イラスト）---" }
-    fieldGif := EmbedField{Name: escapeDiscordMarkdown(gh), Value: "なし", Inline: false}
-    fieldIlst := EmbedField{Name: escapeDiscordMarkdown(ih), Value: "なし", Inline: false}
-    if len(gifs) > 0 { fieldGif.Value = strings.Join(gifs, "\n") }
-    if len(ilsts) > 0 { fieldIlst.Value = strings.Join(ilsts, "\n") }
-    // Tailwind emerald-500
-    green := 0x10B981
+        emoji := eNone
+        if u.Status == "progress" { emoji = eProg }
+        if u.Done || u.Status == "done" { emoji = eDone }
+        byReward[present] = append(byReward[present], summaryLine{Emoji: emoji, Ref: refTag, Name: u.Name, User: u})
+    }
+    groups := make([]summaryGroup, 0, len(rules))
+    for _, r := range rules {
+        groups = append(groups, summaryGroup{Reward: r, Header: rewardHeader(r, cfg), Lines: byReward[r.Name]})
+    }
+    return groups
+}
+
+func summaryTitle(cfg Settings) string {
     title := cfg.DiscordTitle
     if strings.TrimSpace(title) == "" { title = "集計（最新）" }
-    title = escapeDiscordMarkdown(title)
+    return title
+}
+
+// buildSummaryEmbeds builds the summary as one embed per message page (a
+// single page unless Discord's size limits require more, see paginateSummary).
+// Title, lines, headers, placeholder, footer and color come from the
+// discordTemplates setting (templates.go).
+func buildSummaryEmbeds(st State, cfg Settings, mentions discordDirectory) []DiscordEmbed {
+    tpl, _ := compileDiscordTemplates(cfg.DiscordTemplates)
+    groups := buildSummaryGroups(st, cfg)
+    fields := make([]EmbedField, 0, len(groups))
+    for _, g := range groups {
+        lines := make([]string, 0, len(g.Lines))
+        for _, l := range g.Lines {
+            // the default line template escapes user-visible fragments
+            if line := tpl.line.render(lineData{User: l.User, Emoji: l.Emoji, Ref: l.Ref, Reward: g.Reward.RewardRule, Mention: mentions.mention(l.User.Name)}); line != "" {
+                lines = append(lines, line)
+            }
+        }
+        sort.Strings(lines)
+        gd := groupData{Header: g.Header, Reward: g.Reward.RewardRule, Count: len(lines)}
+        f := EmbedField{Name: tpl.groupHeader.render(gd), Value: tpl.empty.render(gd), Inline: false}
+        if len(lines) > 0 { f.Value = strings.Join(lines, "\n") }
+        if f.Name == "" { f.Name = "\u200b" }
+        if f.Value == "" { f.Value = "\u200b" }
+        fields = append(fields, f)
+    }
+    data := summaryData{Title: summaryTitle(cfg), UpdatedAt: st.UpdatedAt, UserCount: len(st.Users), Totals: map[string]int{}}
+    for _, u := range st.Users {
+        for k, v := range u.Counts { data.Totals[k] += v }
+    }
+    color, err := parseColor(tpl.color.render(data))
+    if err != nil { color = 0x10B981 }
     ts := st.UpdatedAt
-    return DiscordEmbed{
-        Title: title,
-        Color: green,
-        Fields: []EmbedField{fieldGif, fieldIlst},
+    return paginateSummary(DiscordEmbed{
+        Title: tpl.title.render(data),
+        Color: color,
         Timestamp: ts,
-        Footer: &EmbedFooter{Text: escapeDiscordMarkdown("最終更新")},
+        Footer: &EmbedFooter{Text: tpl.footer.render(data)},
+    }, fields)
+}
+
+// rewardHeader returns the Discord field header for a reward. The legacy
+// discordHeaderGif / discordHeaderIllustration keys still apply to the built-in names.
+func rewardHeader(r rewardRule, cfg Settings) string {
+    if h := strings.TrimSpace(r.DiscordHeader); h != "" { return h }
+    switch r.Name {
+    case "Gif":
+        if h := strings.TrimSpace(cfg.DiscordHeaderGif); h != "" { return h }
+        return "---大当たり（Gif）---"
+    case "Illustration":
+        if h := strings.TrimSpace(cfg.DiscordHeaderIllustration); h != "" { return h }
+        return "---当たり（イラスト）---"
+    }
+    return "---" + r.Label + "---"
+}
+
+// refreshDiscordSummary upserts the per-session summary message (bot preferred,
+// webhook fallback). Failures are queued in the outbox for retry and never
+// returned to the caller.
+func refreshDiscordSummary(base string, st State) {
+    cfg := loadSettings(base)
+    if !cfg.DiscordEnabled && !isTruthy(os.Getenv("DISCORD_NOTIFY")) {
+        return
+    }
+    // ensure session exists (used for per-session summary mapping)
+    sess, _ := ensureSession(base)
+    embeds := buildSummaryEmbeds(st, cfg, summaryMentions(base, cfg))
+    summaryKey := summaryKeyFor(cfg, sess)
+    if !discordConfigured() {
+        _ = appendAppLog(base, "info: discord enabled but no credentials; skipping")
+        return
+    }
+    for i, e := range embeds {
+        deliverDiscordSummary(base, summaryPageKey(summaryKey, i+1), DiscordMessage{Embeds: []DiscordEmbed{e}})
+    }
+    cleanupSummaryPages(base, summaryKey, len(embeds))
+    ensureSessionThread(base, summaryKey)
+}
+
+// deliverDiscordSummary upserts one summary message, queueing it in the outbox
+// when it cannot be sent now. A queued retry for the message is replaced by
+// payload; once its backoff has elapsed the update is sent right away (so CLI
+// updates get through without `gacha serve`).
+func deliverDiscordSummary(base, key string, payload DiscordMessage) {
+    it, pending := outboxPending(base, key)
+    // a retry is scheduled for later: just replace its payload
+    if pending && !outboxDue(it, time.Now()) {
+        if err := queueDiscordSummary(base, key, payload, nil); err != nil {
+            _ = appendAppLog(base, "warn: discord outbox write failed: "+err.Error())
+            return
+        }
+        _ = appendAppLog(base, "info: discord summary queued (retry pending)")
+        return
+    }
+    mode, err := sendDiscordSummary(base, key, payload)
+    if err != nil {
+        _ = appendAppLog(base, "warn: discord "+mode+" notify failed, queued for retry: "+err.Error())
+        if qerr := queueDiscordSummary(base, key, payload, err); qerr != nil {
+            _ = appendAppLog(base, "warn: discord outbox write failed: "+qerr.Error())
+        }
+        return
+    }
+    if pending {
+        if err := dropOutboxItems(base, func(k string) bool { return k == key }); err != nil {
+            _ = appendAppLog(base, "warn: discord outbox write failed: "+err.Error())
+        }
+        _ = appendAppLog(base, fmt.Sprintf("info: discord %s upsert ok (summary, replaced outbox item after %d attempts)", mode, it.Attempts))
+        return
     }
+    _ = appendAppLog(base, "info: discord "+mode+" upsert ok (summary)")
+}
+
+// summaryKeyFor returns the discord_map key of the summary of session s.
+func summaryKeyFor(cfg Settings, s Session) string {
+    if cfg.DiscordNewMessagePerSession && s.ID != "" { return "__SUMMARY__::" + s.ID }
+    return "__SUMMARY__"
+}
+
+func discordConfigured() bool {
+    token := strings.TrimSpace(os.Getenv("DISCORD_BOT_TOKEN"))
+    channelID := strings.TrimSpace(os.Getenv("DISCORD_CHANNEL_ID"))
+    return (token != "" && channelID != "") || strings.TrimSpace(os.Getenv("DISCORD_WEBHOOK_URL")) != ""
+}
+
+// sendDiscordSummary upserts the message tracked under key and reports which
+// transport was used ("bot" or "webhook").
+func sendDiscordSummary(base, key string, payload DiscordMessage) (string, error) {
+    token := strings.TrimSpace(os.Getenv("DISCORD_BOT_TOKEN"))
+    channelID := strings.TrimSpace(os.Getenv("DISCORD_CHANNEL_ID"))
+    mode, err := "", error(errNoDiscordCredentials)
+    if token != "" && channelID != "" {
+        mode, err = "bot", discordBotUpsertEmbed(base, token, channelID, key, payload)
+    } else if url := strings.TrimSpace(os.Getenv("DISCORD_WEBHOOK_URL")); url != "" {
+        mode, err = "webhook", discordUpsertEmbed(base, url, key, payload)
+    }
+    if err == nil { setArchivedMark(base, key, len(payload.Embeds) > 0 && payload.Embeds[0].Color == archivedColor) }
+    return mode, err
 }
 
 // legacy (unused): kept for reference
@@ -991,19 +1923,57 @@ func loadDiscordMap(base string) (DiscordMap, error) {
         }
         return nil, err
     }
-    var m DiscordMap
-    if err := json.Unmarshal(b, &m); err != nil {
+    var doc map[string]any
+    if err := json.Unmarshal(b, &doc); err != nil {
         return nil, err
     }
+    if doc == nil { doc = map[string]any{} }
+    if _, err := discordMapSchema.migrate(doc); err != nil {
+        return nil, fmt.Errorf("discord_map.json: %w", err)
+    }
+    m := DiscordMap{}
+    for k, v := range doc {
+        if s, ok := v.(string); ok { m[k] = s }
+    }
     return m, nil
 }
 
 func saveDiscordMap(base string, m DiscordMap) error {
-    b, err := json.MarshalIndent(m, "", "  ")
+    doc := make(map[string]any, len(m)+1)
+    for k, v := range m {
+        doc[k] = v
+    }
+    doc["schemaVersion"] = discordMapSchema.latest()
+    b, err := json.MarshalIndent(doc, "", "  ")
     if err != nil { return err }
     return writeFileAtomic(discordMapPath(base), b)
 }
 
+// updateDiscordMap applies fn to discord_map.json under a brief data lock.
+// Notifiers run without the data lock, so they record their entries through
+// this instead of saving a map they loaded before a slow request.
+func updateDiscordMap(base string, fn func(m DiscordMap)) error {
+    return withLock(base, func() error {
+        m, err := loadDiscordMap(base)
+        if err != nil { return err }
+        fn(m)
+        return saveDiscordMap(base, m)
+    })
+}
+
+// mergeDiscordMap writes the entries that differ between before and after
+// (added, changed or deleted) through updateDiscordMap.
+func mergeDiscordMap(base string, before, after DiscordMap) error {
+    return updateDiscordMap(base, func(m DiscordMap) {
+        for k := range before {
+            if _, ok := after[k]; !ok { delete(m, k) }
+        }
+        for k, v := range after {
+            if old, ok := before[k]; !ok || old != v { m[k] = v }
+        }
+    })
+}
+
 func ensureDiscordMapExists(base string) error {
     p := discordMapPath(base)
     if _, err := os.Stat(p); os.IsNotExist(err) {
@@ -1013,89 +1983,138 @@ func ensureDiscordMapExists(base string) error {
     return nil
 }
 
+// ensureSession returns the current session, starting one when there is none.
+// Callers must not hold the data lock.
 func ensureSession(base string) (Session, error) {
-    p := sessionPath(base)
-    b, err := os.ReadFile(p)
-    if err == nil {
-        var s Session
-        if json.Unmarshal(b, &s) == nil && s.ID != "" {
-            return s, nil
-        }
-    }
-    return newSession(base)
+    if s, ok := loadSession(base); ok { return s, nil }
+    var s Session
+    err := withLock(base, func() error {
+        var ok bool
+        if s, ok = loadSession(base); ok { return nil }
+        var err error
+        s, err = newSession(base)
+        return err
+    })
+    return s, err
 }
 
+// newSession starts a new session. The Discord side (archiving the summaries
+// and thread of the previous session) is left to the next notification
+// (archivePreviousSession), so no request is made under the data lock.
+// Callers hold the data lock.
 func newSession(base string) (Session, error) {
     // reload env to ensure webhook/Bot creds are visible to API server
     loadDotenv(base)
-    s := Session{ID: time.Now().Format("20060102_150405"), StartedAt: time.Now().UTC().Format(time.RFC3339)}
-    b, err := json.MarshalIndent(s, "", "  ")
-    if err != nil { return Session{}, err }
-    if err := writeFileAtomic(sessionPath(base), b); err != nil { return Session{}, err }
-    // Archive old summaries if enabled
+    prev, _ := loadSession(base)
+    s := Session{ID: time.Now().Format("20060102_150405"), StartedAt: time.Now().UTC().Format(time.RFC3339), ArchivePending: true, PrevThreadID: prev.ThreadID}
+    // a previous session whose archive is still pending keeps its thread to close
+    if s.PrevThreadID == "" { s.PrevThreadID = prev.PrevThreadID }
+    if err := saveSession(base, s); err != nil { return Session{}, err }
+    // works of the new session are posted again even if already posted before
+    if err := dropDeliverableMarkers(base, s.ID); err != nil {
+        _ = appendAppLog(base, "warn: drop deliverable markers failed: "+err.Error())
+    }
+    return s, nil
+}
+
+// archivePreviousSession archives the queued and posted summaries of earlier
+// sessions (if enabled) and closes the previous session's thread, once per
+// new session. Callers hold the notify lock.
+func archivePreviousSession(base string) {
+    s, ok := loadSession(base)
+    if !ok || !s.ArchivePending { return }
+    if cfg := loadSettings(base); cfg.DiscordEnabled && cfg.DiscordArchiveOldSummary {
+        if err := archiveQueuedSummaries(base, s.ID, buildArchiveHeader(cfg)); err != nil {
+            _ = appendAppLog(base, "warn: archive queued summaries failed: "+err.Error())
+        }
+    }
     if err := archiveOldSummaryMessages(base, s.ID); err != nil {
         _ = appendAppLog(base, "warn: archive old summaries failed: "+err.Error())
     }
-    return s, nil
+    // close the previous session's thread after its summary was archived
+    archiveSessionThread(base, s.PrevThreadID)
+    err := withLock(base, func() error {
+        cur, ok := loadSession(base)
+        if !ok || cur.ID != s.ID { return nil }
+        cur.ArchivePending, cur.PrevThreadID = false, ""
+        return saveSession(base, cur)
+    })
+    if err != nil {
+        _ = appendAppLog(base, "warn: save session.json failed: "+err.Error())
+    }
 }
 
+// archiveOldSummaryMessages retitles the summaries of earlier sessions.
+// Archived messages are marked in discord_map.json and not edited again.
 func archiveOldSummaryMessages(base, newSessionID string) error {
     cfg := loadSettings(base)
     if !cfg.DiscordEnabled || !cfg.DiscordArchiveOldSummary { return nil }
-    // detect creds
-    token := strings.TrimSpace(os.Getenv("DISCORD_BOT_TOKEN"))
-    channelID := strings.TrimSpace(os.Getenv("DISCORD_CHANNEL_ID"))
-    webhookURL := strings.TrimSpace(os.Getenv("DISCORD_WEBHOOK_URL"))
-    if token == "" && webhookURL == "" { return nil }
+    if !discordConfigured() { return nil }
     m, _ := loadDiscordMap(base)
     header := buildArchiveHeader(cfg)
     newKey := "__SUMMARY__"+"::"+newSessionID
+    var done []string
     for key, mid := range m {
         if !strings.HasPrefix(key, "__SUMMARY__") { continue }
-        if key == newKey { continue }
-        if mid == "" { continue }
-        var content string
-        var embeds []DiscordEmbed
-        var err error
-        if token != "" && channelID != "" {
-            content, embeds, err = discordBotGetMessage(token, channelID, mid)
-            if err == nil {
-                // if there is an embed, just retitle/color it; otherwise prepend header to content as fallback
-                if len(embeds) > 0 {
-                    e := embeds[0]
-                    e.Title = header
-                    e.Color = 0x9CA3AF // gray
-                    payload := DiscordMessage{Embeds: []DiscordEmbed{e}}
-                    _ = discordBotEditEmbed(token, channelID, mid, payload)
-                } else if !hasArchiveHeader(content, cfg) {
-                    nc := header+"\n"+content
-                    if len(nc) > 1900 { nc = nc[:1900] }
-                    payload := DiscordMessage{Embeds: []DiscordEmbed{{Title: header, Description: content, Color: 0x9CA3AF}}}
-                    _ = discordBotEditEmbed(token, channelID, mid, payload)
-                }
-                continue
-            }
-        }
-        if webhookURL != "" {
-            info, perr := parseWebhook(webhookURL)
-            if perr == nil {
-                content, embeds, err = discordWebhookGetMessage(info, mid)
-                if err == nil {
-                    if len(embeds) > 0 {
-                        e := embeds[0]
-                        e.Title = header
-                        e.Color = 0x9CA3AF
-                        payload := DiscordMessage{Embeds: []DiscordEmbed{e}}
-                        _ = discordWebhookEditEmbed(info, mid, payload)
-                    } else if !hasArchiveHeader(content, cfg) {
-                        payload := DiscordMessage{Embeds: []DiscordEmbed{{Title: header, Description: content, Color: 0x9CA3AF}}}
-                        _ = discordWebhookEditEmbed(info, mid, payload)
-                    }
-                }
+        if summaryKeyOf(key, newKey) { continue }
+        if mid == "" || m[archivedKey(key)] != "" { continue }
+        if err := archiveSummaryMessage(base, key, mid, header, cfg); err != nil {
+            if isDiscordNotFound(err) {
+                _ = appendAppLog(base, "warn: discord summary to archive is gone (run `gacha discord resync`): key="+key)
+            } else {
+                _ = appendAppLog(base, "warn: discord archive failed: key="+key+": "+err.Error())
             }
+            continue
         }
+        done = append(done, key)
     }
-    return nil
+    if len(done) == 0 { return nil }
+    now := time.Now().UTC().Format(time.RFC3339)
+    return updateDiscordMap(base, func(m DiscordMap) {
+        for _, key := range done {
+            m[archivedKey(key)] = now
+        }
+    })
+}
+
+// archiveSummaryMessage retitles one summary message with the archive header
+// (bot preferred; messages the bot cannot read are tried through the webhook).
+func archiveSummaryMessage(base, key, mid, header string, cfg Settings) error {
+    token := strings.TrimSpace(os.Getenv("DISCORD_BOT_TOKEN"))
+    channelID := strings.TrimSpace(os.Getenv("DISCORD_CHANNEL_ID"))
+    webhookURL := strings.TrimSpace(os.Getenv("DISCORD_WEBHOOK_URL"))
+    // if there is an embed, just retitle/color it; otherwise wrap the content in one
+    archived := func(content string, embeds []DiscordEmbed) (DiscordMessage, bool) {
+        if len(embeds) > 0 {
+            e := embeds[0]
+            e.Title = header
+            e.Color = archivedColor
+            return DiscordMessage{Embeds: []DiscordEmbed{e}}, true
+        }
+        if hasArchiveHeader(content, cfg) { return DiscordMessage{}, false }
+        return DiscordMessage{Embeds: []DiscordEmbed{{Title: header, Description: content, Color: archivedColor}}}, true
+    }
+    err := errNoDiscordCredentials
+    if token != "" && channelID != "" {
+        content, embeds, gerr := discordBotGetMessage(token, channelID, mid)
+        if gerr == nil {
+            payload, ok := archived(content, embeds)
+            if !ok { return nil }
+            return discordBotEditEmbed(token, channelID, mid, payload)
+        }
+        err = gerr
+    }
+    if webhookURL != "" {
+        info, perr := parseWebhook(webhookURL)
+        if perr != nil { return perr }
+        info.Thread = summaryThread(base, key)
+        content, embeds, gerr := discordWebhookGetMessage(info, mid)
+        if gerr != nil { return gerr }
+        payload, ok := archived(content, embeds)
+        if !ok { return nil }
+        return discordWebhookEditEmbed(info, mid, payload)
+    }
+    return err
 }
 
 func buildArchiveHeader(cfg Settings) string {
@@ -1121,6 +2140,7 @@ func hasArchiveHeader(content string, cfg Settings) bool {
 
 func defaultSettings() Settings {
     return Settings{
+        SchemaVersion: settingsSchema.latest(),
         EventJSONLog: false,
         AutoServe: true,
         ServerPort: 3010,
@@ -1136,6 +2156,21 @@ func defaultSettings() Settings {
         DiscordHeaderIllustration: "---当たり（イラスト）---",
         DiscordRefLabelYes: "参考画像あり",
         DiscordRefLabelNo:  "参考画像なし",
+        DebounceEnabled: false,
+        DebounceWindowMs: 2000,
+        Rewards: defaultRewardRules(),
+        Tiers: defaultTiers(),
+        SingleWriter: true,
+        SlackEnabled: false,
+        SlackAPIBase: "https://slack.com/api",
+        DiscordAPIBase: defaultDiscordAPI,
+        DiscordTemplates: defaultDiscordTemplates(),
+        DiscordAnnounceEnabled: false,
+        DiscordAnnouncePerMinute: 6,
+        DiscordAnnounceDeleteAfterMin: 0,
+        DiscordThreadPerSession: false,
+        DiscordMentionInSummary: false,
+        DiscordMentionOnDone: false,
     }
 }
 
@@ -1155,109 +2190,34 @@ func loadSettings(base string) Settings {
         return defaultSettings()
     }
     var s Settings
-    if err := json.Unmarshal(b, &s); err != nil {
+    if err := settingsSchema.decode(b, &s); err != nil {
         return defaultSettings()
     }
     if s.ServerPort == 0 { s.ServerPort = 3010 }
+    if s.DebounceWindowMs <= 0 { s.DebounceWindowMs = 2000 }
     return s
 }
 
 func saveSettings(base string, s Settings) error {
+    s.SchemaVersion = settingsSchema.latest()
     b, err := json.MarshalIndent(s, "", "  ")
     if err != nil { return err }
     return writeFileAtomic(settingsPath(base), b)
 }
 
-func ensureSettingsUpgraded(base string) error {
-    p := settingsPath(base)
-    b, err := os.ReadFile(p)
-    if err != nil { return nil }
-    var raw map[string]interface{}
-    if err := json.Unmarshal(b, &raw); err != nil { return nil }
-    changed := false
-    if _, ok := raw["discordEnabled"]; !ok {
-        raw["discordEnabled"] = true
-        changed = true
-    }
-    if _, ok := raw["discordNewMessagePerSession"]; !ok {
-        raw["discordNewMessagePerSession"] = true
-        changed = true
-    }
-    if _, ok := raw["discordArchiveOldSummary"]; !ok {
-        raw["discordArchiveOldSummary"] = true
-        changed = true
-    }
-    if _, ok := raw["discordArchiveLabel"]; !ok {
-        raw["discordArchiveLabel"] = "アーカイブ"
-        changed = true
-    }
-    if _, ok := raw["discordEmojiDone"]; !ok {
-        raw["discordEmojiDone"] = "✅"
-        changed = true
-    }
-    if _, ok := raw["discordEmojiProgress"]; !ok {
-        raw["discordEmojiProgress"] = "🎨"
-        changed = true
-    }
-    if _, ok := raw["discordEmojiNone"]; !ok {
-        raw["discordEmojiNone"] = "⏳"
-        changed = true
-    }
-    if _, ok := raw["discordHeaderGif"]; !ok {
-        raw["discordHeaderGif"] = "---大当たり（Gif）---"
-        changed = true
-    }
-    if _, ok := raw["discordHeaderIllustration"]; !ok {
-        raw["discordHeaderIllustration"] = "---当たり（イラスト）---"
-        changed = true
-    }
-    if _, ok := raw["discordRefLabelYes"]; !ok {
-        raw["discordRefLabelYes"] = "参考画像あり"
-        changed = true
-    }
-    if _, ok := raw["discordRefLabelNo"]; !ok {
-        raw["discordRefLabelNo"] = "参考画像なし"
-        changed = true
-    }
-    if changed {
-        nb, err := json.MarshalIndent(raw, "", "  ")
-        if err != nil { return err }
-        return writeFileAtomic(p, nb)
-    }
-    return nil
-}
-
-// Remove legacy Japanese keys from current.json and normalize present
-func migrateCurrentJSON(base string) error {
-    p := statePath(base)
-    b, err := os.ReadFile(p)
-    if err != nil { return nil }
-    var root map[string]interface{}
-    if err := json.Unmarshal(b, &root); err != nil { return nil }
-    changed := false
-    if arr, ok := root["users"].([]interface{}); ok {
-        for _, it := range arr {
-            m, ok := it.(map[string]interface{})
-            if !ok { continue }
-            if _, ok := m["プレゼント"]; ok { delete(m, "プレゼント"); changed = true }
-            // normalize present to ASCII
-            if pv, ok := m["present"].(string); ok {
-                if pv == "イラスト" { m["present"] = "Illustration"; changed = true }
-            }
-            // ensure hasReference exists (default false)
-            if _, ok := m["hasReference"]; !ok { m["hasReference"] = false; changed = true }
-        }
-    }
-    if changed {
-        nb, err := json.MarshalIndent(root, "", "  ")
-        if err != nil { return err }
-        return writeFileAtomic(p, nb)
-    }
-    return nil
+type webhookInfo struct { ID, Token string; Base string; Thread string }
+
+// endpoint returns the webhook URL for path ("" or "/messages/{id}"), inside
+// Thread when set.
+func (w webhookInfo) endpoint(path string, wait bool) string {
+    q := url.Values{}
+    if wait { q.Set("wait", "true") }
+    if w.Thread != "" { q.Set("thread_id", w.Thread) }
+    u := w.Base + path
+    if len(q) > 0 { u += "?" + q.Encode() }
+    return u
 }
 
-type webhookInfo struct { ID, Token string; Base string }
-
 func parseWebhook(raw string) (webhookInfo, error) {
     u, err := url.Parse(raw)
     if err != nil { return webhookInfo{}, err }
@@ -1275,29 +2235,46 @@ func parseWebhook(raw string) (webhookInfo, error) {
         return webhookInfo{}, errors.New("invalid webhook URL")
     }
     base := fmt.Sprintf("%s://%s/api/webhooks/%s/%s", u.Scheme, u.Host, id, token)
+    // a custom discordApiBase (e.g. gacha fake-discord) also receives webhook calls
+    if discordAPI != defaultDiscordAPI {
+        base = fmt.Sprintf("%s/webhooks/%s/%s", discordAPI, id, token)
+    }
     return webhookInfo{ID: id, Token: token, Base: base}, nil
 }
 
 func discordUpsertEmbed(base, webhookURL, key string, payload DiscordMessage) error {
     info, err := parseWebhook(webhookURL)
     if err != nil { return err }
+    info.Thread = summaryThread(base, key)
     m, _ := loadDiscordMap(base)
     msgID := m[key]
     if msgID == "" {
+        if s, ok := webhookThreadWanted(base, key); ok {
+            // start the session's forum thread with the summary
+            id, thread, err := discordWebhookPostThread(info, discordThreadName(loadSettings(base), s), payload)
+            if err != nil { return err }
+            _ = updateDiscordMap(base, func(m DiscordMap) {
+                m[key] = id
+                m[forumThreadKey(s.ID)] = thread
+            })
+            if err := setSessionThread(base, s.ID, thread, "webhook"); err != nil { return err }
+            _ = appendAppLog(base, "info: discord thread created (forum post): "+thread)
+            return nil
+        }
         id, err := discordWebhookPost(info, payload)
         if err != nil { return err }
         if id != "" {
-            m[key] = id
-            _ = saveDiscordMap(base, m)
+            _ = updateDiscordMap(base, func(m DiscordMap) { m[key] = id })
         }
         return nil
     }
     if err := discordWebhookEditEmbed(info, msgID, payload); err != nil {
-        // If edit fails (e.g., not found), try to post again and update map
+        // Repost only when the message is gone; rate limits and outages are
+        // returned so the outbox retries the edit instead of duplicating it.
+        if !isDiscordNotFound(err) { return err }
         id, perr := discordWebhookPost(info, payload)
         if perr == nil && id != "" {
-            m[key] = id
-            _ = saveDiscordMap(base, m)
+            _ = updateDiscordMap(base, func(m DiscordMap) { m[key] = id })
             return nil
         }
         return err
@@ -1307,15 +2284,15 @@ func discordUpsertEmbed(base, webhookURL, key string, payload DiscordMessage) er
 
 func discordWebhookPost(info webhookInfo, payload DiscordMessage) (string, error) {
     // use wait=true to get message payload back
-    u := info.Base + "?wait=true"
+    u := info.endpoint("", true)
     b, _ := json.Marshal(payload)
     req, _ := http.NewRequest("POST", u, bytes.NewReader(b))
     req.Header.Set("Content-Type", "application/json")
-    resp, err := http.DefaultClient.Do(req)
+    resp, err := discordDo(req)
     if err != nil { return "", err }
     defer resp.Body.Close()
     if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-        return "", fmt.Errorf("webhook post failed: %s", resp.Status)
+        return "", discordStatusError("webhook post", resp)
     }
     var res struct{ ID string `json:"id"` }
     if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
@@ -1326,27 +2303,27 @@ func discordWebhookPost(info webhookInfo, payload DiscordMessage) (string, error
 }
 
 func discordWebhookEditEmbed(info webhookInfo, messageID string, payload DiscordMessage) error {
-    u := fmt.Sprintf("%s/messages/%s", info.Base, messageID)
+    u := info.endpoint("/messages/"+messageID, false)
     b, _ := json.Marshal(payload)
     req, _ := http.NewRequest("PATCH", u, bytes.NewReader(b))
     req.Header.Set("Content-Type", "application/json")
-    resp, err := http.DefaultClient.Do(req)
+    resp, err := discordDo(req)
     if err != nil { return err }
     defer resp.Body.Close()
     if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-        return fmt.Errorf("webhook edit failed: %s", resp.Status)
+        return discordStatusError("webhook edit", resp)
     }
     return nil
 }
 
 func discordWebhookGetMessage(info webhookInfo, messageID string) (string, []DiscordEmbed, error) {
-    u := fmt.Sprintf("%s/messages/%s", info.Base, messageID)
+    u := info.endpoint("/messages/"+messageID, false)
     req, _ := http.NewRequest("GET", u, nil)
-    resp, err := http.DefaultClient.Do(req)
+    resp, err := discordDo(req)
     if err != nil { return "", nil, err }
     defer resp.Body.Close()
     if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-        return "", nil, fmt.Errorf("webhook get failed: %s", resp.Status)
+        return "", nil, discordStatusError("webhook get", resp)
     }
     var res struct{
         Content string          `json:"content"`
@@ -1356,6 +2333,18 @@ func discordWebhookGetMessage(info webhookInfo, messageID string) (string, []Dis
     return res.Content, res.Embeds, nil
 }
 
+func discordWebhookDeleteMessage(info webhookInfo, messageID string) error {
+    u := info.endpoint("/messages/"+messageID, false)
+    req, _ := http.NewRequest("DELETE", u, nil)
+    resp, err := discordDo(req)
+    if err != nil { return err }
+    defer resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return discordStatusError("webhook delete", resp)
+    }
+    return nil
+}
+
 // Bot (OAuth2 token) message operations
 func discordBotUpsertEmbed(base, token, channelID, key string, payload DiscordMessage) error {
     m, _ := loadDiscordMap(base)
@@ -1364,16 +2353,15 @@ func discordBotUpsertEmbed(base, token, channelID, key string, payload DiscordMe
         id, err := discordBotPost(token, channelID, payload)
         if err != nil { return err }
         if id != "" {
-            m[key] = id
-            _ = saveDiscordMap(base, m)
+            _ = updateDiscordMap(base, func(m DiscordMap) { m[key] = id })
         }
         return nil
     }
     if err := discordBotEditEmbed(token, channelID, msgID, payload); err != nil {
+        if !isDiscordNotFound(err) { return err }
         id, perr := discordBotPost(token, channelID, payload)
         if perr == nil && id != "" {
-            m[key] = id
-            _ = saveDiscordMap(base, m)
+            _ = updateDiscordMap(base, func(m DiscordMap) { m[key] = id })
             return nil
         }
         return err
@@ -1382,16 +2370,16 @@ func discordBotUpsertEmbed(base, token, channelID, key string, payload DiscordMe
 }
 
 func discordBotPost(token, channelID string, payload DiscordMessage) (string, error) {
-    u := fmt.Sprintf("https://discord.com/api/v10/channels/%s/messages", channelID)
+    u := fmt.Sprintf("%s/channels/%s/messages", discordAPI, channelID)
     b, _ := json.Marshal(payload)
     req, _ := http.NewRequest("POST", u, bytes.NewReader(b))
     req.Header.Set("Content-Type", "application/json")
     req.Header.Set("Authorization", "Bot "+token)
-    resp, err := http.DefaultClient.Do(req)
+    resp, err := discordDo(req)
     if err != nil { return "", err }
     defer resp.Body.Close()
     if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-        return "", fmt.Errorf("bot post failed: %s", resp.Status)
+        return "", discordStatusError("bot post", resp)
     }
     var res struct{ ID string `json:"id"` }
     if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
@@ -1401,29 +2389,29 @@ func discordBotPost(token, channelID string, payload DiscordMessage) (string, er
 }
 
 func discordBotEditEmbed(token, channelID, messageID string, payload DiscordMessage) error {
-    u := fmt.Sprintf("https://discord.com/api/v10/channels/%s/messages/%s", channelID, messageID)
+    u := fmt.Sprintf("%s/channels/%s/messages/%s", discordAPI, channelID, messageID)
     b, _ := json.Marshal(payload)
     req, _ := http.NewRequest("PATCH", u, bytes.NewReader(b))
     req.Header.Set("Content-Type", "application/json")
     req.Header.Set("Authorization", "Bot "+token)
-    resp, err := http.DefaultClient.Do(req)
+    resp, err := discordDo(req)
     if err != nil { return err }
     defer resp.Body.Close()
     if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-        return fmt.Errorf("bot edit failed: %s", resp.Status)
+        return discordStatusError("bot edit", resp)
     }
     return nil
 }
 
 func discordBotGetMessage(token, channelID, messageID string) (string, []DiscordEmbed, error) {
-    u := fmt.Sprintf("https://discord.com/api/v10/channels/%s/messages/%s", channelID, messageID)
+    u := fmt.Sprintf("%s/channels/%s/messages/%s", discordAPI, channelID, messageID)
     req, _ := http.NewRequest("GET", u, nil)
     req.Header.Set("Authorization", "Bot "+token)
-    resp, err := http.DefaultClient.Do(req)
+    resp, err := discordDo(req)
     if err != nil { return "", nil, err }
     defer resp.Body.Close()
     if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-        return "", nil, fmt.Errorf("bot get failed: %s", resp.Status)
+        return "", nil, discordStatusError("bot get", resp)
     }
     var res struct{
         Content string          `json:"content"`
@@ -1432,3 +2420,16 @@ func discordBotGetMessage(token, channelID, messageID string) (string, []Discord
     if err := json.NewDecoder(resp.Body).Decode(&res); err != nil { return "", nil, err }
     return res.Content, res.Embeds, nil
 }
+
+func discordBotDeleteMessage(token, channelID, messageID string) error {
+    u := fmt.Sprintf("%s/channels/%s/messages/%s", discordAPI, channelID, messageID)
+    req, _ := http.NewRequest("DELETE", u, nil)
+    req.Header.Set("Authorization", "Bot "+token)
+    resp, err := discordDo(req)
+    if err != nil { return err }
+    defer resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return discordStatusError("bot delete", resp)
+    }
+    return nil
+}
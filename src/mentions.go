@@ -0,0 +1,180 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+)
+
+// Discord mentions (data/discord_users.json).
+// A directory maps winner names (Twitch names) to Discord user IDs; it is kept
+// across sessions and managed with `gacha discord user`, /api/discord/users or
+// by editing the file. Templates get .Mention ("<@id>", or "" when the user has
+// no mapping so they fall back to the plain name):
+//   discordMentionInSummary: summary lines mention the users. Mentions inside
+//     embeds never ping; they only render as a clickable user.
+//   discordMentionOnDone: the completion message (the deliverable upload, or a
+//     text notice for done users without a file) mentions the user and pings them.
+// Messages set allowed_mentions to the mapped users of that message only, so
+// names containing @everyone or role mentions never ping anybody.
+
+type discordDirectory map[string]string
+
+var errBadDiscordID = errors.New("invalid Discord user ID (17-20 digits)")
+
+var discordIDPattern = regexp.MustCompile(`^<@!?(\d{17,20})>$|^(\d{17,20})$`)
+
+func discordUsersPath(base string) string { return filepath.Join(base, "data", "discord_users.json") }
+
+func loadDiscordDirectory(base string) (discordDirectory, error) {
+    b, err := os.ReadFile(discordUsersPath(base))
+    if err != nil {
+        if os.IsNotExist(err) { return discordDirectory{}, nil }
+        return nil, err
+    }
+    d := discordDirectory{}
+    if err := json.Unmarshal(b, &d); err != nil { return nil, err }
+    return d, nil
+}
+
+func saveDiscordDirectory(base string, d discordDirectory) error {
+    b, err := json.MarshalIndent(d, "", "  ")
+    if err != nil { return err }
+    return writeFileAtomic(discordUsersPath(base), b)
+}
+
+// normalizeDiscordID accepts a user ID or a mention (<@id>, <@!id>).
+func normalizeDiscordID(s string) (string, error) {
+    m := discordIDPattern.FindStringSubmatch(strings.TrimSpace(s))
+    if m == nil { return "", fmt.Errorf("%w: %q", errBadDiscordID, s) }
+    return m[1] + m[2], nil
+}
+
+// lookup returns the Discord ID of name: exact match first, then ignoring case
+// (Twitch logins are case-insensitive).
+func (d discordDirectory) lookup(name string) string {
+    if id, ok := d[name]; ok { return id }
+    for k, id := range d {
+        if strings.EqualFold(k, name) { return id }
+    }
+    return ""
+}
+
+// mention returns "<@id>" for name, or "" when it is not mapped.
+func (d discordDirectory) mention(name string) string {
+    if id := d.lookup(name); id != "" { return "<@" + id + ">" }
+    return ""
+}
+
+// sortedNames lists the directory by name.
+func (d discordDirectory) sortedNames() []string {
+    names := make([]string, 0, len(d))
+    for k := range d {
+        names = append(names, k)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// allowedMentions lets exactly ids be pinged (nobody when empty).
+func allowedMentions(ids ...string) map[string]any {
+    am := map[string]any{"parse": []string{}}
+    if len(ids) > 0 { am["users"] = ids }
+    return am
+}
+
+// summaryMentions returns the directory for summary lines (nil when
+// discordMentionInSummary is off).
+func summaryMentions(base string, cfg Settings) discordDirectory {
+    if !cfg.DiscordMentionInSummary { return nil }
+    d, err := loadDiscordDirectory(base)
+    if err != nil {
+        _ = appendAppLog(base, "warn: read discord_users.json failed: "+err.Error())
+        return nil
+    }
+    return d
+}
+
+func doSetDiscordUser(base, name, id string) (string, error) {
+    name = strings.TrimSpace(name)
+    if name == "" { return "", errors.New("missing name") }
+    id, err := normalizeDiscordID(id)
+    if err != nil { return "", err }
+    err = withLock(base, func() error {
+        d, err := loadDiscordDirectory(base)
+        if err != nil { return err }
+        d[name] = id
+        if err := saveDiscordDirectory(base, d); err != nil { return err }
+        _ = appendAppLog(base, fmt.Sprintf("discord user: set name=%q id=%s", name, id))
+        return nil
+    })
+    return id, err
+}
+
+func doRemoveDiscordUser(base, name string) error {
+    name = strings.TrimSpace(name)
+    return withLock(base, func() error {
+        d, err := loadDiscordDirectory(base)
+        if err != nil { return err }
+        if _, ok := d[name]; !ok { return fmt.Errorf("%w: %s", errUserNotFound, name) }
+        delete(d, name)
+        if err := saveDiscordDirectory(base, d); err != nil { return err }
+        _ = appendAppLog(base, fmt.Sprintf("discord user: removed name=%q", name))
+        return nil
+    })
+}
+
+// postCompletionNotices posts the completion message for users that became
+// done in events and have no deliverable (those are announced with their file
+// by postPendingDeliverables). Only with discordMentionOnDone. Callers hold the
+// notify lock.
+func postCompletionNotices(base string, events []ChangeEvent, st State) {
+    cfg := loadSettings(base)
+    if !cfg.DiscordMentionOnDone || !discordConfigured() { return }
+    if !cfg.DiscordEnabled && !isTruthy(os.Getenv("DISCORD_NOTIFY")) { return }
+    idx, _ := loadDeliverables(base)
+    m, err := loadDiscordMap(base)
+    if err != nil { return }
+    dir, err := loadDiscordDirectory(base)
+    if err != nil {
+        _ = appendAppLog(base, "warn: read discord_users.json failed: "+err.Error())
+        dir = discordDirectory{}
+    }
+    tpl, _ := compileDiscordTemplates(cfg.DiscordTemplates)
+    sid := currentSessionID(base)
+    posted := map[string]string{}
+    for _, ev := range events {
+        if ev.Type != journalStatus || ev.Status != "done" { continue }
+        if _, ok := idx[ev.Name]; ok || m[deliverableKey(sid, ev.Name)] != "" { continue }
+        var u User
+        for _, x := range st.Users {
+            if x.Name == ev.Name { u = x }
+        }
+        if u.Name == "" || !(u.Done || u.Status == "done") { continue }
+        payload := DiscordMessage{Content: truncateRunes(tpl.deliverable.render(deliverableData{User: u, Mention: dir.mention(u.Name)}), 2000), AllowedMentions: allowedMentions()}
+        if id := dir.lookup(u.Name); id != "" { payload.AllowedMentions = allowedMentions(id) }
+        id, mode, err := discordPostMessage(currentThread(base), payload)
+        if err != nil {
+            _ = appendAppLog(base, "warn: discord "+mode+" completion notice failed: "+err.Error())
+            continue
+        }
+        if id == "" { id = "posted" }
+        m[deliverableKey(sid, u.Name)] = id
+        posted[deliverableKey(sid, u.Name)] = id
+        _ = appendAppLog(base, fmt.Sprintf("info: discord %s completion notice posted: name=%q id=%s", mode, u.Name, id))
+    }
+    if len(posted) > 0 {
+        if err := updateDiscordMap(base, func(m DiscordMap) {
+            for k, id := range posted {
+                m[k] = id
+            }
+        }); err != nil {
+            _ = appendAppLog(base, "warn: save discord_map.json failed: "+err.Error())
+        }
+    }
+}
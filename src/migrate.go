@@ -0,0 +1,384 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "sort"
+)
+
+// Versioned data files.
+// current.json, setting.json, discord_map.json and backups/*.json carry a
+// top-level "schemaVersion" (files without one are version 0). Each file kind
+// has an ordered list of migration steps; on load the steps newer than the
+// file's version are applied in order. At startup current.json, setting.json
+// and discord_map.json are migrated on disk (migrateLiveFiles); backups are
+// left as they are and migrated in memory when restored (`gacha migrate`
+// checks them). A file with a version newer than this
+// binary knows is refused (errSchemaTooNew) instead of being misread.
+//
+// To change a file format, append a step with the next version number; never
+// edit a released step.
+
+var errSchemaTooNew = errors.New("file was written by a newer version of gacha")
+
+type migration struct {
+    To    int
+    Desc  string
+    Apply func(doc map[string]any) []string // returns a line per change
+}
+
+type schema struct {
+    Steps []migration
+}
+
+var stateSchema = schema{Steps: []migration{
+    {To: 1, Desc: "drop legacy Japanese keys, add hasReference and counts", Apply: migrateState1},
+}}
+
+var settingsSchema = schema{Steps: []migration{
+    {To: 1, Desc: "add missing settings with their defaults", Apply: migrateSettings1},
+    {To: 2, Desc: "add backupRetention (keep everything)", Apply: migrateSettings2},
+    {To: 3, Desc: "highlight the jackpot tier in announcements", Apply: migrateSettings3},
+}}
+
+var discordMapSchema = schema{Steps: []migration{
+    {To: 1, Desc: "add schemaVersion", Apply: func(map[string]any) []string { return nil }},
+    {To: 2, Desc: "rename summary page keys <key>::<N> to <key>#p<N>", Apply: migrateDiscordMap2},
+}}
+
+func (s schema) latest() int { return s.Steps[len(s.Steps)-1].To }
+
+func schemaVersionOf(doc map[string]any) int {
+    if v, ok := doc["schemaVersion"].(float64); ok { return int(v) }
+    return 0
+}
+
+// migrate upgrades doc in place to the latest version and returns what changed
+// (nothing when doc is already current).
+func (s schema) migrate(doc map[string]any) ([]string, error) {
+    v := schemaVersionOf(doc)
+    if v > s.latest() {
+        return nil, fmt.Errorf("%w (schemaVersion %d, this binary understands up to %d)", errSchemaTooNew, v, s.latest())
+    }
+    if v == s.latest() { return nil, nil }
+    var changes []string
+    for _, m := range s.Steps {
+        if m.To <= v { continue }
+        changes = append(changes, fmt.Sprintf("v%d: %s", m.To, m.Desc))
+        for _, c := range m.Apply(doc) {
+            changes = append(changes, "  "+c)
+        }
+    }
+    doc["schemaVersion"] = s.latest()
+    return changes, nil
+}
+
+// decode migrates the JSON document b in memory and decodes it into v.
+func (s schema) decode(b []byte, v any) error {
+    var doc map[string]any
+    if err := json.Unmarshal(b, &doc); err != nil { return err }
+    if doc == nil { doc = map[string]any{} }
+    if _, err := s.migrate(doc); err != nil { return err }
+    nb, err := json.Marshal(doc)
+    if err != nil { return err }
+    return json.Unmarshal(nb, v)
+}
+
+// decodeState reads a current.json or backup document.
+func decodeState(b []byte) (State, error) {
+    var st State
+    if err := stateSchema.decode(b, &st); err != nil { return State{}, err }
+    normalizeStateCounts(&st)
+    return st, nil
+}
+
+// v1: cleanup of pre-schema current.json files.
+func migrateState1(doc map[string]any) []string {
+    var out []string
+    arr, _ := doc["users"].([]any)
+    for _, it := range arr {
+        m, ok := it.(map[string]any)
+        if !ok { continue }
+        name, _ := m["name"].(string)
+        if _, ok := m["プレゼント"]; ok {
+            delete(m, "プレゼント")
+            out = append(out, fmt.Sprintf("users[%s]: removed legacy key プレゼント", name))
+        }
+        // normalize present to ASCII
+        if pv, ok := m["present"].(string); ok && pv == "イラスト" {
+            m["present"] = "Illustration"
+            out = append(out, fmt.Sprintf("users[%s]: present イラスト -> Illustration", name))
+        }
+        if _, ok := m["hasReference"]; !ok {
+            m["hasReference"] = false
+            out = append(out, fmt.Sprintf("users[%s]: added hasReference=false", name))
+        }
+        // move hit/jackpot into the per-tier counts map
+        if _, ok := m["counts"]; !ok {
+            counts := map[string]any{}
+            for _, k := range []string{"hit", "jackpot"} {
+                if v, ok := m[k].(float64); ok && v > 0 { counts[k] = v }
+            }
+            m["counts"] = counts
+            out = append(out, fmt.Sprintf("users[%s]: added counts", name))
+        }
+    }
+    return out
+}
+
+// v1: settings that pre-schema setting.json files may lack.
+func migrateSettings1(doc map[string]any) []string {
+    defaults := []struct {
+        Key   string
+        Value any
+    }{
+        {"discordEnabled", true},
+        {"discordNewMessagePerSession", true},
+        {"discordArchiveOldSummary", true},
+        {"discordArchiveLabel", "アーカイブ"},
+        {"discordEmojiDone", "✅"},
+        {"discordEmojiProgress", "🎨"},
+        {"discordEmojiNone", "⏳"},
+        {"discordHeaderGif", "---大当たり（Gif）---"},
+        {"discordHeaderIllustration", "---当たり（イラスト）---"},
+        {"discordRefLabelYes", "参考画像あり"},
+        {"discordRefLabelNo", "参考画像なし"},
+        {"debounceEnabled", false},
+        {"debounceWindowMs", 2000},
+        {"rewards", defaultRewardRules()},
+        {"singleWriter", true},
+        {"tiers", defaultTiers()},
+        {"webhooks", []OutgoingWebhook{}},
+        {"slackEnabled", false},
+        {"slackApiBase", "https://slack.com/api"},
+        {"discordApiBase", defaultDiscordAPI},
+        {"discordTemplates", defaultDiscordTemplates()},
+        {"discordAnnounceEnabled", false},
+        {"discordAnnouncePerMinute", 6},
+        {"discordAnnounceDeleteAfterMin", 0},
+        {"discordThreadPerSession", false},
+        {"discordMentionInSummary", false},
+        {"discordMentionOnDone", false},
+    }
+    var out []string
+    for _, d := range defaults {
+        if _, ok := doc[d.Key]; ok { continue }
+        doc[d.Key] = d.Value
+        if b, err := json.Marshal(d.Value); err == nil && len(b) <= 40 {
+            out = append(out, fmt.Sprintf("added %s=%s", d.Key, b))
+        } else {
+            out = append(out, "added "+d.Key)
+        }
+    }
+    return out
+}
+
+// v2: backup retention, off by default.
+func migrateSettings2(doc map[string]any) []string {
+    if _, ok := doc["backupRetention"]; ok { return nil }
+    doc["backupRetention"] = BackupRetention{}
+    return []string{"added backupRetention"}
+}
+
+// v3: announcements highlight tiers with "highlight" instead of every tier
+// after the first; keep the jackpot highlighted.
+func migrateSettings3(doc map[string]any) []string {
+    arr, _ := doc["tiers"].([]any)
+    var out []string
+    for i, it := range arr {
+        m, ok := it.(map[string]any)
+        if !ok || m["counter"] != "jackpot" { continue }
+        if _, ok := m["highlight"]; ok { continue }
+        m["highlight"] = true
+        out = append(out, fmt.Sprintf("tiers[%d]: added highlight=true", i))
+    }
+    return out
+}
+
+func migrateDiscordMap2(doc map[string]any) []string {
+    var keys []string
+    for k := range doc {
+        if _, ok := legacySummaryPageKey(k); ok { keys = append(keys, k) }
+    }
+    sort.Strings(keys)
+    var out []string
+    for _, k := range keys {
+        nk, _ := legacySummaryPageKey(k)
+        doc[nk] = doc[k]
+        delete(doc, k)
+        out = append(out, k+" -> "+nk)
+    }
+    return out
+}
+
+type migrationReport struct {
+    File    string   `json:"file"`
+    From    int      `json:"from"`
+    To      int      `json:"to"`
+    Changes []string `json:"changes,omitempty"`
+    Written bool     `json:"written"`
+    Note    string   `json:"note,omitempty"`
+    Error   string   `json:"error,omitempty"`
+}
+
+// migrateFile migrates the file at p, writing it back when write is set and
+// something changed. A missing file yields os.ErrNotExist.
+func migrateFile(p string, s schema, write bool) (migrationReport, error) {
+    rep := migrationReport{File: p, To: s.latest()}
+    b, err := os.ReadFile(p)
+    if err != nil { return rep, err }
+    return migrateBytes(rep, p, b, s, write)
+}
+
+func migrateBytes(rep migrationReport, p string, b []byte, s schema, write bool) (migrationReport, error) {
+    var doc map[string]any
+    if err := json.Unmarshal(b, &doc); err != nil { return rep, fmt.Errorf("%s: %w", filepath.Base(p), err) }
+    if doc == nil { doc = map[string]any{} }
+    rep.From = schemaVersionOf(doc)
+    changes, err := s.migrate(doc)
+    if err != nil { return rep, fmt.Errorf("%s: %w", filepath.Base(p), err) }
+    rep.Changes = changes
+    if !write || rep.From == rep.To { return rep, nil }
+    nb, err := json.MarshalIndent(doc, "", "  ")
+    if err != nil { return rep, err }
+    if err := writeFileAtomic(p, nb); err != nil { return rep, err }
+    rep.Written = true
+    return rep, nil
+}
+
+// migrateDataFiles migrates setting.json, current.json and discord_map.json
+// (written back unless dryRun) and checks the backups, which are only migrated
+// in memory on restore. Callers hold the data lock. The error wraps
+// errSchemaTooNew when a live file is newer than this binary.
+func migrateDataFiles(base string, dryRun bool) ([]migrationReport, error) {
+    var reps []migrationReport
+    var tooNew []error
+    for _, f := range liveDataFiles(base) {
+        rep, err := migrateLiveFile(base, f, !dryRun)
+        if errors.Is(err, os.ErrNotExist) { continue }
+        if err != nil {
+            rep.Error = err.Error()
+            if errors.Is(err, errSchemaTooNew) { tooNew = append(tooNew, err) }
+        }
+        reps = append(reps, rep)
+    }
+    if names, err := listBackups(base); err == nil {
+        sort.Strings(names)
+        for _, n := range names {
+            p := filepath.Join(backupDir(base), n)
+            rep := migrationReport{File: p, To: stateSchema.latest()}
+            b, err := readBackupFile(p)
+            if err == nil { rep, err = migrateBytes(rep, p, b, stateSchema, false) }
+            if err != nil {
+                rep.Error = err.Error()
+            } else if rep.From == rep.To {
+                continue
+            } else {
+                rep.Changes, rep.Note = nil, "migrated in memory on restore"
+            }
+            reps = append(reps, rep)
+        }
+    }
+    if len(tooNew) > 0 {
+        return reps, fmt.Errorf("%w; use a newer gacha", errors.Join(tooNew...))
+    }
+    return reps, nil
+}
+
+type liveDataFile struct {
+    Path   string
+    Schema schema
+}
+
+func liveDataFiles(base string) []liveDataFile {
+    return []liveDataFile{
+        {settingsPath(base), settingsSchema},
+        {statePath(base), stateSchema},
+        {discordMapPath(base), discordMapSchema},
+    }
+}
+
+func migrateLiveFile(base string, f liveDataFile, write bool) (migrationReport, error) {
+    rep, err := migrateFile(f.Path, f.Schema, write)
+    if err == nil && rep.Written {
+        _ = appendAppLog(base, fmt.Sprintf("migrate: %s v%d -> v%d", filepath.Base(f.Path), rep.From, rep.To))
+    }
+    return rep, err
+}
+
+// peekSchemaVersion reads only the schemaVersion of the JSON file at p.
+func peekSchemaVersion(p string) (int, error) {
+    b, err := os.ReadFile(p)
+    if err != nil { return 0, err }
+    var doc struct {
+        SchemaVersion int `json:"schemaVersion"`
+    }
+    if err := json.Unmarshal(b, &doc); err != nil { return 0, err }
+    return doc.SchemaVersion, nil
+}
+
+// migrateLiveFiles brings the live data files to the current schema at
+// startup. Their versions are peeked without the lock, which is taken only
+// when a file has to be rewritten (or discord_map.json created). Unreadable
+// files are left to the loaders. Backups are not looked at. The error wraps
+// errSchemaTooNew when a file is newer than this binary.
+func migrateLiveFiles(base string) error {
+    var stale []liveDataFile
+    var tooNew []error
+    for _, f := range liveDataFiles(base) {
+        v, err := peekSchemaVersion(f.Path)
+        if err != nil { continue }
+        if v > f.Schema.latest() {
+            tooNew = append(tooNew, fmt.Errorf("%s: %w (schemaVersion %d, this binary understands up to %d)", filepath.Base(f.Path), errSchemaTooNew, v, f.Schema.latest()))
+        } else if v < f.Schema.latest() {
+            stale = append(stale, f)
+        }
+    }
+    if len(tooNew) > 0 {
+        return fmt.Errorf("%w; use a newer gacha", errors.Join(tooNew...))
+    }
+    if _, err := os.Stat(discordMapPath(base)); len(stale) == 0 && !os.IsNotExist(err) { return nil }
+    return withLock(base, func() error {
+        for _, f := range stale {
+            // re-read under the lock: another process may have migrated it
+            if _, err := migrateLiveFile(base, f, true); err != nil && !errors.Is(err, os.ErrNotExist) {
+                if errors.Is(err, errSchemaTooNew) { return err }
+                _ = appendAppLog(base, "warn: migrate data files failed: "+err.Error())
+            }
+        }
+        if err := ensureDiscordMapExists(base); err != nil {
+            _ = appendAppLog(base, "warn: ensure discord_map.json failed: "+err.Error())
+        }
+        return nil
+    })
+}
+
+func printMigrationReports(w io.Writer, reps []migrationReport, dryRun bool) {
+    if len(reps) == 0 {
+        fmt.Fprintln(w, "migrate: no data files")
+        return
+    }
+    for _, r := range reps {
+        switch {
+        case r.Error != "":
+            fmt.Fprintf(w, "%s: error: %s\n", r.File, r.Error)
+        case r.From == r.To:
+            fmt.Fprintf(w, "%s: up to date (v%d)\n", r.File, r.To)
+        default:
+            verb := "migrated"
+            if r.Note != "" {
+                verb = r.Note + ":"
+            } else if dryRun || !r.Written {
+                verb = "would migrate"
+            }
+            fmt.Fprintf(w, "%s: %s v%d -> v%d\n", r.File, verb, r.From, r.To)
+            for _, c := range r.Changes {
+                fmt.Fprintln(w, "  "+c)
+            }
+        }
+    }
+}
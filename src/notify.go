@@ -0,0 +1,127 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "time"
+)
+
+// Notifiers.
+// Every state change (win, status/ref change, correction, reset, restore,
+// recompute) is reported through notifyChange as a ChangeEvent. Each configured
+// Notifier receives it: the Discord summary is always registered, the Slack
+// summary with slackEnabled, outgoing webhooks from setting.json "webhooks".
+// Notifiers run under the notify lock, never under the data lock (see lock.go):
+// callers release the data lock first, and notifiers take it only briefly to
+// persist discord_map.json and session.json (updateDiscordMap,
+// setSessionThread). The outbox, announce log and slack_map.json are written
+// by notifiers only and are covered by the notify lock.
+
+const (
+    notifyUndo      = "undo"
+    notifyRecompute = "recompute"
+)
+
+// ChangeEvent describes one state change. Type is one of the journal types
+// (win, status, ref, adjust, reset, restore) or undo / recompute.
+type ChangeEvent struct {
+    Type         string         `json:"type"`
+    At           string         `json:"at"`
+    EventID      string         `json:"eventId,omitempty"`
+    Name         string         `json:"name,omitempty"`
+    HitFlag      *int           `json:"hitFlag,omitempty"`
+    Counter      string         `json:"counter,omitempty"`
+    Status       string         `json:"status,omitempty"`
+    HasReference *bool          `json:"hasReference,omitempty"`
+    Deltas       map[string]int `json:"deltas,omitempty"`
+    Undoes       int64          `json:"undoes,omitempty"`
+    Backup       string         `json:"backup,omitempty"`
+    User         *User          `json:"user,omitempty"` // snapshot after the change
+}
+
+// Notifier delivers state changes to one destination. events holds at least
+// one change; st is the state after the last of them. Delivery failures that
+// the notifier retries by itself should not be returned.
+type Notifier interface {
+    Name() string
+    Notify(base string, events []ChangeEvent, st State) error
+}
+
+// newChangeEvent stamps ev and attaches the snapshot of the affected user.
+func newChangeEvent(ev ChangeEvent, st State) ChangeEvent {
+    if ev.At == "" { ev.At = time.Now().UTC().Format(time.RFC3339) }
+    if ev.Name != "" {
+        for i := range st.Users {
+            if st.Users[i].Name == ev.Name {
+                u := st.Users[i]
+                ev.User = &u
+                break
+            }
+        }
+    }
+    return ev
+}
+
+func notifiers(cfg Settings) []Notifier {
+    ns := []Notifier{discordNotifier{}}
+    if cfg.SlackEnabled { ns = append(ns, slackNotifier{}) }
+    for _, h := range cfg.Webhooks {
+        if strings.TrimSpace(h.URL) == "" { continue }
+        ns = append(ns, webhookNotifier{hook: h})
+    }
+    return ns
+}
+
+func notifyChange(base string, ev ChangeEvent, st State) {
+    notifyChanges(base, []ChangeEvent{newChangeEvent(ev, st)}, st)
+}
+
+// notifyChanges runs the notifiers under the notify lock. Callers must not hold
+// the data lock.
+func notifyChanges(base string, events []ChangeEvent, st State) {
+    if len(events) == 0 { return }
+    err := withNotifyLock(base, func() error {
+        for _, n := range notifiers(loadSettings(base)) {
+            if err := n.Notify(base, events, st); err != nil {
+                _ = appendAppLog(base, "warn: notify "+n.Name()+" failed: "+err.Error())
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        _ = appendAppLog(base, fmt.Sprintf("warn: notify skipped (%d events): %s", len(events), err.Error()))
+    }
+}
+
+// currentSessionID reads data/session.json without starting a new session.
+func currentSessionID(base string) string {
+    s, _ := loadSession(base)
+    return s.ID
+}
+
+// discordNotifier mirrors the latest state into the Discord summary; a batch
+// of events results in a single refresh (plus one announcement per win when
+// discordAnnounceEnabled, and the completion notices of users that became
+// done). Deliverables are uploaded after the notify lock is released
+// (postPendingDeliverables). The archive work of a new session is done here
+// as well (archivePreviousSession).
+type discordNotifier struct{}
+
+func (discordNotifier) Name() string { return "discord" }
+
+func (discordNotifier) Notify(base string, events []ChangeEvent, st State) error {
+    archivePreviousSession(base)
+    // a reset only starts a new session; its summary is posted on the next win
+    onlyReset := true
+    for _, ev := range events {
+        if ev.Type != journalReset { onlyReset = false }
+    }
+    if onlyReset { return nil }
+    refreshDiscordSummary(base, st)
+    announceWins(base, events)
+    postCompletionNotices(base, events, st)
+    if err := deleteExpiredAnnouncements(base); err != nil {
+        _ = appendAppLog(base, "warn: discord announce cleanup failed: "+err.Error())
+    }
+    return nil
+}
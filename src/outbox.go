@@ -0,0 +1,286 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// Durable Discord outbox (data/discord_outbox.json).
+// A summary update that cannot be delivered is kept here, one item per summary
+// key, and retried by `gacha serve` with exponential backoff. Newer updates for
+// the same key replace the queued payload so only the latest state is sent.
+// Slack summaries (Target "slack", key __SLACK__::<summary key>) and outgoing
+// webhook payloads (Target "webhook", one item per event and URL, see
+// webhook_notify.go) that could not be delivered are kept here too.
+// Only notifiers write the outbox; callers hold the notify lock.
+
+const (
+    outboxBaseBackoff  = 5 * time.Second
+    outboxMaxBackoff   = 5 * time.Minute
+    outboxPollInterval = 2 * time.Second
+)
+
+var errNoDiscordCredentials = errors.New("no discord credentials")
+
+const (
+    outboxSlack   = "slack"
+    outboxWebhook = "webhook"
+)
+
+type OutboxItem struct {
+    Key           string          `json:"key"`
+    Target        string          `json:"target,omitempty"` // "" (Discord summary), outboxSlack or outboxWebhook
+    URL           string          `json:"url,omitempty"`    // webhook URL (the secret is looked up when sending)
+    Payload       DiscordMessage  `json:"payload"`
+    Slack         *slackMessage   `json:"slack,omitempty"`
+    Webhook       *webhookPayload `json:"webhook,omitempty"`
+    Attempts      int            `json:"attempts"`
+    NextAttemptAt string         `json:"nextAttemptAt"`
+    LastError     string         `json:"lastError,omitempty"`
+    QueuedAt      string         `json:"queuedAt"`
+    UpdatedAt     string         `json:"updatedAt"`
+}
+
+func outboxPath(base string) string { return filepath.Join(base, "data", "discord_outbox.json") }
+
+func loadOutbox(base string) ([]OutboxItem, error) {
+    b, err := os.ReadFile(outboxPath(base))
+    if err != nil {
+        if os.IsNotExist(err) { return []OutboxItem{}, nil }
+        return nil, err
+    }
+    var items []OutboxItem
+    if err := json.Unmarshal(b, &items); err != nil { return nil, err }
+    if items == nil { items = []OutboxItem{} }
+    // page keys queued before discord_map v2
+    for i := range items {
+        if k, ok := legacySummaryPageKey(items[i].Key); ok { items[i].Key = k }
+    }
+    return items, nil
+}
+
+func saveOutbox(base string, items []OutboxItem) error {
+    if items == nil { items = []OutboxItem{} }
+    b, err := json.MarshalIndent(items, "", "  ")
+    if err != nil { return err }
+    return writeFileAtomic(outboxPath(base), b)
+}
+
+// outboxBackoff returns the delay before retry number attempts+1.
+func outboxBackoff(attempts int) time.Duration {
+    d := outboxBaseBackoff
+    for i := 1; i < attempts && d < outboxMaxBackoff; i++ {
+        d *= 2
+    }
+    if d > outboxMaxBackoff { d = outboxMaxBackoff }
+    return d
+}
+
+// outboxRetryDelay is the backoff for attempts, extended to the delay Discord
+// asked for when the failure was a rate limit.
+func outboxRetryDelay(attempts int, failure error) time.Duration {
+    d := outboxBackoff(attempts)
+    if ra := discordRetryAfter(failure); ra > d { d = ra }
+    return d
+}
+
+// outboxPending returns the queued item for key, if any.
+func outboxPending(base, key string) (OutboxItem, bool) {
+    items, err := loadOutbox(base)
+    if err != nil { return OutboxItem{}, false }
+    for _, it := range items {
+        if it.Key == key { return it, true }
+    }
+    return OutboxItem{}, false
+}
+
+// queueDiscordSummary stores payload for key, replacing any queued payload.
+// A non-nil failure counts as a delivery attempt and schedules the next retry.
+func queueDiscordSummary(base, key string, payload DiscordMessage, failure error) error {
+    return queueOutboxItem(base, OutboxItem{Key: key, Payload: payload}, failure)
+}
+
+// queueOutboxItem stores the payload of it, replacing that of a queued item
+// with the same key. A non-nil failure counts as a delivery attempt and
+// schedules the next retry.
+func queueOutboxItem(base string, it OutboxItem, failure error) error {
+    items, err := loadOutbox(base)
+    if err != nil {
+        _ = appendAppLog(base, "warn: discord outbox unreadable, starting a new one: "+err.Error())
+        items = []OutboxItem{}
+    }
+    now := time.Now().UTC()
+    idx := -1
+    for i := range items {
+        if items[i].Key == it.Key { idx = i; break }
+    }
+    if idx < 0 {
+        items = append(items, OutboxItem{Key: it.Key, QueuedAt: now.Format(time.RFC3339), NextAttemptAt: now.Format(time.RFC3339)})
+        idx = len(items) - 1
+    }
+    q := &items[idx]
+    q.Target, q.URL, q.Payload, q.Slack, q.Webhook = it.Target, it.URL, it.Payload, it.Slack, it.Webhook
+    q.UpdatedAt = now.Format(time.RFC3339)
+    if failure != nil {
+        q.Attempts++
+        q.LastError = failure.Error()
+        q.NextAttemptAt = now.Add(outboxRetryDelay(q.Attempts, failure)).Format(time.RFC3339)
+    }
+    return saveOutbox(base, items)
+}
+
+// outboxHasDue reports whether any item is ready for a retry (read without the lock).
+func outboxHasDue(base string, now time.Time) bool {
+    items, err := loadOutbox(base)
+    if err != nil { return false }
+    for _, it := range items {
+        if outboxDue(it, now) { return true }
+    }
+    return false
+}
+
+func outboxDue(it OutboxItem, now time.Time) bool {
+    at, err := time.Parse(time.RFC3339, it.NextAttemptAt)
+    return err != nil || !at.After(now)
+}
+
+// flushOutbox sends queued items (all of them when force, otherwise only those
+// whose backoff has elapsed). Returns the number sent and still queued.
+func flushOutbox(base string, force bool) (int, int, error) {
+    return flushOutboxItems(base, force, nil)
+}
+
+// flushOutboxItems is flushOutbox limited to the items match accepts (nil:
+// all). Webhook payloads of one URL are sent in order: after a failure the
+// later ones wait for the next flush.
+func flushOutboxItems(base string, force bool, match func(OutboxItem) bool) (int, int, error) {
+    items, err := loadOutbox(base)
+    if err != nil { return 0, 0, err }
+    if len(items) == 0 { return 0, 0, nil }
+    now := time.Now().UTC()
+    sent := 0
+    rest := make([]OutboxItem, 0, len(items))
+    blocked := map[string]bool{} // webhook URLs with an earlier item still queued
+    for _, it := range items {
+        if (match != nil && !match(it)) || (!force && !outboxDue(it, now)) || (it.Target == outboxWebhook && blocked[it.URL]) {
+            if it.Target == outboxWebhook { blocked[it.URL] = true }
+            rest = append(rest, it)
+            continue
+        }
+        if it.Target == outboxWebhook {
+            err := sendQueuedWebhook(base, it)
+            switch {
+            case err == nil:
+                sent++
+                _ = appendAppLog(base, fmt.Sprintf("info: webhook sent (outbox: id=%s attempts=%d url=%s)", it.Webhook.ID, it.Attempts, redactURL(it.URL)))
+            case !webhookRetryable(err) || it.Attempts+1 >= webhookMaxAttempts:
+                _ = appendAppLog(base, fmt.Sprintf("warn: webhook dropped after %d attempts: id=%s url=%s: %s", it.Attempts+1, it.Webhook.ID, redactURL(it.URL), err.Error()))
+            default:
+                it.Attempts++
+                it.LastError = err.Error()
+                it.NextAttemptAt = now.Add(outboxBackoff(it.Attempts)).Format(time.RFC3339)
+                it.UpdatedAt = now.Format(time.RFC3339)
+                rest = append(rest, it)
+                blocked[it.URL] = true
+                _ = appendAppLog(base, fmt.Sprintf("warn: webhook outbox retry failed: id=%s attempts=%d url=%s: %s", it.Webhook.ID, it.Attempts, redactURL(it.URL), err.Error()))
+            }
+            continue
+        }
+        service, mode, err := "discord", "", error(nil)
+        if it.Target == outboxSlack {
+            service = "slack"
+            mode, err = sendQueuedSlack(base, it)
+        } else {
+            mode, err = sendDiscordSummary(base, it.Key, it.Payload)
+        }
+        if err != nil {
+            it.Attempts++
+            it.LastError = err.Error()
+            it.NextAttemptAt = now.Add(outboxRetryDelay(it.Attempts, err)).Format(time.RFC3339)
+            it.UpdatedAt = now.Format(time.RFC3339)
+            rest = append(rest, it)
+            _ = appendAppLog(base, fmt.Sprintf("warn: %s outbox retry failed: key=%s attempts=%d: %s", service, it.Key, it.Attempts, err.Error()))
+            continue
+        }
+        sent++
+        _ = appendAppLog(base, fmt.Sprintf("info: %s %s upsert ok (outbox: key=%s attempts=%d)", service, mode, it.Key, it.Attempts))
+    }
+    if err := saveOutbox(base, rest); err != nil { return sent, len(rest), err }
+    return sent, len(rest), nil
+}
+
+// runOutboxWorker retries due items until the process exits. It runs once
+// immediately so updates queued before a restart are picked up. Expired
+// per-win announcements are deleted here as well.
+func runOutboxWorker(base string) {
+    t := time.NewTicker(outboxPollInterval)
+    defer t.Stop()
+    for {
+        if outboxHasDue(base, time.Now()) {
+            if err := withNotifyLock(base, func() error {
+                _, _, err := flushOutbox(base, false)
+                return err
+            }); err != nil {
+                _ = appendAppLog(base, "warn: discord outbox flush failed: "+err.Error())
+            }
+        }
+        if announceHasExpired(base, time.Now()) {
+            if err := withNotifyLock(base, func() error { return deleteExpiredAnnouncements(base) }); err != nil {
+                _ = appendAppLog(base, "warn: discord announce cleanup failed: "+err.Error())
+            }
+        }
+        <-t.C
+    }
+}
+
+// queueWebhook stores a webhook payload that could not be delivered; failure
+// counts as the first attempt.
+func queueWebhook(base, url string, p webhookPayload, failure error) error {
+    return queueOutboxItem(base, OutboxItem{Key: webhookOutboxKey(url, p.ID), Target: outboxWebhook, URL: url, Webhook: &p}, failure)
+}
+
+// webhookQueued reports whether payloads for url are waiting in the outbox.
+func webhookQueued(base, url string) bool {
+    items, err := loadOutbox(base)
+    if err != nil { return false }
+    for _, it := range items {
+        if it.Target == outboxWebhook && it.URL == url { return true }
+    }
+    return false
+}
+
+// archiveQueuedSummaries marks queued summaries of previous sessions with the
+// archive header so a late retry does not undo the archive edit.
+func archiveQueuedSummaries(base, newSessionID, header string) error {
+    items, err := loadOutbox(base)
+    if err != nil || len(items) == 0 { return err }
+    newKey := "__SUMMARY__" + "::" + newSessionID
+    changed := false
+    for i := range items {
+        if !strings.HasPrefix(items[i].Key, "__SUMMARY__") || summaryKeyOf(items[i].Key, newKey) { continue }
+        if len(items[i].Payload.Embeds) == 0 { continue }
+        items[i].Payload.Embeds[0].Title = header
+        items[i].Payload.Embeds[0].Color = archivedColor
+        changed = true
+    }
+    if !changed { return nil }
+    return saveOutbox(base, items)
+}
+
+// dropOutboxItems removes queued updates whose key matches (e.g. summary pages
+// that no longer exist).
+func dropOutboxItems(base string, match func(key string) bool) error {
+    items, err := loadOutbox(base)
+    if err != nil { return err }
+    rest := make([]OutboxItem, 0, len(items))
+    for _, it := range items {
+        if !match(it.Key) { rest = append(rest, it) }
+    }
+    if len(rest) == len(items) { return nil }
+    return saveOutbox(base, rest)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "time"
+)
+
+// Recovery of a corrupted current.json.
+// loadState reports invalid JSON (a truncated or badly hand-edited file) as
+// errStateCorrupted instead of starting over from an empty state. Commands that
+// write the state load it with loadStateForWrite, which moves the bad file to
+// data/quarantine/current.<time>.json and restores the newest valid source:
+//   - the temp file of an interrupted write (data/.current.json.tmp)
+//   - the event journal (data/journal.jsonl, replayed like `gacha rebuild`)
+//   - the latest readable backup (backups/*.json)
+// The recovery is logged as an error and the command fails with
+// errStateRecovered so the caller notices. A win (applyUpdate) is still applied
+// on top of the recovered state, since the debounce and the journal already
+// count it; other changes are not applied and can simply be run again.
+
+var (
+    errStateCorrupted = errors.New("current.json is corrupted")
+    errStateRecovered = errors.New("current.json was corrupted and has been recovered")
+)
+
+func quarantineDir(base string) string { return filepath.Join(base, "data", "quarantine") }
+
+func stateTempPath(base string) string {
+    return filepath.Join(filepath.Dir(statePath(base)), "."+filepath.Base(statePath(base))+".tmp")
+}
+
+// quarantinePath returns an unused data/quarantine/<stem>[-N]<ext>.
+func quarantinePath(base, stem, ext string) string {
+    p := filepath.Join(quarantineDir(base), stem+ext)
+    for i := 2; ; i++ {
+        if _, err := os.Stat(p); os.IsNotExist(err) { return p }
+        p = filepath.Join(quarantineDir(base), fmt.Sprintf("%s-%d%s", stem, i, ext))
+    }
+}
+
+type recoverySource struct {
+    Name  string // "temp file", "journal", "backup <name>"
+    At    time.Time
+    State State
+}
+
+// loadStateForWrite loads current.json for a change; callers hold the data lock.
+func loadStateForWrite(base string) (State, error) {
+    st, err := loadStateRecovering(base)
+    if errors.Is(err, errStateRecovered) { return State{}, fmt.Errorf("%w; the change was not applied, run it again", err) }
+    return st, err
+}
+
+// loadStateRecovering loads current.json, recovering it when corrupted. After a
+// recovery it returns the recovered state together with an error wrapping
+// errStateRecovered. Callers hold the data lock.
+func loadStateRecovering(base string) (State, error) {
+    st, err := loadState(base)
+    if err == nil || !errors.Is(err, errStateCorrupted) { return st, err }
+    src, qpath, rerr := recoverState(base, err)
+    if rerr != nil { return State{}, fmt.Errorf("%w (recovery failed: %v)", err, rerr) }
+    rerr = fmt.Errorf("%w (quarantined: %s, restored from: %s)", errStateRecovered, qpath, src)
+    st, err = loadState(base)
+    if err != nil { return State{}, fmt.Errorf("%w; reloading it failed: %v", rerr, err) }
+    return st, rerr
+}
+
+// recoverState quarantines the corrupted current.json and writes the newest
+// valid recovery source in its place. Callers hold the data lock.
+func recoverState(base string, cause error) (string, string, error) {
+    if err := os.MkdirAll(quarantineDir(base), 0o755); err != nil { return "", "", err }
+    ts := time.Now().Format("2006-01-02_150405")
+    qpath := quarantinePath(base, "current."+ts, ".json")
+    if _, err := os.Stat(statePath(base)); err == nil {
+        if err := os.Rename(statePath(base), qpath); err != nil { return "", "", err }
+    } else {
+        qpath = "(no current.json)"
+    }
+    srcs := recoverySources(base)
+    // the temp file has been read (or is unreadable too); keep it out of the way
+    if _, err := os.Stat(stateTempPath(base)); err == nil {
+        _ = os.Rename(stateTempPath(base), quarantinePath(base, "current."+ts, ".tmp"))
+    }
+    if len(srcs) == 0 {
+        _ = appendAppLog(base, fmt.Sprintf("error: %v; quarantined to %s; no valid temp file, journal or backup found, starting empty", cause, qpath))
+        return "nothing (empty state)", qpath, nil
+    }
+    // newest first (whole seconds, like the journal); on a tie the order of
+    // recoverySources decides, e.g. the journal over the backup taken by a reset
+    sort.SliceStable(srcs, func(i, j int) bool { return srcs[i].At.After(srcs[j].At) })
+    src := srcs[0]
+    if err := saveState(base, src.State); err != nil { return "", qpath, err }
+    if err := genDataJS(base); err != nil {
+        _ = appendAppLog(base, "warn: gen data.js after recovery failed: "+err.Error())
+    }
+    _ = appendAppLog(base, fmt.Sprintf("error: %v; quarantined to %s; restored from %s (users=%d, as of %s)", cause, qpath, src.Name, len(src.State.Users), src.At.Format(time.RFC3339)))
+    return src.Name, qpath, nil
+}
+
+// recoverySources lists the readable candidates in order of preference.
+func recoverySources(base string) []recoverySource {
+    var out []recoverySource
+    if b, err := os.ReadFile(stateTempPath(base)); err == nil {
+        fi, serr := os.Stat(stateTempPath(base))
+        if st, err := decodeState(b); serr == nil && err == nil {
+            out = append(out, recoverySource{Name: "temp file", At: fi.ModTime().Truncate(time.Second), State: st})
+        }
+    }
+    if entries, skipped, err := readJournal(journalPath(base)); err == nil && len(entries) > 0 {
+        st, _ := replayJournal(entries, time.Time{}, loadRewardRules(base, loadSettings(base)))
+        at, _ := time.Parse(time.RFC3339, entries[len(entries)-1].At)
+        name := "journal"
+        if skipped > 0 { name += fmt.Sprintf(" (%d unreadable lines skipped)", skipped) }
+        out = append(out, recoverySource{Name: name, At: at, State: st})
+    }
+    if names, err := listBackups(base); err == nil {
+        for _, n := range names {
+            p := filepath.Join(backupDir(base), n)
+            b, err := readBackupFile(p)
+            if err != nil { continue }
+            st, err := decodeState(b)
+            if err != nil { continue }
+            // the name carries the backup time; compressing rewrites the file later
+            out = append(out, recoverySource{Name: "backup " + n, At: backupTime(backupDir(base), n).Truncate(time.Second), State: st})
+            break
+        }
+    }
+    return out
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "unicode"
+)
+
+// Reward rule engine.
+// Rewards are declared in setting.json ("rewards") with a condition over the win
+// counters, e.g. "hit >= 3 || jackpot >= 1". The qualifying reward with the
+// highest priority becomes User.Present; all qualifying names go to User.Rewards.
+
+type RewardRule struct {
+    Name          string `json:"name"`
+    Condition     string `json:"condition"`
+    Priority      int    `json:"priority"`
+    Label         string `json:"label,omitempty"`
+    DiscordHeader string `json:"discordHeader,omitempty"`
+}
+
+type rewardRule struct {
+    RewardRule
+    eval func(vars map[string]int) int
+}
+
+func defaultRewardRules() []RewardRule {
+    return []RewardRule{
+        {Name: "Gif", Condition: "hit >= 3 || jackpot >= 1", Priority: 20, Label: "Gif"},
+        {Name: "Illustration", Condition: "hit >= 1", Priority: 10, Label: "イラスト"},
+    }
+}
+
+// compileRewardRules parses every condition and orders rules by priority (desc).
+// Conditions may only use the given counters (see conditionCounters).
+func compileRewardRules(defs []RewardRule, counters map[string]bool) ([]rewardRule, error) {
+    out := make([]rewardRule, 0, len(defs))
+    seen := map[string]bool{}
+    for i, d := range defs {
+        d.Name = strings.TrimSpace(d.Name)
+        if d.Name == "" {
+            return nil, fmt.Errorf("rewards[%d]: name is empty", i)
+        }
+        if seen[d.Name] {
+            return nil, fmt.Errorf("rewards[%d]: duplicate name %q", i, d.Name)
+        }
+        seen[d.Name] = true
+        fn, err := parseCondition(d.Condition, counters)
+        if err != nil {
+            return nil, fmt.Errorf("rewards[%d] %q: %w", i, d.Name, err)
+        }
+        if strings.TrimSpace(d.Label) == "" { d.Label = d.Name }
+        out = append(out, rewardRule{RewardRule: d, eval: fn})
+    }
+    sort.SliceStable(out, func(i, j int) bool { return out[i].Priority > out[j].Priority })
+    return out, nil
+}
+
+// rulesFromSettings compiles the configured rules. When none are configured or
+// they are invalid, the built-in Gif/Illustration rules are returned (with the error).
+func rulesFromSettings(cfg Settings) ([]rewardRule, error) {
+    var err error
+    if len(cfg.Rewards) > 0 {
+        var rules []rewardRule
+        if rules, err = compileRewardRules(cfg.Rewards, conditionCounters(cfg)); err == nil {
+            return rules, nil
+        }
+    }
+    rules, _ := compileRewardRules(defaultRewardRules(), conditionCounters(cfg))
+    return rules, err
+}
+
+// conditionCounters lists the counter names conditions may use: hit, jackpot
+// and the counters of the configured tiers (lower case).
+func conditionCounters(cfg Settings) map[string]bool {
+    out := map[string]bool{"hit": true, "jackpot": true}
+    tiers, _ := tiersFromSettings(cfg)
+    for _, t := range tiers {
+        out[strings.ToLower(t.Counter)] = true
+    }
+    return out
+}
+
+// loadRewardRules is rulesFromSettings that logs invalid configuration.
+func loadRewardRules(base string, cfg Settings) []rewardRule {
+    rules, err := rulesFromSettings(cfg)
+    if err != nil {
+        _ = appendAppLog(base, "warn: invalid rewards in setting.json, using defaults: "+err.Error())
+    }
+    return rules
+}
+
+// userCounters exposes the per-tier counters to conditions (names are
+// case-insensitive; hit/jackpot always exist).
+func userCounters(u User) map[string]int {
+    vars := map[string]int{"hit": u.Hit, "jackpot": u.Jackpot}
+    for k, v := range u.Counts {
+        vars[strings.ToLower(k)] = v
+    }
+    return vars
+}
+
+// evaluateRewards returns the names of all rewards u qualifies for, in priority order.
+func evaluateRewards(u User, rules []rewardRule) []string {
+    vars := userCounters(u)
+    var names []string
+    for _, r := range rules {
+        if r.eval(vars) != 0 {
+            names = append(names, r.Name)
+        }
+    }
+    return names
+}
+
+func hasReward(names []string, name string) bool {
+    for _, n := range names {
+        if n == name { return true }
+    }
+    return false
+}
+
+func findRewardRule(rules []rewardRule, name string) (rewardRule, bool) {
+    for _, r := range rules {
+        if r.Name == name { return r, true }
+    }
+    return rewardRule{}, false
+}
+
+// doRecompute re-applies the current rules to every user in current.json.
+func doRecompute(base string) (int, error) {
+    var st State
+    changed := 0
+    err := withLock(base, func() error {
+        var err error
+        st, err = loadStateForWrite(base)
+        if err != nil { return err }
+        rules := loadRewardRules(base, loadSettings(base))
+        for i := range st.Users {
+            before := st.Users[i].Present + "|" + strings.Join(st.Users[i].Rewards, ",")
+            recomputeUser(&st.Users[i], rules)
+            if st.Users[i].Present+"|"+strings.Join(st.Users[i].Rewards, ",") != before { changed++ }
+        }
+        if err := saveState(base, st); err != nil { return err }
+        return genDataJS(base)
+    })
+    if err != nil { return 0, err }
+    notifyChange(base, ChangeEvent{Type: notifyRecompute}, st)
+    return changed, appendAppLog(base, fmt.Sprintf("recompute: users=%d changed=%d", len(st.Users), changed))
+}
+
+// ---------- condition expressions ----------
+// Grammar: or := and ('||' and)* ; and := cmp ('&&' cmp)* ;
+// cmp := sum (('>='|'<='|'>'|'<'|'=='|'!=') sum)? ; sum := unary (('+'|'-') unary)* ;
+// unary := '!' unary | '-' unary | number | ident | '(' or ')'.
+// Identifiers are counter names (case-insensitive); names not in counters are
+// rejected so a typo does not silently evaluate to 0.
+
+type condParser struct {
+    toks     []string
+    pos      int
+    counters map[string]bool
+}
+
+func parseCondition(src string, counters map[string]bool) (func(map[string]int) int, error) {
+    toks, err := tokenizeCondition(src)
+    if err != nil { return nil, err }
+    if len(toks) == 0 { return nil, errors.New("condition is empty") }
+    p := &condParser{toks: toks, counters: counters}
+    fn, err := p.parseOr()
+    if err != nil { return nil, err }
+    if p.pos < len(p.toks) {
+        return nil, fmt.Errorf("unexpected %q", p.toks[p.pos])
+    }
+    return fn, nil
+}
+
+func tokenizeCondition(src string) ([]string, error) {
+    var toks []string
+    rs := []rune(src)
+    for i := 0; i < len(rs); {
+        c := rs[i]
+        switch {
+        case unicode.IsSpace(c):
+            i++
+        case unicode.IsDigit(c):
+            j := i
+            for j < len(rs) && unicode.IsDigit(rs[j]) { j++ }
+            toks = append(toks, string(rs[i:j]))
+            i = j
+        case unicode.IsLetter(c) || c == '_':
+            j := i
+            for j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j]) || rs[j] == '_') { j++ }
+            toks = append(toks, string(rs[i:j]))
+            i = j
+        default:
+            if i+1 < len(rs) {
+                two := string(rs[i : i+2])
+                switch two {
+                case ">=", "<=", "==", "!=", "&&", "||":
+                    toks = append(toks, two)
+                    i += 2
+                    continue
+                }
+            }
+            switch c {
+            case '>', '<', '!', '(', ')', '+', '-':
+                toks = append(toks, string(c))
+                i++
+            default:
+                return nil, fmt.Errorf("unexpected character %q", c)
+            }
+        }
+    }
+    return toks, nil
+}
+
+func (p *condParser) peek() string {
+    if p.pos < len(p.toks) { return p.toks[p.pos] }
+    return ""
+}
+
+func (p *condParser) parseOr() (func(map[string]int) int, error) {
+    l, err := p.parseAnd()
+    if err != nil { return nil, err }
+    for p.peek() == "||" {
+        p.pos++
+        r, err := p.parseAnd()
+        if err != nil { return nil, err }
+        a, b := l, r
+        l = func(v map[string]int) int { return b2i(a(v) != 0 || b(v) != 0) }
+    }
+    return l, nil
+}
+
+func (p *condParser) parseAnd() (func(map[string]int) int, error) {
+    l, err := p.parseCmp()
+    if err != nil { return nil, err }
+    for p.peek() == "&&" {
+        p.pos++
+        r, err := p.parseCmp()
+        if err != nil { return nil, err }
+        a, b := l, r
+        l = func(v map[string]int) int { return b2i(a(v) != 0 && b(v) != 0) }
+    }
+    return l, nil
+}
+
+func (p *condParser) parseCmp() (func(map[string]int) int, error) {
+    l, err := p.parseSum()
+    if err != nil { return nil, err }
+    op := p.peek()
+    switch op {
+    case ">=", "<=", ">", "<", "==", "!=":
+    default:
+        return l, nil
+    }
+    p.pos++
+    r, err := p.parseSum()
+    if err != nil { return nil, err }
+    a, b := l, r
+    switch op {
+    case ">=":
+        return func(v map[string]int) int { return b2i(a(v) >= b(v)) }, nil
+    case "<=":
+        return func(v map[string]int) int { return b2i(a(v) <= b(v)) }, nil
+    case ">":
+        return func(v map[string]int) int { return b2i(a(v) > b(v)) }, nil
+    case "<":
+        return func(v map[string]int) int { return b2i(a(v) < b(v)) }, nil
+    case "==":
+        return func(v map[string]int) int { return b2i(a(v) == b(v)) }, nil
+    default:
+        return func(v map[string]int) int { return b2i(a(v) != b(v)) }, nil
+    }
+}
+
+func (p *condParser) parseSum() (func(map[string]int) int, error) {
+    l, err := p.parseUnary()
+    if err != nil { return nil, err }
+    for p.peek() == "+" || p.peek() == "-" {
+        op := p.toks[p.pos]
+        p.pos++
+        r, err := p.parseUnary()
+        if err != nil { return nil, err }
+        a, b := l, r
+        if op == "+" {
+            l = func(v map[string]int) int { return a(v) + b(v) }
+        } else {
+            l = func(v map[string]int) int { return a(v) - b(v) }
+        }
+    }
+    return l, nil
+}
+
+func (p *condParser) parseUnary() (func(map[string]int) int, error) {
+    t := p.peek()
+    switch {
+    case t == "":
+        return nil, errors.New("unexpected end of condition")
+    case t == "!":
+        p.pos++
+        x, err := p.parseUnary()
+        if err != nil { return nil, err }
+        return func(v map[string]int) int { return b2i(x(v) == 0) }, nil
+    case t == "-":
+        p.pos++
+        x, err := p.parseUnary()
+        if err != nil { return nil, err }
+        return func(v map[string]int) int { return -x(v) }, nil
+    case t == "(":
+        p.pos++
+        x, err := p.parseOr()
+        if err != nil { return nil, err }
+        if p.peek() != ")" { return nil, errors.New("missing )") }
+        p.pos++
+        return x, nil
+    case unicode.IsDigit([]rune(t)[0]):
+        p.pos++
+        n, err := strconv.Atoi(t)
+        if err != nil { return nil, err }
+        return func(map[string]int) int { return n }, nil
+    case unicode.IsLetter([]rune(t)[0]) || t[0] == '_':
+        name := strings.ToLower(t)
+        if !p.counters[name] { return nil, fmt.Errorf("unknown counter %q", t) }
+        p.pos++
+        return func(v map[string]int) int { return v[name] }, nil
+    default:
+        return nil, fmt.Errorf("unexpected %q", t)
+    }
+}
+
+func b2i(b bool) int {
+    if b { return 1 }
+    return 0
+}
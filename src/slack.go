@@ -0,0 +1,333 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+)
+
+// Slack summary (slackEnabled).
+// Renders the same grouped summary as Discord with Block Kit. With a bot token
+// (SLACK_BOT_TOKEN + SLACK_CHANNEL_ID) the message is posted once per session
+// and then edited with chat.update; its ts is tracked in data/slack_map.json
+// (keys as in discord_map.json). An incoming webhook (SLACK_WEBHOOK_URL) cannot
+// edit messages, so it only posts the final summary of each session when the
+// session is reset. Failed posts are retried through the outbox (outbox.go).
+
+const (
+    slackSectionMax = 3000 // characters per section text
+    slackBlocksMax  = 50
+)
+
+var slackClient = &http.Client{Timeout: 10 * time.Second}
+
+type slackMapEntry struct {
+    TS       string `json:"ts"`
+    Archived bool   `json:"archived,omitempty"`
+}
+
+type slackMessage struct {
+    Channel string           `json:"channel,omitempty"`
+    TS      string           `json:"ts,omitempty"`
+    Text    string           `json:"text"`
+    Blocks  []map[string]any `json:"blocks"`
+}
+
+type slackAPIError struct {
+    Method string
+    Code   string
+}
+
+func (e *slackAPIError) Error() string { return "slack " + e.Method + " failed: " + e.Code }
+
+func slackMapPath(base string) string { return filepath.Join(base, "data", "slack_map.json") }
+
+func loadSlackMap(base string) (map[string]slackMapEntry, error) {
+    b, err := os.ReadFile(slackMapPath(base))
+    if err != nil {
+        if os.IsNotExist(err) { return map[string]slackMapEntry{}, nil }
+        return nil, err
+    }
+    m := map[string]slackMapEntry{}
+    if err := json.Unmarshal(b, &m); err != nil { return nil, err }
+    return m, nil
+}
+
+func saveSlackMap(base string, m map[string]slackMapEntry) error {
+    b, err := json.MarshalIndent(m, "", "  ")
+    if err != nil { return err }
+    return writeFileAtomic(slackMapPath(base), b)
+}
+
+func slackAPIBase(cfg Settings) string {
+    b := strings.TrimRight(strings.TrimSpace(cfg.SlackAPIBase), "/")
+    if b == "" { b = "https://slack.com/api" }
+    return b
+}
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// buildSlackSummary renders the summary groups as Block Kit blocks.
+func buildSlackSummary(st State, cfg Settings, title string) slackMessage {
+    blocks := []map[string]any{
+        {"type": "header", "text": map[string]any{"type": "plain_text", "text": truncateRunes(title, 150)}},
+    }
+    var sections []string
+    for _, g := range buildSummaryGroups(st, cfg) {
+        lines := make([]string, 0, len(g.Lines))
+        for _, l := range g.Lines {
+            lines = append(lines, l.Emoji+" "+slackEscaper.Replace(l.Ref)+" "+slackEscaper.Replace(l.Name))
+        }
+        sort.Strings(lines)
+        header := "*" + slackEscaper.Replace(g.Header) + "*"
+        body := "なし"
+        if len(lines) > 0 { body = strings.Join(lines, "\n") }
+        for i, c := range chunkLines(body, slackSectionMax-runeLen(header)-16) {
+            h := header
+            if i > 0 { h = "*" + slackEscaper.Replace(g.Header) + "（続き）*" }
+            sections = append(sections, h+"\n"+c)
+        }
+    }
+    for i, sec := range sections {
+        if len(blocks) >= slackBlocksMax-2 {
+            blocks = append(blocks, map[string]any{"type": "context", "elements": []map[string]any{{"type": "mrkdwn", "text": fmt.Sprintf("…ほか %d 件の見出しは省略", len(sections)-i)}}})
+            break
+        }
+        blocks = append(blocks, map[string]any{"type": "section", "text": map[string]any{"type": "mrkdwn", "text": sec}})
+    }
+    updated := st.UpdatedAt
+    if t, err := time.Parse(time.RFC3339, st.UpdatedAt); err == nil {
+        updated = fmt.Sprintf("<!date^%d^{date_short_pretty} {time}|%s>", t.Unix(), st.UpdatedAt)
+    }
+    blocks = append(blocks, map[string]any{"type": "context", "elements": []map[string]any{{"type": "mrkdwn", "text": "最終更新: " + updated}}})
+    return slackMessage{Text: title, Blocks: blocks}
+}
+
+// slackCall calls a Web API method with the bot token: a JSON POST, or a GET
+// with query arguments when payload is nil (read methods).
+func slackCall(cfg Settings, token, method string, payload any, out any) error {
+    name, _, _ := strings.Cut(method, "?")
+    var req *http.Request
+    var err error
+    if payload == nil {
+        req, err = http.NewRequest("GET", slackAPIBase(cfg)+"/"+method, nil)
+        if err != nil { return err }
+    } else {
+        b, err := json.Marshal(payload)
+        if err != nil { return err }
+        req, err = http.NewRequest("POST", slackAPIBase(cfg)+"/"+method, bytes.NewReader(b))
+        if err != nil { return err }
+        req.Header.Set("Content-Type", "application/json; charset=utf-8")
+    }
+    req.Header.Set("Authorization", "Bearer "+token)
+    resp, err := slackClient.Do(req)
+    if err != nil { return err }
+    defer resp.Body.Close()
+    if resp.StatusCode == http.StatusTooManyRequests {
+        return &slackAPIError{Method: name, Code: "ratelimited (retry after " + resp.Header.Get("Retry-After") + "s)"}
+    }
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return &slackAPIError{Method: name, Code: resp.Status}
+    }
+    var res struct{ OK bool `json:"ok"`; Error string `json:"error"` }
+    raw := new(bytes.Buffer)
+    if _, err := raw.ReadFrom(resp.Body); err != nil { return err }
+    if err := json.Unmarshal(raw.Bytes(), &res); err != nil { return err }
+    if !res.OK { return &slackAPIError{Method: name, Code: res.Error} }
+    if out != nil { return json.Unmarshal(raw.Bytes(), out) }
+    return nil
+}
+
+func slackWebhookPost(webhookURL string, msg slackMessage) error {
+    b, err := json.Marshal(msg)
+    if err != nil { return err }
+    req, err := http.NewRequest("POST", webhookURL, bytes.NewReader(b))
+    if err != nil { return err }
+    req.Header.Set("Content-Type", "application/json")
+    resp, err := slackClient.Do(req)
+    if err != nil { return err }
+    defer resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return fmt.Errorf("slack webhook post failed: %s", resp.Status)
+    }
+    return nil
+}
+
+// slackOutboxKey is the outbox key of a bot summary (summary key as in
+// slack_map.json) or of a session-end webhook post (webhook::<backup>).
+func slackOutboxKey(key string) string { return "__SLACK__::" + key }
+
+func slackBotCredentials() (token, channel string) {
+    return strings.TrimSpace(os.Getenv("SLACK_BOT_TOKEN")), strings.TrimSpace(os.Getenv("SLACK_CHANNEL_ID"))
+}
+
+// upsertSlackSummary posts or edits the summary stored under key (bot token only).
+func upsertSlackSummary(base string, cfg Settings, key string, msg slackMessage) error {
+    token, channel := slackBotCredentials()
+    if token == "" || channel == "" { return errNoSlackCredentials }
+    m, err := loadSlackMap(base)
+    if err != nil { return err }
+    msg.Channel = channel
+    if e := m[key]; e.TS != "" {
+        msg.TS = e.TS
+        err := slackCall(cfg, token, "chat.update", msg, nil)
+        if err == nil { return nil }
+        // repost only when the message is gone
+        if ae, ok := err.(*slackAPIError); !ok || ae.Code != "message_not_found" { return err }
+        msg.TS = ""
+    }
+    var res struct{ TS string `json:"ts"` }
+    if err := slackCall(cfg, token, "chat.postMessage", msg, &res); err != nil { return err }
+    m[key] = slackMapEntry{TS: res.TS}
+    return saveSlackMap(base, m)
+}
+
+// deliverSlackSummary upserts the summary, or queues it in the outbox when a
+// retry is already pending or the call fails (same flow as Discord).
+func deliverSlackSummary(base string, cfg Settings, key string, msg slackMessage) {
+    okey := slackOutboxKey(key)
+    it, pending := outboxPending(base, okey)
+    if pending && !outboxDue(it, time.Now()) {
+        if err := queueOutboxItem(base, OutboxItem{Key: okey, Target: outboxSlack, Slack: &msg}, nil); err != nil {
+            _ = appendAppLog(base, "warn: slack outbox write failed: "+err.Error())
+            return
+        }
+        _ = appendAppLog(base, "info: slack summary queued (retry pending)")
+        return
+    }
+    if err := upsertSlackSummary(base, cfg, key, msg); err != nil {
+        _ = appendAppLog(base, "warn: slack bot notify failed, queued for retry: "+err.Error())
+        if qerr := queueOutboxItem(base, OutboxItem{Key: okey, Target: outboxSlack, Slack: &msg}, err); qerr != nil {
+            _ = appendAppLog(base, "warn: slack outbox write failed: "+qerr.Error())
+        }
+        return
+    }
+    if pending {
+        if err := dropOutboxItems(base, func(k string) bool { return k == okey }); err != nil {
+            _ = appendAppLog(base, "warn: slack outbox write failed: "+err.Error())
+        }
+        _ = appendAppLog(base, fmt.Sprintf("info: slack bot upsert ok (summary, replaced outbox item after %d attempts)", it.Attempts))
+        return
+    }
+    _ = appendAppLog(base, "info: slack bot upsert ok (summary)")
+}
+
+// postSlackSessionEnd posts the final summary of the session ended by a reset
+// (webhook mode), read back from the backup the reset wrote.
+func postSlackSessionEnd(base string, cfg Settings, hook string, ev ChangeEvent) {
+    if ev.Backup == "" { return }
+    st, _, err := loadSnapshot(base, ev.Backup)
+    if err != nil {
+        _ = appendAppLog(base, "warn: slack webhook: cannot read "+ev.Backup+": "+err.Error())
+        return
+    }
+    msg := buildSlackSummary(st, cfg, buildArchiveHeader(cfg))
+    if err := slackWebhookPost(hook, msg); err != nil {
+        _ = appendAppLog(base, "warn: slack webhook notify failed, queued for retry: "+err.Error())
+        if qerr := queueOutboxItem(base, OutboxItem{Key: slackOutboxKey("webhook::" + ev.Backup), Target: outboxSlack, Slack: &msg}, err); qerr != nil {
+            _ = appendAppLog(base, "warn: slack outbox write failed: "+qerr.Error())
+        }
+        return
+    }
+    _ = appendAppLog(base, "info: slack webhook post ok (session end: "+ev.Backup+")")
+}
+
+// sendQueuedSlack retries an outbox item with the credentials configured now.
+func sendQueuedSlack(base string, it OutboxItem) (string, error) {
+    if it.Slack == nil { return "", fmt.Errorf("empty slack payload") }
+    key := strings.TrimPrefix(it.Key, slackOutboxKey(""))
+    if strings.HasPrefix(key, "webhook::") {
+        hook := strings.TrimSpace(os.Getenv("SLACK_WEBHOOK_URL"))
+        if hook == "" { return "webhook", errNoSlackCredentials }
+        return "webhook", slackWebhookPost(hook, *it.Slack)
+    }
+    return "bot", upsertSlackSummary(base, loadSettings(base), key, *it.Slack)
+}
+
+var errNoSlackCredentials = &slackAPIError{Method: "notify", Code: "no credentials"}
+
+// archiveOldSlackSummaries retitles the summaries of previous sessions with the
+// archive header (bot token only; needs the channels:history scope to read them).
+func archiveOldSlackSummaries(base string, cfg Settings, sessionID string) error {
+    token, channel := slackBotCredentials()
+    if token == "" || channel == "" { return nil }
+    m, err := loadSlackMap(base)
+    if err != nil { return err }
+    header := buildArchiveHeader(cfg)
+    newKey := summaryKeyFor(cfg, Session{ID: sessionID})
+    changed := false
+    for key, e := range m {
+        if e.Archived || e.TS == "" || key == newKey { continue }
+        var hist struct {
+            Messages []struct {
+                Text   string           `json:"text"`
+                Blocks []map[string]any `json:"blocks"`
+            } `json:"messages"`
+        }
+        q := url.Values{"channel": {channel}, "latest": {e.TS}, "inclusive": {"true"}, "limit": {"1"}}
+        if err := slackCall(cfg, token, "conversations.history?"+q.Encode(), nil, &hist); err != nil || len(hist.Messages) == 0 {
+            if err == nil { err = fmt.Errorf("message %s not found", e.TS) }
+            _ = appendAppLog(base, "warn: slack archive "+key+" failed: "+err.Error())
+            continue
+        }
+        blocks := hist.Messages[0].Blocks
+        if len(blocks) > 0 && blocks[0]["type"] == "header" {
+            blocks[0] = map[string]any{"type": "header", "text": map[string]any{"type": "plain_text", "text": truncateRunes(header, 150)}}
+        } else {
+            blocks = append([]map[string]any{{"type": "header", "text": map[string]any{"type": "plain_text", "text": truncateRunes(header, 150)}}}, blocks...)
+        }
+        msg := slackMessage{Channel: channel, TS: e.TS, Text: header, Blocks: blocks}
+        if err := slackCall(cfg, token, "chat.update", msg, nil); err != nil {
+            _ = appendAppLog(base, "warn: slack archive "+key+" failed: "+err.Error())
+            continue
+        }
+        e.Archived = true
+        m[key] = e
+        changed = true
+    }
+    if changed { return saveSlackMap(base, m) }
+    return nil
+}
+
+// slackNotifier mirrors the latest state into the Slack summary.
+type slackNotifier struct{}
+
+func (slackNotifier) Name() string { return "slack" }
+
+func (slackNotifier) Notify(base string, events []ChangeEvent, st State) error {
+    cfg := loadSettings(base)
+    token, channel := slackBotCredentials()
+    if token == "" || channel == "" {
+        hook := strings.TrimSpace(os.Getenv("SLACK_WEBHOOK_URL"))
+        if hook == "" {
+            _ = appendAppLog(base, "info: slack enabled but no credentials; skipping")
+            return nil
+        }
+        // a webhook cannot edit its message: post once per session, at its end
+        for _, ev := range events {
+            if ev.Type == journalReset { postSlackSessionEnd(base, cfg, hook, ev) }
+        }
+        return nil
+    }
+    onlyReset := true
+    for _, ev := range events {
+        if ev.Type != journalReset {
+            onlyReset = false
+        } else if cfg.DiscordArchiveOldSummary {
+            if err := archiveOldSlackSummaries(base, cfg, currentSessionID(base)); err != nil {
+                _ = appendAppLog(base, "warn: slack archive failed: "+err.Error())
+            }
+        }
+    }
+    if onlyReset { return nil }
+    sess, _ := ensureSession(base)
+    deliverSlackSummary(base, cfg, summaryKeyFor(cfg, sess), buildSlackSummary(st, cfg, summaryTitle(cfg)))
+    return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "strconv"
+    "strings"
+    "text/template"
+    "time"
+)
+
+// Discord summary templates (setting.json "discordTemplates").
+// Each part of the summary is a Go text/template; empty entries use the
+// built-in defaults below, which reproduce the classic layout. Templates are
+// validated at startup; a template that fails to parse or execute falls back
+// to its default (and is reported in app.log / `gacha discord preview`).
+//
+// Data available to each template:
+//   title, footer, color: .Title (discordTitle) .UpdatedAt .UserCount .Totals (counter -> sum)
+//   line:                 .User (all User fields: .Name .Hit .Jackpot .Counts .Status .Present
+//                         .HasReference .Rewards ...) .Emoji .Ref .Reward (.Name .Label .Priority)
+//                         .Mention (discordMentionInSummary, mentions.go)
+//   groupHeader, empty:   .Header (reward header) .Reward .Count
+//   announce, announceHighlight (per-win posts, announce.go):
+//                         .User .Tier .Counter .Jackpot .Crossed .Reward .Prev .Emoji .Ref
+//   deliverable (completion message, with the uploaded artwork when registered,
+//                         deliverables.go): .User .File .Mention (discordMentionOnDone)
+// Functions: escape (Discord markdown escape), join.
+
+type DiscordTemplates struct {
+    Title       string `json:"title,omitempty"`
+    Line        string `json:"line,omitempty"`
+    GroupHeader string `json:"groupHeader,omitempty"`
+    Empty       string `json:"empty,omitempty"`
+    Footer      string `json:"footer,omitempty"`
+    Color       string `json:"color,omitempty"` // #RRGGBB, 0xRRGGBB or decimal
+    Announce          string `json:"announce,omitempty"`
+    AnnounceHighlight string `json:"announceHighlight,omitempty"`
+    Deliverable       string `json:"deliverable,omitempty"`
+}
+
+func defaultDiscordTemplates() DiscordTemplates {
+    return DiscordTemplates{
+        Title:       `{{escape .Title}}`,
+        Line:        `{{.Emoji}} {{escape .Ref}} {{if .Mention}}{{.Mention}}{{else}}{{escape .User.Name}}{{end}}`,
+        GroupHeader: `{{escape .Header}}`,
+        Empty:       `なし`,
+        Footer:      `最終更新`,
+        Color:       `#10B981`, // Tailwind emerald-500
+        Announce:          `🎉 **{{escape .User.Name}}** さんが{{.Tier}}！（当たり{{.User.Hit}}回 / 大当たり{{.User.Jackpot}}回）`,
+        AnnounceHighlight: `{{if .Crossed}}🏆 **{{escape .User.Name}}** さんが「{{escape .Reward.Label}}」に到達！{{else}}🎊 **{{escape .User.Name}}** さんが{{.Tier}}！{{end}}（当たり{{.User.Hit}}回 / 大当たり{{.User.Jackpot}}回）`,
+        Deliverable:       `✅ {{if .Mention}}{{.Mention}}{{else}}**{{escape .User.Name}}**{{end}} さんの作品が完成しました！`,
+    }
+}
+
+type summaryData struct {
+    Title     string
+    UpdatedAt string
+    UserCount int
+    Totals    map[string]int
+}
+
+type lineData struct {
+    User    User
+    Emoji   string
+    Ref     string
+    Reward  RewardRule
+    Mention string // "<@id>" with discordMentionInSummary and a mapping, else ""
+}
+
+type groupData struct {
+    Header string
+    Reward RewardRule
+    Count  int
+}
+
+type summaryTemplate struct {
+    name string
+    t    *template.Template
+    def  *template.Template
+}
+
+type summaryTemplates struct {
+    title, line, groupHeader, empty, footer, color summaryTemplate
+    announce, announceHighlight, deliverable       summaryTemplate
+}
+
+var summaryTemplateFuncs = template.FuncMap{
+    "escape": escapeDiscordMarkdown,
+    "join":   strings.Join,
+}
+
+// compileDiscordTemplates parses the configured templates and test-runs them on
+// sample data. Invalid ones are replaced by their defaults and reported in err.
+func compileDiscordTemplates(cfg DiscordTemplates) (summaryTemplates, error) {
+    def := defaultDiscordTemplates()
+    var errs []string
+    parse := func(name, src, defSrc string, sample any) summaryTemplate {
+        d := template.Must(template.New(name).Funcs(summaryTemplateFuncs).Parse(defSrc))
+        st := summaryTemplate{name: name, t: d, def: d}
+        if strings.TrimSpace(src) == "" { return st }
+        t, err := template.New(name).Funcs(summaryTemplateFuncs).Option("missingkey=zero").Parse(src)
+        if err == nil {
+            err = t.Execute(&bytes.Buffer{}, sample)
+        }
+        if err != nil {
+            errs = append(errs, name+": "+err.Error())
+            return st
+        }
+        st.t = t
+        return st
+    }
+    sum := summaryData{Title: "集計（最新）", UpdatedAt: "2025-01-01T00:00:00Z", UserCount: 1, Totals: map[string]int{"hit": 1}}
+    rr := defaultRewardRules()[0]
+    line := lineData{User: User{Name: "sample", Hit: 1, Counts: map[string]int{"hit": 1}, Status: "none", Present: rr.Name, Rewards: []string{rr.Name}}, Emoji: "⏳", Ref: "[参考画像なし]", Reward: rr, Mention: "<@123456789012345678>"}
+    group := groupData{Header: "---" + rr.Label + "---", Reward: rr, Count: 1}
+    win := announceData{User: line.User, Tier: "大当たり", Counter: "jackpot", Jackpot: true, Crossed: true, Reward: rr, Emoji: line.Emoji, Ref: line.Ref}
+    out := summaryTemplates{
+        title:       parse("title", cfg.Title, def.Title, sum),
+        line:        parse("line", cfg.Line, def.Line, line),
+        groupHeader: parse("groupHeader", cfg.GroupHeader, def.GroupHeader, group),
+        empty:       parse("empty", cfg.Empty, def.Empty, group),
+        footer:      parse("footer", cfg.Footer, def.Footer, sum),
+        color:       parse("color", cfg.Color, def.Color, sum),
+        announce:          parse("announce", cfg.Announce, def.Announce, win),
+        announceHighlight: parse("announceHighlight", cfg.AnnounceHighlight, def.AnnounceHighlight, win),
+        deliverable:       parse("deliverable", cfg.Deliverable, def.Deliverable, deliverableData{User: line.User, File: "sample.png", Mention: line.Mention}),
+    }
+    if c := out.color; c.t != c.def {
+        if _, err := parseColor(c.render(sum)); err != nil {
+            errs = append(errs, "color: "+err.Error())
+            out.color.t = c.def
+        }
+    }
+    if len(errs) > 0 { return out, errors.New(strings.Join(errs, "; ")) }
+    return out, nil
+}
+
+// render executes the template, falling back to the default on error.
+func (s summaryTemplate) render(data any) string {
+    var buf bytes.Buffer
+    if err := s.t.Execute(&buf, data); err != nil {
+        buf.Reset()
+        _ = s.def.Execute(&buf, data)
+    }
+    return strings.TrimSpace(buf.String())
+}
+
+func parseColor(s string) (int, error) {
+    s = strings.TrimSpace(s)
+    var v int64
+    var err error
+    switch {
+    case strings.HasPrefix(s, "#"):
+        v, err = strconv.ParseInt(s[1:], 16, 32)
+    case strings.HasPrefix(strings.ToLower(s), "0x"):
+        v, err = strconv.ParseInt(s[2:], 16, 32)
+    default:
+        v, err = strconv.ParseInt(s, 10, 32)
+    }
+    if err != nil || v < 0 || v > 0xFFFFFF {
+        return 0, fmt.Errorf("invalid color %q (use #RRGGBB)", s)
+    }
+    return int(v), nil
+}
+
+// previewDiscordSummary renders the summary of the current state (or sample
+// users) without sending it. The returned error reports invalid templates; the
+// preview itself is still written using the defaults for those parts.
+func previewDiscordSummary(base string, w io.Writer, asJSON, sample bool) error {
+    cfg := loadSettings(base)
+    _, terr := compileDiscordTemplates(cfg.DiscordTemplates)
+    st, _ := loadState(base)
+    if sample {
+        st = sampleState(cfg)
+    }
+    mentions := summaryMentions(base, cfg)
+    if sample { mentions = nil }
+    embeds := buildSummaryEmbeds(st, cfg, mentions)
+    if asJSON {
+        b, err := json.MarshalIndent(embeds, "", "  ")
+        if err != nil { return err }
+        fmt.Fprintln(w, string(b))
+        return terr
+    }
+    for i, e := range embeds {
+        if i > 0 { fmt.Fprintln(w, "----------") }
+        fmt.Fprintf(w, "# %s  (color #%06X)\n", e.Title, e.Color)
+        for _, f := range e.Fields {
+            fmt.Fprintf(w, "\n[%s]\n%s\n", f.Name, f.Value)
+        }
+        if e.Footer != nil { fmt.Fprintf(w, "\n-- %s %s\n", e.Footer.Text, e.Timestamp) }
+    }
+    return terr
+}
+
+// sampleState is a small state covering each status and reference flag.
+func sampleState(cfg Settings) State {
+    now := time.Now().UTC().Format(time.RFC3339)
+    rules, _ := rulesFromSettings(cfg)
+    st := State{UpdatedAt: now}
+    add := func(name string, hit, jackpot int, status string, ref bool) {
+        u := User{Name: name, Hit: hit, Jackpot: jackpot, Counts: map[string]int{"hit": hit, "jackpot": jackpot}, Status: status, Done: status == "done", HasReference: ref}
+        if rw := evaluateRewards(u, rules); len(rw) > 0 {
+            u.Present = rw[0]
+            u.Rewards = rw
+        }
+        st.Users = append(st.Users, u)
+    }
+    add("sample_a", 1, 0, "none", false)
+    add("sample_b", 2, 0, "progress", true)
+    add("sample_c", 0, 1, "done", true)
+    add("sample_d", 3, 0, "none", false)
+    return st
+}
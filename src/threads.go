@@ -0,0 +1,191 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+)
+
+// Discord thread per session (discordThreadPerSession).
+// Bot: once the summary of a session is posted, a thread is started from it.
+// Webhook: threads can only be created in forum channels; the summary is posted
+// as a new forum post (thread_name) and every later webhook call for the
+// session passes thread_id. Per-win announcements and deliverables are posted
+// inside the thread. The thread ID is kept in data/session.json (forum threads
+// also in discord_map.json as __THREAD__::<session>, so the summaries of past
+// sessions stay reachable); when the next session starts the previous thread
+// is archived and locked (needs the bot token with Manage Threads).
+
+const discordThreadAutoArchiveMin = 10080 // 7 days: stays open for the whole session
+
+func loadSession(base string) (Session, bool) {
+    b, err := os.ReadFile(sessionPath(base))
+    if err != nil { return Session{}, false }
+    var s Session
+    if json.Unmarshal(b, &s) != nil || s.ID == "" { return Session{}, false }
+    return s, true
+}
+
+func saveSession(base string, s Session) error {
+    b, err := json.MarshalIndent(s, "", "  ")
+    if err != nil { return err }
+    return writeFileAtomic(sessionPath(base), b)
+}
+
+// setSessionThread records the thread of session sid under a brief data lock;
+// nothing is written when a reset started another session meanwhile.
+func setSessionThread(base, sid, threadID, via string) error {
+    return withLock(base, func() error {
+        s, ok := loadSession(base)
+        if !ok || s.ID != sid { return nil }
+        s.ThreadID, s.ThreadVia = threadID, via
+        return saveSession(base, s)
+    })
+}
+
+// currentThread returns the thread of the current session ("" if none).
+func currentThread(base string) string {
+    s, _ := loadSession(base)
+    return s.ThreadID
+}
+
+func forumThreadKey(sessionID string) string { return "__THREAD__::" + sessionID }
+
+// summarySessionID returns the session of a per-session summary key or one of
+// its pages ("" for the legacy __SUMMARY__ key and other entries).
+func summarySessionID(key string) string {
+    rest, ok := strings.CutPrefix(key, "__SUMMARY__::")
+    if !ok { return "" }
+    sid, _, _ := strings.Cut(rest, summaryPageSep)
+    return sid
+}
+
+// summaryThread returns the thread a summary message lives in: only forum
+// threads created through the webhook contain the summary itself.
+func summaryThread(base, key string) string {
+    sid := summarySessionID(key)
+    if sid == "" { return "" }
+    if m, err := loadDiscordMap(base); err == nil && m[forumThreadKey(sid)] != "" { return m[forumThreadKey(sid)] }
+    s, ok := loadSession(base)
+    if !ok || s.ThreadVia != "webhook" || s.ID != sid { return "" }
+    return s.ThreadID
+}
+
+// webhookThreadWanted reports whether posting the summary under key should
+// create the session's forum thread.
+func webhookThreadWanted(base, key string) (Session, bool) {
+    cfg := loadSettings(base)
+    if !cfg.DiscordThreadPerSession || !cfg.DiscordNewMessagePerSession { return Session{}, false }
+    s, ok := loadSession(base)
+    if !ok || s.ThreadID != "" || key != "__SUMMARY__::"+s.ID { return Session{}, false }
+    return s, true
+}
+
+func discordThreadName(cfg Settings, s Session) string {
+    started := s.StartedAt
+    if t, err := time.Parse(time.RFC3339, s.StartedAt); err == nil {
+        started = t.In(time.Local).Format("2006/01/02 15:04")
+    }
+    return truncateRunes(summaryTitle(cfg)+" "+started, 100)
+}
+
+// ensureSessionThread starts the session's thread from the summary message
+// (bot only; the webhook creates it with the first post). Callers hold the
+// notify lock.
+func ensureSessionThread(base, summaryKey string) {
+    cfg := loadSettings(base)
+    if !cfg.DiscordThreadPerSession || !cfg.DiscordNewMessagePerSession { return }
+    token := strings.TrimSpace(os.Getenv("DISCORD_BOT_TOKEN"))
+    channelID := strings.TrimSpace(os.Getenv("DISCORD_CHANNEL_ID"))
+    if token == "" || channelID == "" { return }
+    s, ok := loadSession(base)
+    if !ok || s.ThreadID != "" || summaryKey != "__SUMMARY__::"+s.ID { return }
+    m, _ := loadDiscordMap(base)
+    mid := m[summaryKey]
+    if mid == "" { return }
+    id, err := discordStartThread(token, channelID, mid, discordThreadName(cfg, s))
+    if err != nil {
+        _ = appendAppLog(base, "warn: discord thread create failed: "+err.Error())
+        return
+    }
+    if err := setSessionThread(base, s.ID, id, "bot"); err != nil {
+        _ = appendAppLog(base, "warn: save session.json failed: "+err.Error())
+        return
+    }
+    _ = appendAppLog(base, "info: discord thread created: "+id)
+}
+
+// discordStartThread starts a public thread from a channel message.
+func discordStartThread(token, channelID, messageID, name string) (string, error) {
+    u := fmt.Sprintf("%s/channels/%s/messages/%s/threads", discordAPI, channelID, messageID)
+    b, _ := json.Marshal(map[string]any{"name": name, "auto_archive_duration": discordThreadAutoArchiveMin})
+    req, _ := http.NewRequest("POST", u, bytes.NewReader(b))
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("Authorization", "Bot "+token)
+    resp, err := discordDo(req)
+    if err != nil { return "", err }
+    defer resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return "", discordStatusError("bot start thread", resp)
+    }
+    var res struct{ ID string `json:"id"` }
+    if err := json.NewDecoder(resp.Body).Decode(&res); err != nil { return "", err }
+    return res.ID, nil
+}
+
+// discordWebhookPostThread posts payload as a new forum post and returns the
+// message and thread IDs.
+func discordWebhookPostThread(info webhookInfo, name string, payload DiscordMessage) (string, string, error) {
+    b, _ := json.Marshal(struct {
+        DiscordMessage
+        ThreadName string `json:"thread_name"`
+    }{payload, name})
+    req, _ := http.NewRequest("POST", info.endpoint("", true), bytes.NewReader(b))
+    req.Header.Set("Content-Type", "application/json")
+    resp, err := discordDo(req)
+    if err != nil { return "", "", err }
+    defer resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return "", "", discordStatusError("webhook post thread", resp)
+    }
+    var res struct{ ID string `json:"id"`; ChannelID string `json:"channel_id"` }
+    if err := json.NewDecoder(resp.Body).Decode(&res); err != nil { return "", "", err }
+    return res.ID, res.ChannelID, nil
+}
+
+// discordArchiveThread archives and locks a thread (bot token only).
+func discordArchiveThread(token, threadID string) error {
+    u := fmt.Sprintf("%s/channels/%s", discordAPI, threadID)
+    b, _ := json.Marshal(map[string]any{"archived": true, "locked": true})
+    req, _ := http.NewRequest("PATCH", u, bytes.NewReader(b))
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("Authorization", "Bot "+token)
+    resp, err := discordDo(req)
+    if err != nil { return err }
+    defer resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return discordStatusError("bot archive thread", resp)
+    }
+    return nil
+}
+
+// archiveSessionThread closes the thread of a finished session.
+func archiveSessionThread(base, threadID string) {
+    if threadID == "" { return }
+    token := strings.TrimSpace(os.Getenv("DISCORD_BOT_TOKEN"))
+    if token == "" {
+        _ = appendAppLog(base, "info: discord thread "+threadID+" left open (archiving needs DISCORD_BOT_TOKEN; it auto-archives when inactive)")
+        return
+    }
+    if err := discordArchiveThread(token, threadID); err != nil {
+        if !isDiscordNotFound(err) {
+            _ = appendAppLog(base, "warn: discord thread archive failed: "+err.Error())
+        }
+        return
+    }
+    _ = appendAppLog(base, "info: discord thread archived: "+threadID)
+}
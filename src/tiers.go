@@ -0,0 +1,143 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Prize tiers: hitFlag id -> counter name.
+// 0 (当たり -> hit) and 1 (大当たり -> jackpot) always exist for backward
+// compatibility; extra tiers (e.g. super jackpot, consolation) come from
+// setting.json "tiers". Counters are stored per user in User.Counts. Tiers with
+// "highlight" (the built-in jackpot) are announced as jackpots.
+
+type PrizeTier struct {
+    ID        int    `json:"id"`
+    Label     string `json:"label"`
+    Counter   string `json:"counter"`
+    Highlight bool   `json:"highlight,omitempty"`
+}
+
+func defaultTiers() []PrizeTier {
+    return []PrizeTier{
+        {ID: 0, Label: "当たり", Counter: "hit"},
+        {ID: 1, Label: "大当たり", Counter: "jackpot", Highlight: true},
+    }
+}
+
+// tiersFromSettings validates the configured tiers and fills in the built-in
+// 0/1 tiers when they are missing. Invalid entries are reported as an error and
+// skipped. The result is ordered by id.
+func tiersFromSettings(cfg Settings) ([]PrizeTier, error) {
+    var out []PrizeTier
+    var errs []string
+    ids := map[int]bool{}
+    counters := map[string]bool{}
+    for i, t := range cfg.Tiers {
+        t.Counter = strings.TrimSpace(t.Counter)
+        t.Label = strings.TrimSpace(t.Label)
+        switch {
+        case t.ID < 0:
+            errs = append(errs, fmt.Sprintf("tiers[%d]: id must be >= 0", i))
+            continue
+        case t.Counter == "":
+            errs = append(errs, fmt.Sprintf("tiers[%d]: counter is empty", i))
+            continue
+        case ids[t.ID]:
+            errs = append(errs, fmt.Sprintf("tiers[%d]: duplicate id %d", i, t.ID))
+            continue
+        case counters[strings.ToLower(t.Counter)]:
+            errs = append(errs, fmt.Sprintf("tiers[%d]: duplicate counter %q", i, t.Counter))
+            continue
+        }
+        if t.Label == "" { t.Label = t.Counter }
+        ids[t.ID] = true
+        counters[strings.ToLower(t.Counter)] = true
+        out = append(out, t)
+    }
+    for _, d := range defaultTiers() {
+        if !ids[d.ID] && !counters[d.Counter] {
+            out = append(out, d)
+        }
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+    if len(errs) > 0 {
+        return out, fmt.Errorf("%s", strings.Join(errs, "; "))
+    }
+    return out, nil
+}
+
+func loadTiers(base string, cfg Settings) []PrizeTier {
+    tiers, err := tiersFromSettings(cfg)
+    if err != nil {
+        _ = appendAppLog(base, "warn: invalid tiers in setting.json: "+err.Error())
+    }
+    return tiers
+}
+
+func findTier(tiers []PrizeTier, id int) (PrizeTier, bool) {
+    for _, t := range tiers {
+        if t.ID == id { return t, true }
+    }
+    return PrizeTier{}, false
+}
+
+// tierCounter maps a hitFlag to its counter name; unknown ids (e.g. a tier
+// removed from settings after it was journaled) map to "tier<N>".
+func tierCounter(tiers []PrizeTier, id int) string {
+    if t, ok := findTier(tiers, id); ok { return t.Counter }
+    switch id {
+    case 0:
+        return "hit"
+    case 1:
+        return "jackpot"
+    }
+    return "tier" + strconv.Itoa(id)
+}
+
+func tierCountersText(tiers []PrizeTier) string {
+    cs := make([]string, 0, len(tiers))
+    for _, t := range tiers {
+        cs = append(cs, t.Counter)
+    }
+    return strings.Join(cs, ", ")
+}
+
+func tierIDsText(tiers []PrizeTier) string {
+    ids := make([]string, 0, len(tiers))
+    for _, t := range tiers {
+        ids = append(ids, strconv.Itoa(t.ID))
+    }
+    return strings.Join(ids, ", ")
+}
+
+// normalizeUserCounts migrates legacy hit/jackpot into Counts (when Counts is
+// absent) and refreshes the hit/jackpot mirrors from Counts.
+func normalizeUserCounts(u *User) {
+    if u.Counts == nil {
+        u.Counts = map[string]int{}
+        if u.Hit > 0 { u.Counts["hit"] = u.Hit }
+        if u.Jackpot > 0 { u.Counts["jackpot"] = u.Jackpot }
+    }
+    for k, v := range u.Counts {
+        if v <= 0 { delete(u.Counts, k) }
+    }
+    u.Hit = u.Counts["hit"]
+    u.Jackpot = u.Counts["jackpot"]
+}
+
+func normalizeStateCounts(st *State) {
+    for i := range st.Users {
+        normalizeUserCounts(&st.Users[i])
+    }
+}
+
+func totalCount(u User) int {
+    n := 0
+    for _, v := range u.Counts {
+        n += v
+    }
+    return n
+}
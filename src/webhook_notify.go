@@ -0,0 +1,218 @@
+package main
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Generic outgoing webhooks (setting.json "webhooks").
+// Each change is POSTed as a versioned JSON payload. The body is signed with
+// HMAC-SHA256 over "<X-Gacha-Timestamp>.<body>" and sent as
+// "X-Gacha-Signature: sha256=<hex>" so receivers can verify origin and age;
+// a hook without a secret is sent unsigned with a warning in app.log.
+// Payloads that fail with a network error, 408, 429 or 5xx are queued in the
+// outbox and retried with backoff (up to webhookMaxAttempts, in order per
+// URL); other 4xx answers are not retried.
+
+const (
+    webhookPayloadVersion = 1
+    webhookMaxAttempts    = 8 // about 10 minutes of retries
+)
+
+var webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+// webhookUnsignedWarned remembers the URLs already warned about in this process.
+var webhookUnsignedWarned sync.Map
+
+type webhookStatusError struct {
+    Code   int
+    Status string
+}
+
+func (e *webhookStatusError) Error() string { return "webhook post failed: " + e.Status }
+
+// webhookRetryable reports whether a failed post may succeed later.
+func webhookRetryable(err error) bool {
+    var se *webhookStatusError
+    if !errors.As(err, &se) { return !errors.Is(err, errWebhookRemoved) }
+    return se.Code == http.StatusRequestTimeout || se.Code == http.StatusTooManyRequests || se.Code >= 500
+}
+
+var errWebhookRemoved = errors.New("webhook no longer in setting.json")
+
+type OutgoingWebhook struct {
+    URL    string   `json:"url"`
+    Secret string   `json:"secret,omitempty"` // falls back to env GACHA_WEBHOOK_SECRET
+    Events []string `json:"events,omitempty"` // event types to send (empty: all)
+}
+
+type webhookUser struct {
+    Name         string         `json:"name"`
+    Counts       map[string]int `json:"counts"`
+    Hit          int            `json:"hit"`
+    Jackpot      int            `json:"jackpot"`
+    Status       string         `json:"status"`
+    Present      string         `json:"present"`
+    Rewards      []string       `json:"rewards"`
+    HasReference bool           `json:"hasReference"`
+}
+
+type webhookPayload struct {
+    Version      int            `json:"version"`
+    ID           string         `json:"id"`
+    Type         string         `json:"type"`
+    At           string         `json:"at"`
+    Session      string         `json:"session,omitempty"`
+    Name         string         `json:"name,omitempty"` // affected user (also set when the user was removed)
+    User         *webhookUser   `json:"user,omitempty"`
+    HitFlag      *int           `json:"hitFlag,omitempty"`
+    Counter      string         `json:"counter,omitempty"`
+    Status       string         `json:"status,omitempty"`
+    HasReference *bool          `json:"hasReference,omitempty"`
+    Deltas       map[string]int `json:"deltas,omitempty"`
+    Undoes       int64          `json:"undoes,omitempty"`
+    Backup       string         `json:"backup,omitempty"`
+    UserCount    int            `json:"userCount"`
+    Totals       map[string]int `json:"totals"` // per-counter sum over all users
+}
+
+type webhookNotifier struct {
+    hook OutgoingWebhook
+}
+
+func (n webhookNotifier) Name() string { return "webhook " + redactURL(n.hook.URL) }
+
+func (n webhookNotifier) Notify(base string, events []ChangeEvent, st State) error {
+    if n.secret() == "" {
+        if _, warned := webhookUnsignedWarned.LoadOrStore(n.hook.URL, true); !warned {
+            _ = appendAppLog(base, "warn: webhook "+redactURL(n.hook.URL)+" has no secret (set \"secret\" or GACHA_WEBHOOK_SECRET); payloads are sent unsigned")
+        }
+    }
+    // earlier payloads still queued for this URL go first so the receiver sees
+    // the events in order; while some remain, new ones are queued behind them
+    if _, _, err := flushOutboxItems(base, false, func(it OutboxItem) bool { return it.Target == outboxWebhook && it.URL == n.hook.URL }); err != nil {
+        _ = appendAppLog(base, "warn: discord outbox write failed: "+err.Error())
+    }
+    backlog := webhookQueued(base, n.hook.URL)
+    session := currentSessionID(base)
+    totals := map[string]int{}
+    for _, u := range st.Users {
+        for k, v := range u.Counts {
+            totals[k] += v
+        }
+    }
+    for _, ev := range events {
+        if !n.wants(ev.Type) { continue }
+        p := webhookPayload{
+            Version: webhookPayloadVersion, ID: ev.EventID, Type: ev.Type, At: ev.At, Session: session, Name: ev.Name,
+            HitFlag: ev.HitFlag, Counter: ev.Counter, Status: ev.Status, HasReference: ev.HasReference,
+            Deltas: ev.Deltas, Undoes: ev.Undoes, Backup: ev.Backup,
+            UserCount: len(st.Users), Totals: totals,
+        }
+        if p.ID == "" { p.ID = newEventID() }
+        if u := ev.User; u != nil {
+            p.User = &webhookUser{Name: u.Name, Counts: u.Counts, Hit: u.Hit, Jackpot: u.Jackpot, Status: u.Status, Present: u.Present, Rewards: u.Rewards, HasReference: u.HasReference}
+            if p.User.Counts == nil { p.User.Counts = map[string]int{} }
+            if p.User.Rewards == nil { p.User.Rewards = []string{} }
+        }
+        var err error
+        if !backlog { err = n.post(p) }
+        switch {
+        case backlog:
+            if qerr := queueWebhook(base, n.hook.URL, p, nil); qerr != nil {
+                _ = appendAppLog(base, "warn: discord outbox write failed: "+qerr.Error())
+            }
+        case err == nil:
+            _ = appendAppLog(base, fmt.Sprintf("info: webhook sent: type=%s id=%s url=%s", p.Type, p.ID, redactURL(n.hook.URL)))
+        case webhookRetryable(err):
+            _ = appendAppLog(base, fmt.Sprintf("warn: webhook failed, queued for retry: type=%s id=%s url=%s: %s", p.Type, p.ID, redactURL(n.hook.URL), err.Error()))
+            if qerr := queueWebhook(base, n.hook.URL, p, err); qerr != nil {
+                _ = appendAppLog(base, "warn: discord outbox write failed: "+qerr.Error())
+            }
+            backlog = true
+        default:
+            _ = appendAppLog(base, fmt.Sprintf("warn: webhook rejected, not retried: type=%s id=%s url=%s: %s", p.Type, p.ID, redactURL(n.hook.URL), err.Error()))
+        }
+    }
+    return nil
+}
+
+// webhookOutboxKey identifies a queued payload; the URL is hashed so tokens in
+// it do not show up in the queue listing.
+func webhookOutboxKey(url, id string) string {
+    sum := sha256.Sum256([]byte(url))
+    return "__WEBHOOK__::" + hex.EncodeToString(sum[:4]) + "::" + id
+}
+
+// sendQueuedWebhook posts a queued payload with the hook's current secret.
+func sendQueuedWebhook(base string, it OutboxItem) error {
+    if it.Webhook == nil { return errWebhookRemoved }
+    for _, h := range loadSettings(base).Webhooks {
+        if h.URL == it.URL { return webhookNotifier{hook: h}.post(*it.Webhook) }
+    }
+    return errWebhookRemoved
+}
+
+func (n webhookNotifier) secret() string {
+    if n.hook.Secret != "" { return n.hook.Secret }
+    return os.Getenv("GACHA_WEBHOOK_SECRET")
+}
+
+func (n webhookNotifier) wants(typ string) bool {
+    if len(n.hook.Events) == 0 { return true }
+    for _, e := range n.hook.Events {
+        if strings.EqualFold(strings.TrimSpace(e), typ) { return true }
+    }
+    return false
+}
+
+func (n webhookNotifier) post(p webhookPayload) error {
+    body, err := json.Marshal(p)
+    if err != nil { return err }
+    ts := strconv.FormatInt(time.Now().Unix(), 10)
+    req, err := http.NewRequest("POST", n.hook.URL, bytes.NewReader(body))
+    if err != nil { return err }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("User-Agent", "gacha/"+version)
+    req.Header.Set("X-Gacha-Event", p.Type)
+    req.Header.Set("X-Gacha-Timestamp", ts)
+    if secret := n.secret(); secret != "" {
+        req.Header.Set("X-Gacha-Signature", "sha256="+signWebhook(secret, ts, body))
+    }
+    resp, err := webhookClient.Do(req)
+    if err != nil { return err }
+    defer resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return &webhookStatusError{Code: resp.StatusCode, Status: resp.Status}
+    }
+    return nil
+}
+
+func signWebhook(secret, ts string, body []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(ts))
+    mac.Write([]byte("."))
+    mac.Write(body)
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// redactURL drops the path/query (which often carries a token) for logs.
+func redactURL(raw string) string {
+    if i := strings.Index(raw, "://"); i >= 0 {
+        rest := raw[i+3:]
+        if j := strings.IndexAny(rest, "/?"); j >= 0 { rest = rest[:j] }
+        return raw[:i+3] + rest
+    }
+    return raw
+}
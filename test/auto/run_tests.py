@@ -5,6 +5,9 @@ import re
 import shutil
 import subprocess
 import sys
+import time
+import urllib.error
+import urllib.request
 from pathlib import Path
 
 ROOT = Path(__file__).resolve().parents[2]
@@ -21,8 +24,11 @@ def read_json(p: Path):
         return json.load(f)
 
 def writef(p: Path, data: str):
+    # replace atomically: a running API server may read the file meanwhile
     p.parent.mkdir(parents=True, exist_ok=True)
-    p.write_text(data, encoding='utf-8')
+    tmp = p.with_name('.' + p.name + '.test-tmp')
+    tmp.write_text(data, encoding='utf-8')
+    os.replace(tmp, p)
 
 def prepare():
     if TESTDIR.exists():
@@ -47,9 +53,57 @@ def assert_user(state, name, hit, jackpot, illust, gif):
     assert bool(u['flags']['illust']) == bool(illust)
     assert bool(u['flags']['gif']) == bool(gif)
 
+def write_backup(name, users, **extra):
+    doc = {'users': users, 'updatedAt': '2025-01-01T00:00:00Z'}
+    doc.update(extra)
+    writef(TESTDIR/'backups'/name, json.dumps(doc, ensure_ascii=False, indent=2))
+
+def backup_user(name, hit, jackpot=0):
+    return {'name': name, 'hit': hit, 'jackpot': jackpot, 'counts': {'hit': hit, 'jackpot': jackpot},
+            'flags': {'illust': hit >= 1, 'gif': hit >= 3 or jackpot >= 1}, 'hasReference': False}
+
 def load_state():
     return read_json(TESTDIR / 'data' / 'current.json')
 
+def http_json(url, data=None, method=None):
+    body = None if data is None else json.dumps(data).encode('utf-8')
+    req = urllib.request.Request(url, data=body, method=method, headers={'Content-Type': 'application/json'})
+    with urllib.request.urlopen(req, timeout=5) as r:
+        raw = r.read()
+        return json.loads(raw) if raw else None
+
+def start_serve(exe, port):
+    srv = subprocess.Popen([str(exe), 'serve', str(port)], cwd=TESTDIR, stdout=subprocess.DEVNULL, stderr=subprocess.DEVNULL)
+    for _ in range(50):
+        try:
+            http_json(f'http://127.0.0.1:{port}/api/health')
+            return srv
+        except OSError:
+            time.sleep(0.1)
+    srv.kill()
+    raise AssertionError(f'serve {port} did not start')
+
+def stop_serve(srv):
+    srv.kill()
+    srv.wait()
+
+def start_fake_discord(exe, port):
+    fake = subprocess.Popen([str(exe), 'fake-discord', str(port)], cwd=TESTDIR, stdout=subprocess.DEVNULL, stderr=subprocess.DEVNULL)
+    for _ in range(50):
+        try:
+            http_json(f'http://127.0.0.1:{port}/_fake/messages')
+            return fake
+        except OSError:
+            time.sleep(0.1)
+    fake.kill()
+    raise AssertionError(f'fake-discord {port} did not start')
+
+def update_settings(**kv):
+    cfg = read_json(TESTDIR/'setting.json')
+    cfg.update(kv)
+    writef(TESTDIR/'setting.json', json.dumps(cfg, ensure_ascii=False, indent=2))
+    return cfg
+
 def main():
     exe = prepare()
     passed = []
@@ -81,6 +135,21 @@ def main():
     assert_user(st, '山田 太郎', 1, 0, True, False)
     passed.append('4: space & jp name')
 
+    # 4b) 同時実行（バースト）でも加算が失われない
+    procs = [subprocess.Popen([str(exe), 'burst', '0'], cwd=TESTDIR, stdout=subprocess.DEVNULL, stderr=subprocess.DEVNULL) for _ in range(10)]
+    for p in procs:
+        assert p.wait() == 0
+    st = load_state()
+    assert_user(st, 'burst', 10, 0, True, True)
+    # the API server started by the burst may still hold the lock for a moment
+    # (its notifier reads a snapshot); a lock left behind would stay
+    for lk in (TESTDIR/'data'/'.lock', TESTDIR/'data'/'.notify.lock'):
+        for _ in range(40):
+            if not lk.exists(): break
+            time.sleep(0.05)
+        assert not lk.exists(), f'{lk.name} left behind'
+    passed.append('4b: concurrent burst')
+
     # 5) 無効フラグ
     before = st
     p = subprocess.run([str(exe), 'userX', '2'], cwd=TESTDIR)
@@ -105,7 +174,562 @@ def main():
     assert re.search(r"window.__GACHA_DATA__\s*=\s*\{", datajs), 'data.js invalid'
     passed.append('7: gen data.js')
 
-    # logs
+    # 8) Discord まとめ（疑似Discordサーバー）
+    port = 3961
+    fake = start_fake_discord(exe, port)
+    try:
+        fake_url = f'http://127.0.0.1:{port}'
+        cfg = read_json(TESTDIR/'setting.json')
+        cfg.update({'discordEnabled': True, 'singleWriter': False, 'discordApiBase': fake_url + '/api/v10'})
+        writef(TESTDIR/'setting.json', json.dumps(cfg, ensure_ascii=False, indent=2))
+        writef(TESTDIR/'.env.local', 'DISCORD_WEBHOOK_URL=https://discord.com/api/webhooks/1/token\n')
+        run([str(exe), 'userD', '0'], cwd=TESTDIR)
+        run([str(exe), 'userE', '0'], cwd=TESTDIR)
+        msgs = http_json(fake_url + '/_fake/messages')
+        assert len(msgs) == 1, msgs  # 2回目は編集
+        # 429 では再投稿しない（重複まとめを作らない）
+        http_json(fake_url + '/_fake/inject', {'method': 'PATCH', 'status': 429, 'retryAfter': 0.2})
+        run([str(exe), 'userF', '0'], cwd=TESTDIR)
+        msgs = http_json(fake_url + '/_fake/messages')
+        assert len(msgs) == 1, msgs
+        assert 'userF' in msgs[0]['embeds'][0]['fields'][-1]['value']
+        # 404（削除済み）なら新規投稿してマッピングを更新
+        http_json(fake_url + '/_fake/inject', {'method': 'PATCH', 'status': 404})
+        run([str(exe), 'userG', '0'], cwd=TESTDIR)
+        msgs = http_json(fake_url + '/_fake/messages')
+        assert len(msgs) == 2, msgs
+        assert msgs[-1]['id'] in read_json(TESTDIR/'data'/'discord_map.json').values()
+        # 500 は送信待ちに入り、flush で再送
+        http_json(fake_url + '/_fake/inject', {'method': 'PATCH', 'status': 500})
+        run([str(exe), 'userH', '0'], cwd=TESTDIR)
+        assert len(read_json(TESTDIR/'data'/'discord_outbox.json')) == 1
+        run([str(exe), 'discord', 'flush'], cwd=TESTDIR)
+        assert read_json(TESTDIR/'data'/'discord_outbox.json') == []
+        msgs = http_json(fake_url + '/_fake/messages')
+        assert 'userH' in msgs[-1]['embeds'][0]['fields'][-1]['value']
+    finally:
+        fake.kill()
+        (TESTDIR/'.env.local').unlink(missing_ok=True)
+    passed.append('8: discord upsert via fake server')
+
+    # 9) 壊れた current.json の復旧（当選は復旧後の状態に適用）
+    cfg = read_json(TESTDIR/'setting.json')
+    cfg.update({'discordEnabled': False, 'singleWriter': False})
+    writef(TESTDIR/'setting.json', json.dumps(cfg, ensure_ascii=False, indent=2))
+    run([str(exe), 'userR', '0'], cwd=TESTDIR)
+    run([str(exe), 'userR', '1'], cwd=TESTDIR)
+    cur = TESTDIR/'data'/'current.json'
+    raw = cur.read_text(encoding='utf-8')
+    writef(cur, raw[:len(raw)//2])
+    p = run([str(exe), 'userR', '0'], cwd=TESTDIR, expect=1)
+    assert 'recovered' in p.stderr + p.stdout, p.stderr
+    quarantined = list((TESTDIR/'data'/'quarantine').glob('current.*.json'))
+    assert len(quarantined) == 1, quarantined
+    assert quarantined[0].read_text(encoding='utf-8') == raw[:len(raw)//2]
+    st = load_state()
+    assert_user(st, 'userR', 2, 1, True, True)
+    assert any(u['name']=='userD' for u in st['users']), st
+    passed.append('9: corrupted current.json recovered')
+
+    # 10) バックアップの整理（backupRetention / prune-backups）と圧縮バックアップの復元
+    shutil.rmtree(TESTDIR/'backups')
+    for i, name in enumerate(['2025-01-01_100000', '2025-01-01_110000', '2025-01-02_100000', '2025-01-03_100000']):
+        write_backup(name + '.json', [backup_user('prune%d' % i, i + 1)], schemaVersion=1)
+    cfg = read_json(TESTDIR/'setting.json')
+    cfg['backupRetention'] = {'keepLast': 1, 'keepDaily': 2, 'keepWeekly': 0, 'keepMonthly': 0, 'compressAfter': 1}
+    writef(TESTDIR/'setting.json', json.dumps(cfg, ensure_ascii=False, indent=2))
+    before = sorted(p.name for p in (TESTDIR/'backups').iterdir())
+    p = run([str(exe), 'prune-backups', '--dry-run', '--json'], cwd=TESTDIR)
+    rep = json.loads(p.stdout)
+    actions = {e['name']: e['action'] for e in rep['entries']}
+    assert actions == {
+        '2025-01-03_100000.json': 'keep',
+        '2025-01-02_100000.json': 'compress',
+        '2025-01-01_110000.json': 'delete',
+        '2025-01-01_100000.json': 'delete',
+    }, actions
+    assert (rep['kept'], rep['compressed'], rep['deleted']) == (1, 1, 2), rep
+    assert sorted(p.name for p in (TESTDIR/'backups').iterdir()) == before, 'dry run changed backups'
+    run([str(exe), 'prune-backups'], cwd=TESTDIR)
+    names = sorted(p.name for p in (TESTDIR/'backups').glob('2025-*'))
+    assert names == ['2025-01-02_100000.json.gz', '2025-01-03_100000.js', '2025-01-03_100000.json'], names
+    run([str(exe), 'restore', '2025-01-02_100000'], cwd=TESTDIR)
+    st = load_state()
+    assert [u['name'] for u in st['users']] == ['prune2'], st
+    assert_user(st, 'prune2', 3, 0, True, True)
+    cfg['backupRetention'] = {'keepLast': 0, 'keepDaily': 0, 'keepWeekly': 0, 'keepMonthly': 0, 'compressAfter': 0}
+    writef(TESTDIR/'setting.json', json.dumps(cfg, ensure_ascii=False, indent=2))
+    passed.append('10: prune backups & restore compressed')
+
+    # 11) schemaVersion: 新しすぎるファイルの拒否、migrate --dry-run、旧形式バックアップの復元
+    cur = TESTDIR/'data'/'current.json'
+    raw = cur.read_text(encoding='utf-8')
+    doc = json.loads(raw)
+    doc['schemaVersion'] = 99
+    writef(cur, json.dumps(doc, ensure_ascii=False, indent=2))
+    too_new = cur.read_text(encoding='utf-8')
+    p = run([str(exe), 'gen-datajs'], cwd=TESTDIR, expect=1)
+    assert 'newer version' in p.stderr, p.stderr
+    assert cur.read_text(encoding='utf-8') == too_new, 'too-new current.json was modified'
+    legacy = {'users': [{'name': 'legacy', 'hit': 2, 'jackpot': 1, 'flags': {'illust': True, 'gif': True}, 'プレゼント': 'イラスト', 'present': 'イラスト'}],
+              'updatedAt': '2025-01-01T00:00:00Z'}
+    writef(cur, json.dumps(legacy, ensure_ascii=False, indent=2))
+    v0 = cur.read_text(encoding='utf-8')
+    p = run([str(exe), 'migrate', '--dry-run', '--json'], cwd=TESTDIR)
+    reps = {Path(r['file']).name: r for r in json.loads(p.stdout)}
+    assert (reps['current.json']['from'], reps['current.json']['to'], reps['current.json']['written']) == (0, 1, False), reps
+    assert cur.read_text(encoding='utf-8') == v0, 'migrate --dry-run changed current.json'
+    run([str(exe), 'migrate'], cwd=TESTDIR)
+    st = load_state()
+    assert st.get('schemaVersion') == 1, st
+    u = st['users'][0]
+    assert u['counts'] == {'hit': 2, 'jackpot': 1} and 'プレゼント' not in u and u['hasReference'] is False, u
+    write_backup('2025-02-01_100000.json', [{'name': 'old', 'hit': 1, 'jackpot': 0, 'flags': {'illust': True, 'gif': False}, 'プレゼント': 'イラスト'}])
+    bak = (TESTDIR/'backups'/'2025-02-01_100000.json').read_text(encoding='utf-8')
+    run([str(exe), 'restore', '2025-02-01_100000'], cwd=TESTDIR)
+    st = load_state()
+    assert_user(st, 'old', 1, 0, True, False)
+    assert st['users'][0]['counts'] == {'hit': 1} and 'プレゼント' not in st['users'][0], st
+    assert (TESTDIR/'backups'/'2025-02-01_100000.json').read_text(encoding='utf-8') == bak, 'backup was rewritten'
+    passed.append('11: schemaVersion refusal, dry run & v0 backup restore')
+
+    # 12) スナップショットの差分（gacha diff <backup> --json）
+    cfg = read_json(TESTDIR/'setting.json')
+    cfg['tiers'] = [t for t in cfg.get('tiers', []) if t['id'] != 2] + [{'id': 2, 'label': '超大当たり', 'counter': 'superJackpot'}]
+    writef(TESTDIR/'setting.json', json.dumps(cfg, ensure_ascii=False, indent=2))
+    for name in ['keep', 'gone', 'flip']:
+        run([str(exe), name, '0'], cwd=TESTDIR)
+    run([str(exe), 'backup', '--label', 'before diff'], cwd=TESTDIR)
+    snap = max(p.name for p in (TESTDIR/'backups').glob('*.json'))
+    run([str(exe), 'newbie', '2'], cwd=TESTDIR)
+    run([str(exe), 'adjust', 'gone', '--hit', '-1'], cwd=TESTDIR)
+    run([str(exe), 'keep', '2'], cwd=TESTDIR)
+    run([str(exe), 'keep', '1'], cwd=TESTDIR)
+    srv = start_serve(exe, 3962)
+    try:
+        api = 'http://127.0.0.1:3962'
+        http_json(api + '/api/user/status', {'name': 'flip', 'status': 'done'})
+        http_json(api + '/api/user/ref', {'name': 'flip', 'hasReference': True})
+    finally:
+        stop_serve(srv)
+    d = json.loads(run([str(exe), 'diff', snap, '--json'], cwd=TESTDIR).stdout)
+    assert (d['from'], d['to']) == (snap, 'current'), d
+    assert (d['added'], d['removed'], d['changed']) == (1, 1, 2), d
+    assert d['totals'] == {'hit': -1, 'jackpot': 1, 'superJackpot': 2}, d['totals']
+    users = {u['name']: u for u in d['users']}
+    assert [u['name'] for u in d['users']] == ['newbie', 'gone', 'flip', 'keep'], d['users']
+    assert users['newbie']['change'] == 'added' and users['newbie']['deltas'] == {'superJackpot': 1}, users['newbie']
+    assert users['newbie']['statusTo'] == 'none' and users['newbie']['refTo'] is False, users['newbie']
+    assert users['gone']['change'] == 'removed' and users['gone']['deltas'] == {'hit': -1}, users['gone']
+    assert users['keep']['change'] == 'changed' and users['keep']['deltas'] == {'jackpot': 1, 'superJackpot': 1}, users['keep']
+    assert 'statusFrom' not in users['keep'] and 'refTo' not in users['keep'], users['keep']
+    flip = users['flip']
+    assert 'deltas' not in flip, flip
+    assert (flip['statusFrom'], flip['statusTo'], flip['refFrom'], flip['refTo']) == ('none', 'done', False, True), flip
+    passed.append('12: diff against a backup')
+
+    # 13) 重複トリガーの抑止（debounceEnabled）: 失敗した呼び出しは抑止の対象にしない
+    cfg = read_json(TESTDIR/'setting.json')
+    cfg['debounceEnabled'], cfg['debounceWindowMs'] = True, 1500
+    writef(TESTDIR/'setting.json', json.dumps(cfg, ensure_ascii=False, indent=2))
+    run([str(exe), 'deb', '0'], cwd=TESTDIR)
+    p = run([str(exe), 'deb', '0'], cwd=TESTDIR)
+    assert 'suppressed' in p.stdout, p.stdout
+    run([str(exe), 'deb', '1'], cwd=TESTDIR)
+    users = {u['name']: u for u in load_state()['users']}
+    assert users['deb']['counts'] == {'hit': 1, 'jackpot': 1}, users['deb']
+    time.sleep(1.6)
+    run([str(exe), 'deb', '0'], cwd=TESTDIR)
+    users = {u['name']: u for u in load_state()['users']}
+    assert users['deb']['counts'] == {'hit': 2, 'jackpot': 1}, users['deb']
+    srv = start_serve(exe, 3963)
+    try:
+        api = 'http://127.0.0.1:3963'
+        cur = TESTDIR/'data'/'current.json'
+        good = cur.read_text(encoding='utf-8')
+        doc = json.loads(good)
+        doc['schemaVersion'] = 99
+        writef(cur, json.dumps(doc))
+        try:
+            http_json(api + '/api/event', {'winner': 'retry', 'hitFlag': '0'})
+            raise AssertionError('event on unreadable current.json succeeded')
+        except urllib.error.HTTPError as e:
+            assert e.code == 500, e.code
+        writef(cur, good)
+        r = http_json(api + '/api/event', {'winner': 'retry', 'hitFlag': '0'})
+        assert r == {'ok': True}, r
+        r = http_json(api + '/api/event', {'winner': 'retry', 'hitFlag': '0'})
+        assert r.get('suppressed') is True, r
+    finally:
+        stop_serve(srv)
+    users = {u['name']: u for u in load_state()['users']}
+    assert users['retry']['counts'] == {'hit': 1}, users['retry']
+    cfg['debounceEnabled'] = False
+    writef(TESTDIR/'setting.json', json.dumps(cfg, ensure_ascii=False, indent=2))
+    passed.append('13: debounce suppresses only accepted duplicates')
+
+    # 14) イベントジャーナル: rebuild / replay の結果が current.json と一致する
+    def users_of(st):
+        return sorted(({k: v for k, v in u.items() if k != 'updatedAt'} for u in st['users']), key=lambda u: u['name'])
+    before = load_state()
+    p = run([str(exe), 'replay'], cwd=TESTDIR)
+    assert users_of(json.loads(p.stdout)) == users_of(before), 'replay differs from current.json'
+    run([str(exe), 'rebuild'], cwd=TESTDIR)
+    assert users_of(load_state()) == users_of(before), 'rebuild differs from current.json'
+    assert read_json(TESTDIR/'data'/'current.before-rebuild.json')['users'] == before['users']
+    entries = [json.loads(l) for l in (TESTDIR/'data'/'journal.jsonl').read_text(encoding='utf-8').splitlines() if l.strip()]
+    seqs = [e['seq'] for e in entries]
+    assert seqs == sorted(seqs) and len(set(seqs)) == len(seqs), seqs
+    # --until は指定時刻より後のイベントを含めない
+    time.sleep(1.1)
+    until = time.strftime('%Y-%m-%dT%H:%M:%SZ', time.gmtime())
+    time.sleep(1.1)
+    run([str(exe), 'late', '0'], cwd=TESTDIR)
+    run([str(exe), 'keep', '0'], cwd=TESTDIR)
+    st = json.loads(run([str(exe), 'replay', '--until', until], cwd=TESTDIR).stdout)
+    assert users_of(st) == users_of(before), 'replay --until included later events'
+    st = json.loads(run([str(exe), 'replay'], cwd=TESTDIR).stdout)
+    assert users_of(st) == users_of(load_state()), 'replay differs after new wins'
+    assert any(u['name'] == 'late' for u in st['users']), st
+    passed.append('14: journal rebuild & replay match current.json')
+
+    # 15) 報酬ルールの変更と recompute
+    run([str(exe), 'reset'], cwd=TESTDIR)
+    for name, flag in [('rule1', '0'), ('rule1', '0'), ('rule2', '1'), ('rule3', '0')]:
+        run([str(exe), name, flag], cwd=TESTDIR)
+    users = {u['name']: u for u in load_state()['users']}
+    assert [users[n]['present'] for n in ['rule1', 'rule2', 'rule3']] == ['Illustration', 'Gif', 'Illustration'], users
+    cfg = read_json(TESTDIR/'setting.json')
+    cfg['rewards'] = [
+        {'name': 'Voice', 'condition': 'hit >= 2', 'priority': 30, 'label': 'ボイス'},
+        {'name': 'Gif', 'condition': 'hit >= 3 || jackpot >= 1', 'priority': 20, 'label': 'Gif'},
+        {'name': 'Illustration', 'condition': 'hit >= 1', 'priority': 10, 'label': 'イラスト'},
+    ]
+    writef(TESTDIR/'setting.json', json.dumps(cfg, ensure_ascii=False, indent=2))
+    p = run([str(exe), 'recompute'], cwd=TESTDIR)
+    assert '(1 changed)' in p.stdout, p.stdout
+    users = {u['name']: u for u in load_state()['users']}
+    assert users['rule1']['present'] == 'Voice', users['rule1']
+    assert set(users['rule1']['rewards']) == {'Voice', 'Illustration'}, users['rule1']
+    assert users['rule2']['present'] == 'Gif' and users['rule3']['present'] == 'Illustration', users
+    assert 'ボイス' in (TESTDIR/'data'/'data.js').read_text(encoding='utf-8'), 'data.js lacks the new reward'
+    # 新しい当選にもルールが適用される
+    run([str(exe), 'rule3', '0'], cwd=TESTDIR)
+    users = {u['name']: u for u in load_state()['users']}
+    assert users['rule3']['present'] == 'Voice', users['rule3']
+    # 不正なルール（存在しないカウンタ名）は既定ルールに戻して warn
+    cfg['rewards'] = [{'name': 'Voice', 'condition': 'hits >= 2', 'priority': 30}]
+    writef(TESTDIR/'setting.json', json.dumps(cfg, ensure_ascii=False, indent=2))
+    p = run([str(exe), 'recompute'], cwd=TESTDIR)
+    assert '(2 changed)' in p.stdout, p.stdout
+    users = {u['name']: u for u in load_state()['users']}
+    assert [users[n]['present'] for n in ['rule1', 'rule2', 'rule3']] == ['Illustration', 'Gif', 'Illustration'], users
+    assert 'hits' in (TESTDIR/'logs'/'app.log').read_text(encoding='utf-8'), 'invalid rule not logged'
+    del cfg['rewards']
+    writef(TESTDIR/'setting.json', json.dumps(cfg, ensure_ascii=False, indent=2))
+    passed.append('15: reward rules & recompute')
+
+    # 16) 追加の当選区分（tiers）: hitFlag 2/9 の記録・未定義フラグの拒否・API/data.js への出力
+    cfg = read_json(TESTDIR/'setting.json')
+    cfg['tiers'] = [t for t in cfg.get('tiers', []) if t['id'] not in (2, 9)] + [
+        {'id': 2, 'label': '超大当たり', 'counter': 'superJackpot'},
+        {'id': 9, 'label': '残念賞', 'counter': 'consolation'},
+    ]
+    writef(TESTDIR/'setting.json', json.dumps(cfg, ensure_ascii=False, indent=2))
+    for flag in ['9', '2', '0', '9']:
+        run([str(exe), 'tiered', flag], cwd=TESTDIR)
+    users = {u['name']: u for u in load_state()['users']}
+    t = users['tiered']
+    assert t['counts'] == {'hit': 1, 'superJackpot': 1, 'consolation': 2}, t
+    assert (t['hit'], t['jackpot']) == (1, 0), t
+    before = (TESTDIR/'data'/'current.json').read_text(encoding='utf-8')
+    p = run([str(exe), 'tiered', '7'], cwd=TESTDIR, expect=1)
+    assert '0, 1, 2, 9' in p.stderr, p.stderr
+    assert (TESTDIR/'data'/'current.json').read_text(encoding='utf-8') == before, 'undefined hitFlag changed current.json'
+    run([str(exe), 'adjust', 'tiered', '--consolation', '-1'], cwd=TESTDIR)
+    users = {u['name']: u for u in load_state()['users']}
+    assert users['tiered']['counts'].get('consolation') == 1, users['tiered']
+    datajs = (TESTDIR/'data'/'data.js').read_text(encoding='utf-8')
+    data = json.loads(datajs[datajs.index('{'):datajs.rindex('}') + 1])
+    assert {t['counter'] for t in data['tiers']} >= {'hit', 'jackpot', 'superJackpot', 'consolation'}, data['tiers']
+    srv = start_serve(exe, 3964)
+    try:
+        api = 'http://127.0.0.1:3964'
+        s = http_json(api + '/api/settings')
+        assert [t['id'] for t in s['tiers']] == [t['id'] for t in data['tiers']], s['tiers']
+        r = http_json(api + '/api/event', {'winner': 'tiered', 'hitFlag': '2'})
+        assert r == {'ok': True}, r
+        try:
+            http_json(api + '/api/event', {'winner': 'tiered', 'hitFlag': '7'})
+            raise AssertionError('undefined hitFlag accepted by the API')
+        except urllib.error.HTTPError as e:
+            assert e.code == 400, e.code
+    finally:
+        stop_serve(srv)
+    users = {u['name']: u for u in load_state()['users']}
+    assert users['tiered']['counts'] == {'hit': 1, 'superJackpot': 2, 'consolation': 1}, users['tiered']
+    passed.append('16: extra prize tiers')
+
+    # 17) まとめのテンプレート（discordTemplates）: preview と実際の送信
+    run([str(exe), 'a_b*c', '0'], cwd=TESTDIR)
+    update_settings(discordTemplates={
+        'title': '{{escape .Title}} ({{.UserCount}}人)',
+        'line': '{{.Emoji}} **{{escape .User.Name}}** 当たり{{.User.Hit}}',
+        'groupHeader': '【{{.Header}}】{{.Count}}',
+        'footer': '更新',
+        'color': '#FF0000',
+    })
+    n = len(load_state()['users'])
+    embeds = json.loads(run([str(exe), 'discord', 'preview', '--json'], cwd=TESTDIR).stdout)
+    e = embeds[0]
+    assert e['title'].endswith(f' ({n}人)'), e['title']
+    assert e['color'] == 0xFF0000 and e['footer']['text'] == '更新', e
+    values = '\n'.join(f['value'] for f in e['fields'])
+    assert '**a\\_b\\*c** 当たり1' in values, values
+    assert all(re.fullmatch(r'【.*】\d+', f['name']) for f in e['fields']), [f['name'] for f in e['fields']]
+    port = 3965
+    fake = start_fake_discord(exe, port)
+    try:
+        fake_url = f'http://127.0.0.1:{port}'
+        update_settings(discordEnabled=True, discordApiBase=fake_url + '/api/v10')
+        writef(TESTDIR/'.env.local', 'DISCORD_WEBHOOK_URL=https://discord.com/api/webhooks/1/token\n')
+        run([str(exe), 'a_b*c', '0'], cwd=TESTDIR)
+        sent = http_json(fake_url + '/_fake/messages')[-1]['embeds'][0]
+        assert sent['title'] == e['title'] and sent['color'] == 0xFF0000, sent
+        assert '**a\\_b\\*c** 当たり2' in '\n'.join(f['value'] for f in sent['fields']), sent['fields']
+    finally:
+        fake.kill()
+        (TESTDIR/'.env.local').unlink(missing_ok=True)
+        update_settings(discordEnabled=False)
+    # 存在しない項目を参照するテンプレートは既定値で描画し、preview は終了コード1
+    update_settings(discordTemplates={'line': '{{.User.Nope}}'})
+    p = run([str(exe), 'discord', 'preview', '--json'], cwd=TESTDIR, expect=1)
+    assert 'Nope' in p.stderr, p.stderr
+    values = '\n'.join(f['value'] for f in json.loads(p.stdout)[0]['fields'])
+    assert 'a\\_b\\*c' in values and 'Nope' not in values, values
+    update_settings(discordTemplates={})
+    passed.append('17: discord templates')
+
+    # 18) 当選ごとの速報: 強調表示・件数制限・自動削除
+    port = 3966
+    fake = start_fake_discord(exe, port)
+    try:
+        fake_url = f'http://127.0.0.1:{port}'
+        update_settings(discordEnabled=True, discordApiBase=fake_url + '/api/v10', discordAnnounceEnabled=True,
+                        discordAnnouncePerMinute=2, discordAnnounceDeleteAfterMin=5)
+        writef(TESTDIR/'.env.local', 'DISCORD_WEBHOOK_URL=https://discord.com/api/webhooks/1/token\n')
+        def announcements():
+            return [m for m in http_json(fake_url + '/_fake/messages') if m.get('embeds') and m['embeds'][0].get('color') in (0x3B82F6, 0xF59E0B)]
+        # 当たり×2（通常）、3回目でGif到達（強調）、件数制限を超えた通常は投稿しない、大当たり（強調）
+        for name, flag in [('ann1', '0'), ('ann1', '0'), ('ann1', '0'), ('ann2', '0'), ('ann2', '1')]:
+            run([str(exe), name, flag], cwd=TESTDIR)
+        anns = announcements()
+        assert [m['embeds'][0]['color'] for m in anns] == [0x3B82F6, 0x3B82F6, 0xF59E0B, 0xF59E0B], anns
+        assert '「Gif」に到達' in anns[2]['embeds'][0]['description'] and 'ann1' in anns[2]['embeds'][0]['description'], anns[2]
+        assert 'ann2' in anns[3]['embeds'][0]['description'] and '大当たり' in anns[3]['embeds'][0]['description'], anns[3]
+        assert 'rate limit 2/min' in (TESTDIR/'logs'/'app.log').read_text(encoding='utf-8'), 'rate limit not logged'
+        # 期限切れの速報は次の当選（CLI）または gacha serve が削除する
+        alog_path = TESTDIR/'data'/'discord_announce.json'
+        alog = read_json(alog_path)
+        assert [m['id'] for m in alog['messages']] == [m['id'] for m in anns], alog
+        for m in alog['messages'][:2]:
+            m['deleteAt'] = '2000-01-01T00:00:00Z'
+        writef(alog_path, json.dumps(alog))
+        run([str(exe), 'ann3', '0'], cwd=TESTDIR)
+        assert [m['id'] for m in announcements()] == [m['id'] for m in anns[2:]], announcements()
+        alog = read_json(alog_path)
+        for m in alog['messages']:
+            m['deleteAt'] = '2000-01-01T00:00:00Z'
+        writef(alog_path, json.dumps(alog))
+        srv = start_serve(exe, 3967)
+        try:
+            for _ in range(50):
+                if not announcements():
+                    break
+                time.sleep(0.1)
+            assert announcements() == [], announcements()
+        finally:
+            stop_serve(srv)
+        assert read_json(alog_path)['messages'] == [], read_json(alog_path)
+    finally:
+        fake.kill()
+        (TESTDIR/'.env.local').unlink(missing_ok=True)
+        update_settings(discordEnabled=False, discordAnnounceEnabled=False)
+    passed.append('18: per-win announcements')
+
+    # 19) セッションごとのスレッド（Bot: まとめから開始 / Webhook: フォーラム投稿）
+    port = 3968
+    per_session = read_json(TESTDIR/'setting.json').get('discordNewMessagePerSession')
+    fake = start_fake_discord(exe, port)
+    try:
+        fake_url = f'http://127.0.0.1:{port}'
+        update_settings(discordEnabled=True, discordApiBase=fake_url + '/api/v10', discordNewMessagePerSession=True,
+                        discordThreadPerSession=True, discordAnnounceEnabled=True, discordAnnouncePerMinute=0,
+                        discordAnnounceDeleteAfterMin=0)
+        writef(TESTDIR/'.env.local', 'DISCORD_BOT_TOKEN=t\nDISCORD_CHANNEL_ID=c1\n')
+        def session():
+            return read_json(TESTDIR/'data'/'session.json')
+        def threads():
+            return {t['id']: t for t in http_json(fake_url + '/_fake/threads')}
+        def messages_in(cid):
+            return [m for m in http_json(fake_url + '/_fake/messages') if m['channel_id'] == cid]
+        time.sleep(1.1)
+        run([str(exe), 'reset'], cwd=TESTDIR)
+        run([str(exe), 'th1', '0'], cwd=TESTDIR)
+        run([str(exe), 'th2', '0'], cwd=TESTDIR)
+        s = session()
+        assert s.get('threadVia') == 'bot' and s['threadId'] in threads(), (s, threads())
+        first = s['threadId']
+        summary = [m for m in messages_in('c1') if m['id'] == first]
+        assert summary and 'th2' in json.dumps(summary[0]['embeds'], ensure_ascii=False), summary
+        anns = messages_in(first)
+        assert len(anns) == 2 and 'th1' in anns[0]['embeds'][0]['description'], anns
+        # 次のセッションで前のスレッドをアーカイブ＆ロックし、新しいスレッドを作る
+        time.sleep(1.1)
+        run([str(exe), 'reset'], cwd=TESTDIR)
+        run([str(exe), 'th3', '0'], cwd=TESTDIR)
+        ts = threads()
+        assert ts[first]['archived'] and ts[first]['locked'], ts[first]
+        s = session()
+        assert s['threadId'] != first and not ts[s['threadId']]['archived'], (s, ts)
+        assert len(messages_in(s['threadId'])) == 1, messages_in(s['threadId'])
+        # Webhookのみ: フォーラム投稿としてスレッドを作り、以降の更新・速報はスレッド内
+        writef(TESTDIR/'.env.local', 'DISCORD_WEBHOOK_URL=https://discord.com/api/webhooks/1/token\n')
+        time.sleep(1.1)
+        run([str(exe), 'reset'], cwd=TESTDIR)
+        run([str(exe), 'th4', '0'], cwd=TESTDIR)
+        run([str(exe), 'th5', '0'], cwd=TESTDIR)
+        s = session()
+        assert s.get('threadVia') == 'webhook' and s['threadId'] in threads(), s
+        assert read_json(TESTDIR/'data'/'discord_map.json').get('__THREAD__::' + s['id']) == s['threadId']
+        inside = messages_in(s['threadId'])
+        summaries = [m for m in inside if 'th5' in json.dumps(m['embeds'], ensure_ascii=False) and 'fields' in m['embeds'][0]]
+        assert len(summaries) == 1 and len(inside) == 3, inside
+    finally:
+        fake.kill()
+        (TESTDIR/'.env.local').unlink(missing_ok=True)
+        update_settings(discordEnabled=False, discordAnnounceEnabled=False, discordThreadPerSession=False,
+                        discordNewMessagePerSession=per_session)
+    passed.append('19: discord thread per session')
+
+    # 20) discord_map の再同期（resync）: 削除済みの記録・旧まとめのアーカイブ・孤立した記録・再投稿
+    port = 3969
+    per_session = read_json(TESTDIR/'setting.json').get('discordNewMessagePerSession')
+    fake = start_fake_discord(exe, port)
+    try:
+        fake_url = f'http://127.0.0.1:{port}'
+        update_settings(discordEnabled=True, discordApiBase=fake_url + '/api/v10', discordNewMessagePerSession=True,
+                        discordArchiveOldSummary=False)
+        writef(TESTDIR/'.env.local', 'DISCORD_WEBHOOK_URL=https://discord.com/api/webhooks/1/token\n')
+        writef(TESTDIR/'data'/'discord_map.json', json.dumps({'schemaVersion': 2}))
+        sids = []
+        for name in ['rs1', 'rs2', 'rs3']:
+            time.sleep(1.1)
+            run([str(exe), 'reset'], cwd=TESTDIR)
+            run([str(exe), name, '0'], cwd=TESTDIR)
+            sids.append(read_json(TESTDIR/'data'/'session.json')['id'])
+        keys = ['__SUMMARY__::' + sid for sid in sids]
+        dmap = read_json(TESTDIR/'data'/'discord_map.json')
+        assert all(dmap.get(k) for k in keys), dmap
+        # 1つ目のまとめをDiscord側で削除し、対応のない記録を追加
+        http_json(fake_url + '/api/v10/webhooks/1/token/messages/' + dmap[keys[0]], method='DELETE')
+        dmap['__ARCHIVED__::__SUMMARY__::19990101_000000'] = '2000-01-01T00:00:00Z'
+        dmap['__THREAD__::19990101_000000'] = '1'
+        writef(TESTDIR/'data'/'discord_map.json', json.dumps(dmap))
+        update_settings(discordArchiveOldSummary=True)
+        rep = json.loads(run([str(exe), 'discord', 'resync', '--json'], cwd=TESTDIR).stdout)
+        results = {e['key']: e['result'] for e in rep['entries']}
+        assert results == {keys[0]: 'missing', keys[1]: 'retitled', keys[2]: 'current',
+                           '__ARCHIVED__::__SUMMARY__::19990101_000000': 'dropped', '__THREAD__::19990101_000000': 'dropped'}, results
+        assert (rep['checked'], rep['marked'], rep['missing'], rep['dropped'], rep['errors']) == (3, 1, 1, 2, 0), rep
+        dmap = read_json(TESTDIR/'data'/'discord_map.json')
+        assert keys[0] not in dmap and dmap.get('__ARCHIVED__::' + keys[1]) and '__THREAD__::19990101_000000' not in dmap, dmap
+        old = http_json(fake_url + '/api/v10/webhooks/1/token/messages/' + dmap[keys[1]])
+        assert old['embeds'][0]['title'].startswith('['), old['embeds'][0]['title']
+        # 2回目は変更なし（アーカイブ済みは再編集しない）
+        edited = old.get('edited_timestamp')
+        rep = json.loads(run([str(exe), 'discord', 'resync', '--json'], cwd=TESTDIR).stdout)
+        assert {e['key']: e['result'] for e in rep['entries']} == {keys[1]: 'archived', keys[2]: 'current'}, rep
+        assert http_json(fake_url + '/api/v10/webhooks/1/token/messages/' + dmap[keys[1]]).get('edited_timestamp') == edited
+        # 再投稿（API）: 現在のまとめを削除して新しく投稿
+        srv = start_serve(exe, 3970)
+        try:
+            r = http_json('http://127.0.0.1:3970/api/discord/resync?repost=1', {})
+        finally:
+            stop_serve(srv)
+        assert r['ok'] is True and r['report']['reposted'] is True, r
+        new_id = read_json(TESTDIR/'data'/'discord_map.json')[keys[2]]
+        ids = [m['id'] for m in http_json(fake_url + '/_fake/messages')]
+        assert new_id != dmap[keys[2]] and new_id in ids and dmap[keys[2]] not in ids, (new_id, dmap[keys[2]], ids)
+    finally:
+        fake.kill()
+        (TESTDIR/'.env.local').unlink(missing_ok=True)
+        update_settings(discordEnabled=False, discordNewMessagePerSession=per_session)
+    passed.append('20: discord resync')
+
+    # 21) 名前→DiscordユーザーIDの対応表とメンション（まとめの行・完成メッセージ）
+    port = 3971
+    fake = start_fake_discord(exe, port)
+    try:
+        fake_url = f'http://127.0.0.1:{port}'
+        update_settings(discordEnabled=True, discordApiBase=fake_url + '/api/v10', discordMentionInSummary=True,
+                        discordMentionOnDone=True)
+        writef(TESTDIR/'.env.local', 'DISCORD_WEBHOOK_URL=https://discord.com/api/webhooks/1/token\n')
+        time.sleep(1.1)
+        run([str(exe), 'reset'], cwd=TESTDIR)
+        p = run([str(exe), 'discord', 'user', 'set', 'mn1', '<@111111111111111111>'], cwd=TESTDIR)
+        assert '111111111111111111' in p.stdout, p.stdout
+        run([str(exe), 'discord', 'user', 'set', 'gone', '333333333333333333'], cwd=TESTDIR)
+        run([str(exe), 'discord', 'user', 'remove', 'gone'], cwd=TESTDIR)
+        for name in ['mn1', 'mn2', 'mn3']:
+            run([str(exe), name, '0'], cwd=TESTDIR)
+        srv = start_serve(exe, 3972)
+        try:
+            api = 'http://127.0.0.1:3972'
+            r = http_json(api + '/api/discord/users', {'name': 'MN2', 'id': '222222222222222222'})
+            assert r['ok'] and r['id'] == '222222222222222222', r
+            assert http_json(api + '/api/discord/users')['users'] == {'mn1': '111111111111111111', 'MN2': '222222222222222222'}
+            def completions():
+                return [m for m in http_json(fake_url + '/_fake/messages') if 'さんの作品が完成しました' in m['content']]
+            for name in ['mn1', 'mn3']:
+                http_json(api + '/api/user/status', {'name': name, 'status': 'done'})
+            # 同じセッションでもう一度 done になっても再投稿しない
+            http_json(api + '/api/user/status', {'name': 'mn1', 'status': 'progress'})
+            http_json(api + '/api/user/status', {'name': 'mn1', 'status': 'done'})
+            for _ in range(50):
+                if len(completions()) >= 2:
+                    break
+                time.sleep(0.1)
+            time.sleep(0.5)
+            done = completions()
+            assert [m['content'] for m in done] == ['✅ <@111111111111111111> さんの作品が完成しました！', '✅ **mn3** さんの作品が完成しました！'], done
+            posts = [q['body'] for q in http_json(fake_url + '/_fake/requests')
+                     if q['method'] == 'POST' and q.get('body') and 'さんの作品が完成しました' in json.dumps(q['body'], ensure_ascii=False)]
+            assert [q['allowed_mentions'] for q in posts] == [{'parse': [], 'users': ['111111111111111111']}, {'parse': []}], posts
+            # まとめの行: 対応表にある名前（大文字小文字は区別しない）はメンション表示、ない名前はそのまま
+            http_json(api + '/api/user/ref', {'name': 'mn2', 'hasReference': True})
+            for _ in range(50):
+                lines = '\n'.join(f['value'] for m in http_json(fake_url + '/_fake/messages') if m['embeds'] and 'fields' in m['embeds'][0] for f in m['embeds'][0]['fields'])
+                if '<@222222222222222222>' in lines:
+                    break
+                time.sleep(0.1)
+            assert '<@111111111111111111>' in lines and '<@222222222222222222>' in lines and 'mn3' in lines, lines
+            assert http_json(api + '/api/discord/users?name=MN2', method='DELETE')['ok']
+        finally:
+            stop_serve(srv)
+        p = run([str(exe), 'discord', 'user', 'list'], cwd=TESTDIR)
+        assert 'mn1' in p.stdout and 'MN2' not in p.stdout and 'gone' not in p.stdout, p.stdout
+    finally:
+        fake.kill()
+        (TESTDIR/'.env.local').unlink(missing_ok=True)
+        update_settings(discordEnabled=False, discordMentionInSummary=False, discordMentionOnDone=False)
+    passed.append('21: discord mentions')
+
+    # logs (per-event JSON logs are written with eventJsonLog)
+    cfg = read_json(TESTDIR/'setting.json')
+    cfg['eventJsonLog'] = True
+    writef(TESTDIR/'setting.json', json.dumps(cfg, ensure_ascii=False, indent=2))
+    run([str(exe), 'logger', '0'], cwd=TESTDIR)
     assert any(p.suffix=='.json' for p in (TESTDIR/'logs').glob('*.json')), 'event logs missing'
     assert (TESTDIR/'logs'/'app.log').exists(), 'app.log missing'
 